@@ -0,0 +1,35 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	ctx2 "yema.dev/app/api/ctx"
+	"yema.dev/app/internal/errcode"
+	"yema.dev/app/internal/response"
+	"yema.dev/app/service/deploy"
+)
+
+type ArtifactCtl struct {
+	service *deploy.Service
+}
+
+// List 构建产物缓存列表
+func (ctl *ArtifactCtl) List(ctx *gin.Context) {
+	params := deploy.ArtifactListReq{SpaceId: ctx2.GetSpaceId(ctx)}
+	err := ctx.ShouldBind(&params)
+	if err != nil {
+		response.Fail(ctx, errcode.ErrInvalidParams.Wrap(err))
+		return
+	}
+	total, items, err := ctl.service.ArtifactList(&params)
+	response.PageData(ctx, total, items, err)
+}
+
+// Delete 删除构建产物缓存
+func (ctl *ArtifactCtl) Delete(ctx *gin.Context) {
+	spaceAndId, err := ctx2.GetSpaceWithId(ctx)
+	if err != nil {
+		response.Fail(ctx, errcode.ErrInvalidParams.Wrap(err))
+		return
+	}
+	response.Response(ctx, ctl.service.ArtifactDelete(spaceAndId), nil)
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/wuzfei/go-helper/slices"
+	ctx2 "yema.dev/app/api/ctx"
+	"yema.dev/app/internal/errcode"
+	"yema.dev/app/internal/response"
+	"yema.dev/app/model"
+	"yema.dev/app/model/field"
+	"yema.dev/app/service/credential"
+)
+
+type CredentialCtl struct {
+	service *credential.Service
+}
+
+func (ctl *CredentialCtl) Create(ctx *gin.Context) {
+	params := credential.CreateReq{SpaceId: ctx2.GetSpaceId(ctx)}
+	err := ctx.ShouldBindJSON(&params)
+	if err != nil {
+		response.Fail(ctx, errcode.ErrInvalidParams.Wrap(err))
+		return
+	}
+	response.Response(ctx, ctl.service.Create(&params), nil)
+}
+
+func (ctl *CredentialCtl) List(ctx *gin.Context) {
+	params := credential.ListReq{SpaceId: ctx2.GetSpaceId(ctx)}
+	err := ctx.ShouldBind(&params)
+	if err != nil {
+		response.Fail(ctx, errcode.ErrInvalidParams.Wrap(err))
+		return
+	}
+	total, items, err := ctl.service.List(&params)
+	response.PageData(ctx, total, items, err)
+}
+
+func (ctl *CredentialCtl) Update(ctx *gin.Context) {
+	params := credential.UpdateReq{SpaceId: ctx2.GetSpaceId(ctx)}
+	err := ctx.ShouldBindJSON(&params)
+	if err != nil {
+		response.Fail(ctx, errcode.ErrInvalidParams.Wrap(err))
+		return
+	}
+	response.Response(ctx, ctl.service.Update(&params), nil)
+}
+
+func (ctl *CredentialCtl) Delete(ctx *gin.Context) {
+	spaceAndId, err := ctx2.GetSpaceWithId(ctx)
+	if err != nil {
+		response.Fail(ctx, errcode.ErrInvalidParams.Wrap(err))
+		return
+	}
+	response.Response(ctx, ctl.service.Delete(spaceAndId), nil)
+}
+
+func (ctl *CredentialCtl) Options(ctx *gin.Context) {
+	params := credential.ListReq{SpaceId: ctx2.GetSpaceId(ctx)}
+	err := ctx.ShouldBind(&params)
+	if err != nil {
+		response.Fail(ctx, errcode.ErrInvalidParams.Wrap(err))
+		return
+	}
+	total, items, err := ctl.service.List(&params)
+	if err != nil {
+		response.Fail(ctx, err)
+		return
+	}
+	res := response.DataOptions{Total: total, Options: slices.Map(items, func(item *model.Credential, k int) response.DataOption {
+		return response.DataOption{
+			Text:   item.Name,
+			Value:  item.ID,
+			Status: field.StatusEnable,
+		}
+	})}
+	response.Success(ctx, res)
+}
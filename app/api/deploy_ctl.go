@@ -68,7 +68,35 @@ func (ctl *DeployCtl) Release(ctx *gin.Context) {
 		response.Fail(ctx, errcode.ErrInvalidParams.Wrap(err))
 		return
 	}
-	err = ctl.service.Release(spaceAndId, ctx2.UserId(ctx))
+	//不在发布窗口内时，负责人可以填写原因强制发布
+	err = ctl.service.Release(spaceAndId, ctx2.UserId(ctx), ctx.Query("override_reason"))
+	response.Response(ctx, err, nil)
+}
+
+// Schedule 设置或修改定时发布
+func (ctl *DeployCtl) Schedule(ctx *gin.Context) {
+	spaceAndId, err := ctx2.GetSpaceWithId(ctx)
+	if err != nil {
+		response.Fail(ctx, errcode.ErrInvalidParams.Wrap(err))
+		return
+	}
+	params := deploy.ScheduleReq{SpaceId: spaceAndId.SpaceId, UserId: ctx2.UserId(ctx), ID: spaceAndId.ID}
+	err = ctx.ShouldBindJSON(&params)
+	if err != nil {
+		response.Fail(ctx, errcode.ErrInvalidParams.Wrap(err))
+		return
+	}
+	response.Response(ctx, ctl.service.Schedule(&params), nil)
+}
+
+// CancelSchedule 取消定时发布
+func (ctl *DeployCtl) CancelSchedule(ctx *gin.Context) {
+	spaceAndId, err := ctx2.GetSpaceWithId(ctx)
+	if err != nil {
+		response.Fail(ctx, errcode.ErrInvalidParams.Wrap(err))
+		return
+	}
+	err = ctl.service.CancelSchedule(spaceAndId, ctx2.UserId(ctx))
 	response.Response(ctx, err, nil)
 }
 
@@ -90,7 +118,30 @@ func (ctl *DeployCtl) Rollback(ctx *gin.Context) {
 		response.Fail(ctx, errcode.ErrInvalidParams.Wrap(err))
 		return
 	}
-	err = ctl.service.Release(spaceAndId, ctx2.UserId(ctx))
+	err = ctl.service.Rollback(spaceAndId, ctx2.UserId(ctx))
+	response.Response(ctx, err, nil)
+}
+
+// Promote 灰度确认
+func (ctl *DeployCtl) Promote(ctx *gin.Context) {
+	spaceAndId, err := ctx2.GetSpaceWithId(ctx)
+	if err != nil {
+		response.Fail(ctx, errcode.ErrInvalidParams.Wrap(err))
+		return
+	}
+	//不在发布窗口内时，负责人可以填写原因强制发布
+	err = ctl.service.Promote(spaceAndId, ctx2.UserId(ctx), ctx.Query("override_reason"))
+	response.Response(ctx, err, nil)
+}
+
+// AbortCanary 取消灰度
+func (ctl *DeployCtl) AbortCanary(ctx *gin.Context) {
+	spaceAndId, err := ctx2.GetSpaceWithId(ctx)
+	if err != nil {
+		response.Fail(ctx, errcode.ErrInvalidParams.Wrap(err))
+		return
+	}
+	err = ctl.service.AbortCanary(spaceAndId, ctx2.UserId(ctx))
 	response.Response(ctx, err, nil)
 }
 
@@ -11,6 +11,7 @@ import (
 	"yema.dev/app/global"
 	"yema.dev/app/model"
 	"yema.dev/app/service/common"
+	"yema.dev/app/service/credential"
 	"yema.dev/app/service/environment"
 	"yema.dev/app/service/login"
 	"yema.dev/app/service/member"
@@ -79,6 +80,12 @@ func apiRoutes(r *gin.RouterGroup, s *Server) {
 		r.GET("/server_info", ctl.ServiceInfo)
 	}
 
+	//代码仓库webhook，通过项目配置的密钥校验
+	{
+		ctl := &WebhookCtl{service: global.Service.Deploy()}
+		r.POST("/webhook/:id", ctl.Deploy)
+	}
+
 	//用户管理
 	{
 		ctl := &UserCtl{service: user.NewService(global.Log, global.DB, global.Jwt)}
@@ -117,8 +124,23 @@ func apiRoutes(r *gin.RouterGroup, s *Server) {
 		ownerPermRouter.POST("/server/:id/check", ctl.Check)
 		//设置免登陆
 		ownerPermRouter.POST("/server/set_authorized", ctl.SetAuthorized)
+		//主机公钥，服务器重装后需要重置
+		ownerPermRouter.GET("/server/:id/host_key", ctl.HostKey)
+		ownerPermRouter.DELETE("/server/:id/host_key", ctl.ResetHostKey)
 		//websocket 连接终端
 		ownerPermRouter.GET("/server/:id/terminal", ctl.Terminal)
+		//ssh连接池状态，包含所有空间的连接
+		superPermRouter.GET("/server/ssh_pool", ctl.SshPool)
+	}
+
+	//服务器登录凭据
+	{
+		ctl := &CredentialCtl{service: credential.NewService(global.DB)}
+		ownerPermRouter.GET("/credential", ctl.List)
+		ownerPermRouter.POST("/credential", ctl.Create)
+		ownerPermRouter.DELETE("/credential/:id", ctl.Delete)
+		ownerPermRouter.PUT("/credential", ctl.Update)
+		ownerPermRouter.GET("/credential/options", ctl.Options)
 	}
 
 	//环境管理
@@ -157,12 +179,26 @@ func apiRoutes(r *gin.RouterGroup, s *Server) {
 		masterPermRouter.POST("/deploy/:id/audit", ctl.Audit)
 		//发布
 		masterPermRouter.GET("/deploy/:id/release", ctl.Release)
+		//定时发布，重复设置即修改定时时间
+		masterPermRouter.POST("/deploy/:id/schedule", ctl.Schedule)
+		masterPermRouter.DELETE("/deploy/:id/schedule", ctl.CancelSchedule)
 		//发布
 		masterPermRouter.GET("/deploy/:id/stop_release", ctl.StopRelease)
 		//发布
 		masterPermRouter.GET("/deploy/:id/rollback", ctl.Rollback)
+		//灰度确认
+		masterPermRouter.GET("/deploy/:id/promote", ctl.Promote)
+		//取消灰度
+		masterPermRouter.GET("/deploy/:id/abort_canary", ctl.AbortCanary)
 		//websocket, 部署日志, 将整个部署过程日志输出
 		masterPermRouter.GET("/deploy/:id/console", ctl.Console)
 	}
 
+	//构建产物缓存
+	{
+		ctl := &ArtifactCtl{service: global.Service.Deploy()}
+		masterPermRouter.GET("/artifact", ctl.List)
+		masterPermRouter.DELETE("/artifact/:id", ctl.Delete)
+	}
+
 }
@@ -12,6 +12,7 @@ import (
 	"gorm.io/gorm"
 	"net"
 	"net/http"
+	"yema.dev/app/global"
 	"yema.dev/app/internal/validate"
 	"yema.dev/app/pkg/jwt"
 	"yema.dev/app/pkg/repo"
@@ -65,6 +66,7 @@ func (s *Server) Run(ctx context.Context) error {
 	var group errgroup.Group
 	group.Go(func() error {
 		<-ctx.Done()
+		global.Service.Close()
 		return s.server.Shutdown(context.Background())
 	})
 	group.Go(func() error {
@@ -73,6 +73,29 @@ func (ctl *ServerCtl) SetAuthorized(ctx *gin.Context) {
 	response.Response(ctx, ctl.service.SetAuthorized(&params), nil)
 }
 
+func (ctl *ServerCtl) HostKey(ctx *gin.Context) {
+	spaceAndId, err := ctx2.GetSpaceWithId(ctx)
+	if err != nil {
+		response.Fail(ctx, errcode.ErrInvalidParams.Wrap(err))
+		return
+	}
+	res, err := ctl.service.HostKey(spaceAndId)
+	response.Response(ctx, err, res)
+}
+
+func (ctl *ServerCtl) ResetHostKey(ctx *gin.Context) {
+	spaceAndId, err := ctx2.GetSpaceWithId(ctx)
+	if err != nil {
+		response.Fail(ctx, errcode.ErrInvalidParams.Wrap(err))
+		return
+	}
+	response.Response(ctx, ctl.service.ResetHostKey(spaceAndId), nil)
+}
+
+func (ctl *ServerCtl) SshPool(ctx *gin.Context) {
+	response.Success(ctx, ctl.service.SshPool())
+}
+
 func (ctl *ServerCtl) Terminal(ctx *gin.Context) {
 	spaceAndId, err := ctx2.GetSpaceWithId(ctx)
 	if err != nil {
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"strconv"
+	"yema.dev/app/internal/errcode"
+	"yema.dev/app/internal/response"
+	"yema.dev/app/pkg/webhook"
+	"yema.dev/app/service/deploy"
+)
+
+type WebhookCtl struct {
+	service *deploy.Service
+}
+
+// Deploy 代码仓库推送事件触发创建上线单
+func (ctl *WebhookCtl) Deploy(ctx *gin.Context) {
+	projectId, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil || projectId <= 0 {
+		response.Fail(ctx, errcode.ErrInvalidParams)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(ctx.Request.Body, 5<<20))
+	if err != nil {
+		response.Fail(ctx, errcode.ErrInvalidParams.Wrap(err))
+		return
+	}
+	task, err := ctl.service.Webhook(projectId, ctx.Request.Header, body)
+	if errors.Is(err, webhook.ErrIgnored) {
+		response.Success(ctx, gin.H{"ignored": true})
+		return
+	}
+	if task == nil {
+		response.Fail(ctx, err)
+		return
+	}
+	response.Response(ctx, err, gin.H{"task_id": task.ID, "status": task.Status})
+}
@@ -8,6 +8,7 @@ import (
 	"yema.dev/app/pkg/jwt"
 	"yema.dev/app/pkg/log"
 	"yema.dev/app/pkg/repo"
+	"yema.dev/app/pkg/secret"
 	"yema.dev/app/pkg/ssh"
 	"yema.dev/app/service"
 )
@@ -21,6 +22,7 @@ type Config struct {
 	JWT     jwt.Config
 	Log     log.Config
 	Ssh     ssh.Config
+	Secret  secret.Config
 	Service service.Config
 }
 
@@ -29,6 +31,7 @@ func (conf Config) Init() {
 	errs2 := errs.Group{}
 	errs2.Add(
 		global.InitLog(&conf.Log),
+		global.InitSecret(&conf.Secret),
 		global.InitDB(&conf.Db),
 		global.InitJwt(&conf.JWT),
 		global.InitRepo(&conf.Repo),
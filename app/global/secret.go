@@ -0,0 +1,14 @@
+package global
+
+import (
+	"yema.dev/app/model/field"
+	"yema.dev/app/pkg/secret"
+)
+
+var Secret *secret.Secret
+
+func InitSecret(conf *secret.Config) (err error) {
+	Secret, err = secret.NewSecret(conf)
+	field.SetSecret(Secret)
+	return
+}
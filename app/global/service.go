@@ -3,6 +3,7 @@ package global
 import (
 	s2 "yema.dev/app/service"
 	"yema.dev/app/service/deploy"
+	"yema.dev/app/service/notice"
 )
 
 var Service *service
@@ -10,6 +11,7 @@ var Service *service
 type service struct {
 	config *s2.Config
 	deploy *deploy.Service
+	notice *notice.Service
 }
 
 func InitService(conf *s2.Config) (err error) {
@@ -21,7 +23,21 @@ func InitService(conf *s2.Config) (err error) {
 
 func (s *service) Deploy() *deploy.Service {
 	if s.deploy == nil {
-		s.deploy = deploy.NewService(DB, Log, Ssh, Repo, &s.config.Deploy)
+		s.deploy = deploy.NewService(DB, Log, Ssh, Repo, s.Notice(), &s.config.Deploy)
 	}
 	return s.deploy
 }
+
+// Close 停止后台调度，未使用的服务不需要关闭
+func (s *service) Close() {
+	if s.deploy != nil {
+		s.deploy.Close()
+	}
+}
+
+func (s *service) Notice() *notice.Service {
+	if s.notice == nil {
+		s.notice = notice.NewService(Log, &s.config.Notice)
+	}
+	return s.notice
+}
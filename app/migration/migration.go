@@ -46,6 +46,10 @@ func (m *Migration) InitTables() error {
 		&model.Record{},
 		&model.Task{},
 		&model.TaskServer{},
+		&model.Artifact{},
+		&model.Credential{},
+		&model.Approval{},
+		&model.Override{},
 	)
 }
 
@@ -0,0 +1,78 @@
+package migration
+
+import (
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"strings"
+	"yema.dev/app/pkg/secret"
+)
+
+// secretColumns 需要加密存储的字段，直接读写原始数据，避免经过Encrypted字段解密
+var secretColumns = []struct {
+	table   string
+	columns []string
+}{
+	{"projects", []string{"repo_password", "task_vars", "repo_private_key", "notice_secret", "webhook_secret"}},
+	{"credentials", []string{"password", "private_key", "passphrase"}},
+}
+
+// EncryptSecrets 加密历史明文数据，并使用当前密钥重新加密旧密钥加密的数据
+func (m *Migration) EncryptSecrets(s *secret.Secret) error {
+	if s == nil {
+		return errors.New("未配置加密密钥，请先设置secret.key或者secret.key-file")
+	}
+	for _, table := range secretColumns {
+		selects := []string{"id"}
+		for _, col := range table.columns {
+			selects = append(selects, fmt.Sprintf("COALESCE(%s, '') AS %s", col, col))
+		}
+		rows, err := m.db.Table(table.table).Select(strings.Join(selects, ", ")).Rows()
+		if err != nil {
+			return err
+		}
+		updates := make(map[int64]map[string]any)
+		for rows.Next() {
+			var id int64
+			values := make([]string, len(table.columns))
+			dest := []any{&id}
+			for i := range values {
+				dest = append(dest, &values[i])
+			}
+			if err = rows.Scan(dest...); err != nil {
+				_ = rows.Close()
+				return err
+			}
+			for i, col := range table.columns {
+				if !s.NeedRotate(values[i]) {
+					continue
+				}
+				plain, err := s.Decrypt(values[i])
+				if err != nil {
+					_ = rows.Close()
+					return fmt.Errorf("解密数据[%s, id:%d, %s]出错：%w", table.table, id, col, err)
+				}
+				if updates[id] == nil {
+					updates[id] = make(map[string]any)
+				}
+				if updates[id][col], err = s.Encrypt(plain); err != nil {
+					_ = rows.Close()
+					return err
+				}
+			}
+		}
+		//读取中途出错时不能只更新已读取的部分
+		err = rows.Err()
+		_ = rows.Close()
+		if err != nil {
+			return err
+		}
+		for id, columns := range updates {
+			if err = m.db.Table(table.table).Where("id = ?", id).UpdateColumns(columns).Error; err != nil {
+				return err
+			}
+		}
+		m.log.Info("加密敏感数据完成", zap.String("table", table.table), zap.Int("rows", len(updates)))
+	}
+	return nil
+}
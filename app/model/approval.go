@@ -0,0 +1,24 @@
+package model
+
+import (
+	"time"
+)
+
+const (
+	ApprovalReject = 0 //拒绝
+	ApprovalPass   = 1 //通过
+)
+
+// Approval 上线单审核记录，每个用户对同一个上线单只能审核一次
+type Approval struct {
+	ID       int64  `gorm:"column:id;primaryKey;autoIncrement;" json:"id"`
+	TaskId   int64  `gorm:"column:task_id;notNull;uniqueIndex:task_user;comment:上线单" json:"task_id"`
+	UserId   int64  `gorm:"column:user_id;notNull;uniqueIndex:task_user;comment:审核人" json:"user_id"`
+	Role     string `gorm:"column:role;size:20;notNull;default:'';comment:审核时的角色" json:"role"`
+	Approved int8   `gorm:"column:approved;notNull;default:0;comment:是否通过" json:"approved"`
+	Comment  string `gorm:"column:comment;type:string;size:500;notNull;default:'';comment:审核意见" json:"comment"`
+
+	CreatedAt time.Time `gorm:"column:created_at;type:datetime;notNull" json:"created_at"`
+
+	User User `json:"user,omitempty"`
+}
@@ -0,0 +1,23 @@
+package model
+
+import "time"
+
+// Artifact 构建产物缓存，相同仓库、提交和构建脚本的发布复用已打包的程序包
+type Artifact struct {
+	ID         int64     `gorm:"column:id;primaryKey;autoIncrement;" json:"id"`
+	SpaceId    int64     `gorm:"column:space_id;notNull;index;comment:所属空间" json:"space_id"`
+	ProjectId  int64     `gorm:"column:project_id;notNull;default:0;comment:构建项目" json:"project_id"`
+	TaskId     int64     `gorm:"column:task_id;notNull;default:0;comment:构建任务" json:"task_id"`
+	Key        string    `gorm:"column:cache_key;size:64;notNull;uniqueIndex;comment:缓存key" json:"key"`
+	RepoUrl    string    `gorm:"column:repo_url;size:200;notNull;default:'';comment:仓库地址" json:"repo_url"`
+	CommitId   string    `gorm:"column:commit_id;size:64;notNull;default:'';comment:提交hash" json:"commit_id"`
+	BuildHash  string    `gorm:"column:build_hash;size:64;notNull;default:'';comment:构建脚本hash" json:"build_hash"`
+	Path       string    `gorm:"column:path;size:500;notNull;default:'';comment:程序包路径" json:"path"`
+	Size       int64     `gorm:"column:size;notNull;default:0;comment:程序包大小" json:"size"`
+	LastUsedAt time.Time `gorm:"column:last_used_at;type:datetime;notNull;comment:最后使用时间" json:"last_used_at"`
+
+	Project Project `json:"project"`
+
+	CreatedAt time.Time `gorm:"column:created_at;type:datetime;notNull" json:"created_at"`
+	UpdatedAt time.Time `gorm:"column:updated_at;type:datetime;notNull" json:"updated_at"`
+}
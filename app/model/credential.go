@@ -0,0 +1,34 @@
+package model
+
+import (
+	"gorm.io/gorm"
+	"time"
+	"yema.dev/app/model/field"
+)
+
+const (
+	CredentialTypePassword = "password" //密码登录
+	CredentialTypeKey      = "key"      //密钥登录
+
+	CredentialNotDefault = 0
+	CredentialIsDefault  = 1 //空间默认凭据，服务器未指定凭据时使用
+)
+
+// Credential 服务器登录凭据，密码和私钥加密存储
+type Credential struct {
+	ID          int64           `gorm:"column:id;primaryKey;autoIncrement;" json:"id"`
+	SpaceId     int64           `gorm:"column:space_id;index;notNull;comment:所属空间" json:"space_id"`
+	Name        string          `gorm:"column:name;type:string;size:100;notNull;comment:名称" json:"name"`
+	Type        string          `gorm:"column:type;size:20;notNull;default:'';comment:凭据类型" json:"type"`
+	Password    field.Encrypted `gorm:"column:password;size:500;notNull;default:'';comment:登录密码" json:"-"`
+	PrivateKey  field.Encrypted `gorm:"column:private_key;type:text;comment:登录私钥" json:"-"`
+	Passphrase  field.Encrypted `gorm:"column:passphrase;size:500;notNull;default:'';comment:私钥密码" json:"-"`
+	PublicKey   string          `gorm:"column:public_key;size:1000;notNull;default:'';comment:公钥" json:"public_key"`
+	Fingerprint string          `gorm:"column:fingerprint;size:100;notNull;default:'';comment:公钥指纹" json:"fingerprint"`
+	IsDefault   int8            `gorm:"column:is_default;notNull;default:0;comment:是否空间默认凭据" json:"is_default"`
+	Description string          `gorm:"column:description;type:string;size:500;notNull;default:'';comment:简介说明" json:"description"`
+
+	CreatedAt time.Time      `gorm:"column:created_at;type:datetime;notNull" json:"created_at"`
+	UpdatedAt time.Time      `gorm:"column:updated_at;type:datetime;notNull" json:"updated_at"`
+	DeletedAt gorm.DeletedAt `gorm:"column:deleted_at;index" json:"-"`
+}
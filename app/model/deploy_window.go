@@ -0,0 +1,131 @@
+package model
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DeployWindow 允许发布的时间窗口，格式类似cron，支持*、数字、范围和逗号分隔的列表，
+// 例如周一到周五的9点到17点：{"weekdays": "1-5", "hours": "9-17"}
+type DeployWindow struct {
+	Weekdays string `json:"weekdays"` //星期，0和7都表示周日
+	Hours    string `json:"hours"`    //小时，0-23，9-17表示9:00到17:59
+}
+
+// Match 时间是否在窗口内
+func (w DeployWindow) Match(t time.Time) bool {
+	weekdays, err := parseCronField(w.Weekdays, 0, 7)
+	if err != nil {
+		return false
+	}
+	hours, err := parseCronField(w.Hours, 0, 23)
+	if err != nil {
+		return false
+	}
+	weekday := int(t.Weekday())
+	return (weekdays[weekday] || weekday == 0 && weekdays[7]) && hours[t.Hour()]
+}
+
+// Validate 检查窗口格式
+func (w DeployWindow) Validate() error {
+	if _, err := parseCronField(w.Weekdays, 0, 7); err != nil {
+		return fmt.Errorf("星期格式错误：%s", err)
+	}
+	if _, err := parseCronField(w.Hours, 0, 23); err != nil {
+		return fmt.Errorf("小时格式错误：%s", err)
+	}
+	return nil
+}
+
+// DeployFreeze 封版时间段，期间禁止发布
+type DeployFreeze struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Reason string    `json:"reason"`
+}
+
+type DeployWindows []DeployWindow
+
+func (w *DeployWindows) Scan(value any) error {
+	*w = make(DeployWindows, 0)
+	return scanJSONList(value, w)
+}
+
+func (w DeployWindows) Value() (driver.Value, error) {
+	if len(w) == 0 {
+		return "", nil
+	}
+	r, err := json.Marshal(w)
+	return string(r), err
+}
+
+type DeployFreezes []DeployFreeze
+
+func (f *DeployFreezes) Scan(value any) error {
+	*f = make(DeployFreezes, 0)
+	return scanJSONList(value, f)
+}
+
+func (f DeployFreezes) Value() (driver.Value, error) {
+	if len(f) == 0 {
+		return "", nil
+	}
+	r, err := json.Marshal(f)
+	return string(r), err
+}
+
+func scanJSONList(value any, dst any) error {
+	var bytes []byte
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []byte:
+		bytes = v
+	case string:
+		bytes = []byte(v)
+	default:
+		return errors.New("type error")
+	}
+	if len(bytes) < 3 {
+		return nil
+	}
+	return json.Unmarshal(bytes, dst)
+}
+
+// parseCronField 解析cron格式的字段，返回允许的取值
+func parseCronField(spec string, min, max int) (map[int]bool, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, errors.New("不能为空")
+	}
+	res := make(map[int]bool)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		from, to := min, max
+		if part != "*" {
+			start, end, isRange := strings.Cut(part, "-")
+			var err error
+			if from, err = strconv.Atoi(strings.TrimSpace(start)); err != nil {
+				return nil, fmt.Errorf("[%s]不是有效的数字", part)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(strings.TrimSpace(end)); err != nil {
+					return nil, fmt.Errorf("[%s]不是有效的范围", part)
+				}
+			}
+		}
+		if from < min || to > max || from > to {
+			return nil, fmt.Errorf("[%s]超出范围%d-%d", part, min, max)
+		}
+		for i := from; i <= to; i++ {
+			res[i] = true
+		}
+	}
+	return res, nil
+}
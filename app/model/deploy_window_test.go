@@ -0,0 +1,59 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckDeployTime(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skip(err)
+	}
+	env := &Environment{
+		Name:           "prod",
+		DeployTimezone: "Asia/Shanghai",
+		DeployWindows:  DeployWindows{{Weekdays: "1-4", Hours: "9-17"}, {Weekdays: "5", Hours: "9-11"}},
+		DeployFreezes: DeployFreezes{{
+			Start:  time.Date(2024, 9, 30, 0, 0, 0, 0, shanghai),
+			End:    time.Date(2024, 10, 8, 0, 0, 0, 0, shanghai),
+			Reason: "国庆封版",
+		}},
+	}
+	cases := []struct {
+		name    string
+		now     time.Time
+		allowed bool
+	}{
+		{"weekday", time.Date(2024, 9, 10, 10, 0, 0, 0, shanghai), true},
+		{"last hour", time.Date(2024, 9, 10, 17, 59, 0, 0, shanghai), true},
+		{"after hours", time.Date(2024, 9, 10, 18, 0, 0, 0, shanghai), false},
+		{"friday afternoon", time.Date(2024, 9, 13, 14, 0, 0, 0, shanghai), false},
+		{"sunday", time.Date(2024, 9, 15, 10, 0, 0, 0, shanghai), false},
+		{"timezone", time.Date(2024, 9, 10, 2, 0, 0, 0, time.UTC), true},
+		{"freeze", time.Date(2024, 10, 8, 10, 0, 0, 0, shanghai).Add(-24 * time.Hour), false},
+		{"freeze end", time.Date(2024, 10, 8, 10, 0, 0, 0, shanghai), true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := env.CheckDeployTime(c.now); (err == nil) != c.allowed {
+				t.Fatalf("err: %v", err)
+			}
+		})
+	}
+}
+
+func TestDeployWindowValidate(t *testing.T) {
+	valid := []DeployWindow{{"*", "*"}, {"0,6,7", "0-23"}, {"1-3, 5", "9-12,14-18"}}
+	for _, w := range valid {
+		if err := w.Validate(); err != nil {
+			t.Errorf("%v: %v", w, err)
+		}
+	}
+	invalid := []DeployWindow{{"", "*"}, {"1-8", "*"}, {"5-1", "*"}, {"*", "24"}, {"mon", "*"}}
+	for _, w := range invalid {
+		if err := w.Validate(); err == nil {
+			t.Errorf("%v: expected error", w)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"fmt"
 	"gorm.io/gorm"
 	"time"
 	"yema.dev/app/model/field"
@@ -14,6 +15,14 @@ type Environment struct {
 	Description string       `gorm:"column:description;type:string;size:500;notNull;default:'';comment:简介说明" json:"description"`
 	Color       string       `gorm:"column:color;size:10;notNull;default:'';comment:主题色" json:"color"`
 
+	ApprovalCount   int                  `gorm:"column:approval_count;notNull;default:0;comment:上线单需要审核通过的人数,为0时由项目决定是否审核" json:"approval_count"`
+	ApprovalRoles   field.Slices[string] `gorm:"column:approval_roles;notNull;default:'';comment:可以审核的角色,为空不限制" json:"approval_roles"`
+	ApprovalUserIds field.Slices[int64]  `gorm:"column:approval_user_ids;notNull;default:'';comment:可以审核的用户,为空不限制" json:"approval_user_ids"`
+
+	DeployTimezone string        `gorm:"column:deploy_timezone;size:50;notNull;default:'';comment:发布窗口时区,为空使用服务所在时区" json:"deploy_timezone"`
+	DeployWindows  DeployWindows `gorm:"column:deploy_windows;type:text;comment:允许发布的时间窗口,为空不限制" json:"deploy_windows"`
+	DeployFreezes  DeployFreezes `gorm:"column:deploy_freezes;type:text;comment:封版时间段" json:"deploy_freezes"`
+
 	CreatedAt time.Time      `gorm:"column:created_at;type:datetime;notNull" json:"created_at"`
 	UpdatedAt time.Time      `gorm:"column:updated_at;type:datetime;notNull" json:"updated_at"`
 	DeletedAt gorm.DeletedAt `gorm:"column:deleted_at;index" json:"-"`
@@ -21,3 +30,60 @@ type Environment struct {
 	Space    Space      `json:"space"`
 	Projects []*Project `json:"projects"`
 }
+
+// HasApprovalPolicy 环境配置了审核策略时，不论项目是否开启审核，上线单都需要按策略审核
+func (e *Environment) HasApprovalPolicy() bool {
+	return e.ApprovalCount > 0 || len(e.ApprovalRoles) > 0 || len(e.ApprovalUserIds) > 0
+}
+
+// ApprovalRequired 上线单需要审核通过的人数，至少一人
+func (e *Environment) ApprovalRequired() int {
+	if e.ApprovalCount < 1 {
+		return 1
+	}
+	return e.ApprovalCount
+}
+
+// CanApprove 用户是否可以审核该环境的上线单，同时配置了角色和用户时满足其一即可
+func (e *Environment) CanApprove(userId int64, role Role) bool {
+	if len(e.ApprovalRoles) == 0 && len(e.ApprovalUserIds) == 0 {
+		return true
+	}
+	for _, r := range e.ApprovalRoles {
+		if Role(r) == role {
+			return true
+		}
+	}
+	for _, id := range e.ApprovalUserIds {
+		if id == userId {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckDeployTime 检查时间是否允许发布，处于封版期间或者不在任何发布窗口内时返回原因
+func (e *Environment) CheckDeployTime(now time.Time) error {
+	for _, f := range e.DeployFreezes {
+		if !now.Before(f.Start) && now.Before(f.End) {
+			return fmt.Errorf("该环境[%s]处于封版期间(%s至%s)：%s", e.Name,
+				f.Start.Format("2006-01-02 15:04"), f.End.Format("2006-01-02 15:04"), f.Reason)
+		}
+	}
+	if len(e.DeployWindows) == 0 {
+		return nil
+	}
+	if e.DeployTimezone != "" {
+		loc, err := time.LoadLocation(e.DeployTimezone)
+		if err != nil {
+			return fmt.Errorf("该环境[%s]发布窗口时区错误：%s", e.Name, err)
+		}
+		now = now.In(loc)
+	}
+	for _, w := range e.DeployWindows {
+		if w.Match(now) {
+			return nil
+		}
+	}
+	return fmt.Errorf("该环境[%s]当前不在允许发布的时间窗口内", e.Name)
+}
@@ -0,0 +1,63 @@
+package field
+
+import (
+	"database/sql/driver"
+	"errors"
+	"yema.dev/app/pkg/secret"
+)
+
+var cipher *secret.Secret
+
+// SetSecret 设置Encrypted字段使用的加解密
+func SetSecret(s *secret.Secret) {
+	cipher = s
+}
+
+// SecretEnabled 是否配置了加密密钥
+func SecretEnabled() bool {
+	return cipher != nil
+}
+
+// Encrypted 加密存储的字符串，写入数据库时加密，读取时解密，未配置密钥时明文存储
+type Encrypted string
+
+func (e *Encrypted) Scan(value any) error {
+	var text string
+	switch v := value.(type) {
+	case []byte:
+		text = string(v)
+	case string:
+		text = v
+	case nil:
+		text = ""
+	default:
+		return errors.New("type error")
+	}
+	if !secret.IsEncrypted(text) {
+		*e = Encrypted(text)
+		return nil
+	}
+	if cipher == nil {
+		return errors.New("未配置加密密钥，无法解密数据")
+	}
+	plain, err := cipher.Decrypt(text)
+	if err != nil {
+		return err
+	}
+	*e = Encrypted(plain)
+	return nil
+}
+
+func (e Encrypted) Value() (driver.Value, error) {
+	if e == "" {
+		return "", nil
+	}
+	if cipher == nil {
+		return string(e), nil
+	}
+	return cipher.Encrypt(string(e))
+}
+
+func (e Encrypted) String() string {
+	return string(e)
+}
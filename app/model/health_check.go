@@ -0,0 +1,37 @@
+package model
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+)
+
+const (
+	HealthCheckHttp    = "http"    //在服务器上请求http地址，校验状态码和响应内容
+	HealthCheckTcp     = "tcp"     //检查服务器本机端口是否可以连接
+	HealthCheckCommand = "command" //在发布目录执行命令，退出码为0为成功
+)
+
+// HealthCheck 发布后健康检查
+type HealthCheck struct {
+	Type         string `json:"type"`
+	Url          string `json:"url"`           //http检查地址，在目标服务器上请求，例如http://127.0.0.1:8080/health
+	ExpectStatus int    `json:"expect_status"` //期望的状态码，为0时要求2xx
+	ExpectBody   string `json:"expect_body"`   //响应内容需要匹配的正则，为空时不检查
+	Port         int    `json:"port"`          //tcp检查端口
+	Command      string `json:"command"`       //检查命令
+}
+
+type HealthChecks []HealthCheck
+
+func (h *HealthChecks) Scan(value any) error {
+	*h = make(HealthChecks, 0)
+	return scanJSONList(value, h)
+}
+
+func (h HealthChecks) Value() (driver.Value, error) {
+	if len(h) == 0 {
+		return "", nil
+	}
+	r, err := json.Marshal(h)
+	return string(r), err
+}
@@ -0,0 +1,17 @@
+package model
+
+import (
+	"time"
+)
+
+// Override 负责人强制在发布窗口外或封版期间发布的审计记录，每次强制发布启动成功后记录一条
+type Override struct {
+	ID     int64  `gorm:"column:id;primaryKey;autoIncrement;" json:"id"`
+	TaskId int64  `gorm:"column:task_id;notNull;index;comment:上线单" json:"task_id"`
+	UserId int64  `gorm:"column:user_id;notNull;comment:强制发布的负责人" json:"user_id"`
+	Reason string `gorm:"column:reason;type:string;size:500;notNull;default:'';comment:强制发布原因" json:"reason"`
+
+	CreatedAt time.Time `gorm:"column:created_at;type:datetime;notNull" json:"created_at"`
+
+	User User `json:"user,omitempty"`
+}
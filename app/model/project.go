@@ -12,6 +12,26 @@ const (
 
 	ProjectTaskAuditEnable  = 1
 	ProjectTaskAuditDisable = 0
+
+	ProjectReleaseAll     = 0 //全部服务器同时发布
+	ProjectReleaseRolling = 1 //分批滚动发布
+
+	ProjectWebhookAutoReleaseDisable = 0
+	ProjectWebhookAutoReleaseEnable  = 1
+
+	ProjectDistributeDirect = 0 //发布机直接推送程序包到每台服务器
+	ProjectDistributeSeed   = 1 //每批推送到第一台服务器，其余服务器从该服务器拉取
+	ProjectDistributeRelay  = 2 //推送到中转服务器，所有服务器从中转服务器拉取
+
+	ProjectTransferPackage  = 0 //每次上传完整程序包
+	ProjectTransferHardLink = 1 //增量发布，硬链接上一个版本目录后只传输变化的文件
+	ProjectTransferCopy     = 2 //增量发布，复制上一个版本目录后只传输变化的文件
+
+	ProjectDeployPackage = "package" //本地构建程序包，上传到服务器后切换软链接
+	ProjectDeployDocker  = "docker"  //构建或使用已有镜像，服务器拉取镜像后替换容器
+
+	ProjectServiceRestart = "restart"
+	ProjectServiceReload  = "reload"
 )
 
 type Project struct {
@@ -20,21 +40,23 @@ type Project struct {
 	EnvironmentId int64 `gorm:"column:environment_id;notNull;comment:所属环境" json:"environment_id"`
 	UserId        int64 `gorm:"column:user_id;notNull;comment:所属用户" json:"user_id"`
 
-	Name         string `gorm:"column:name;size:100;notNull;comment:名称" json:"name"`
-	RepoUrl      string `gorm:"column:repo_url;size:500;notNull;comment:仓库地址" json:"repo_url"`
-	RepoMode     string `gorm:"column:repo_mode;size:10;notNull;default:tag;comment:分支类型" json:"repo_mode"` // tag/branch
-	RepoUsername string `gorm:"column:repo_username;size:100;notNull;default:'';comment:仓库用户" json:"repo_username"`
-	RepoPassword string `gorm:"column:repo_password;size:100;notNull;default:'';comment:仓库密码" json:"repo_password"`
-	RepoType     string `gorm:"column:repo_type;size:20;notNull;default:git;comment:仓库类型" json:"repo_type"`
+	Name         string          `gorm:"column:name;size:100;notNull;comment:名称" json:"name"`
+	RepoUrl      string          `gorm:"column:repo_url;size:500;notNull;comment:仓库地址" json:"repo_url"`
+	RepoMode     string          `gorm:"column:repo_mode;size:10;notNull;default:tag;comment:分支类型" json:"repo_mode"` // tag/branch
+	RepoUsername string          `gorm:"column:repo_username;size:100;notNull;default:'';comment:仓库用户" json:"repo_username"`
+	RepoPassword field.Encrypted `gorm:"column:repo_password;size:500;notNull;default:'';comment:仓库密码,加密存储" json:"-"`
+	RepoType     string          `gorm:"column:repo_type;size:20;notNull;default:git;comment:仓库类型" json:"repo_type"`
+
+	RepoPrivateKey field.Encrypted `gorm:"column:repo_private_key;type:text;comment:仓库部署私钥,加密存储" json:"-"`
 
 	Excludes  string `gorm:"column:excludes;size:1000;notNull;default:'';comment:包含或者去除的文件列表" json:"excludes"` //包含或者去除的文件
 	IsInclude int8   `gorm:"column:is_include;notNull;default:0;comment:1去除0包含" json:"is_include"`             //是包含还是去除
 
-	TaskVars    string `gorm:"column:task_vars;size:1000;notNull;default:'';comment:全局环境变量" json:"task_vars"` //全局变量
-	PrevDeploy  string `gorm:"column:prev_deploy;size:1000;notNull;default:'';comment:编译前操作命令" json:"prev_deploy"`
-	PostDeploy  string `gorm:"column:post_deploy;size:1000;notNull;default:'';comment:编译后操作命令" json:"post_deploy"`
-	PrevRelease string `gorm:"column:prev_release;size:1000;notNull;default:'';comment:发布前操作命令" json:"prev_release"`
-	PostRelease string `gorm:"column:post_release;size:1000;notNull;default:'';comment:发布后操作命令" json:"post_release"`
+	TaskVars    field.Encrypted `gorm:"column:task_vars;type:text;comment:全局环境变量,加密存储" json:"task_vars"` //全局变量
+	PrevDeploy  string          `gorm:"column:prev_deploy;size:1000;notNull;default:'';comment:编译前操作命令" json:"prev_deploy"`
+	PostDeploy  string          `gorm:"column:post_deploy;size:1000;notNull;default:'';comment:编译后操作命令" json:"post_deploy"`
+	PrevRelease string          `gorm:"column:prev_release;size:1000;notNull;default:'';comment:发布前操作命令" json:"prev_release"`
+	PostRelease string          `gorm:"column:post_release;size:1000;notNull;default:'';comment:发布后操作命令" json:"post_release"`
 
 	TargetRoot     string `gorm:"column:target_root;size:500;notNull;default:'';comment:目标路径" json:"target_root"` //目标路径
 	TargetReleases string `gorm:"column:target_releases;size:500;notNull;default:'';comment:目标代码路径" json:"target_releases"`
@@ -42,10 +64,43 @@ type Project struct {
 	TaskAudit      int8   `gorm:"column:task_audit;notNull;default:1;comment:上线单是否开启审核" json:"task_audit"`          //上线单是否开启审核
 	Description    string `gorm:"column:description;size:500;notNull;default:'';comment:简介说明" json:"description"`
 
-	Master     string `gorm:"column:master" json:"master"`
-	Version    string `gorm:"column:version;size:100;notNull;default:'';comment:版本号" json:"version"`
-	NoticeType string `gorm:"column:notice_type" json:"notice_type"`
-	NoticeHook string `gorm:"column:notice_hook" json:"notice_hook"`
+	ReleaseStrategy int8 `gorm:"column:release_strategy;notNull;default:0;comment:发布策略,0全部同时1分批滚动" json:"release_strategy"`
+	BatchSize       int  `gorm:"column:batch_size;notNull;default:0;comment:每批发布服务器数量" json:"batch_size"` //为0时按BatchPercent计算
+	BatchPercent    int  `gorm:"column:batch_percent;notNull;default:0;comment:每批发布服务器百分比" json:"batch_percent"`
+	BatchPause      int  `gorm:"column:batch_pause;notNull;default:0;comment:批次间暂停时间(秒)" json:"batch_pause"`
+	BatchMaxFail    int  `gorm:"column:batch_max_fail;notNull;default:0;comment:单批次允许失败服务器数量" json:"batch_max_fail"` //超出则中止后续批次
+
+	DistributeMode    int8  `gorm:"column:distribute_mode;notNull;default:0;comment:程序包分发方式,0直接推送1种子服务器2中转服务器" json:"distribute_mode"`
+	DistributeRelayId int64 `gorm:"column:distribute_relay_id;notNull;default:0;comment:中转服务器" json:"distribute_relay_id"`
+	DistributeLimit   int   `gorm:"column:distribute_limit;notNull;default:0;comment:服务器间拉取限速(KB/s)" json:"distribute_limit"` //为0时不限速
+
+	TransferMode int8 `gorm:"column:transfer_mode;notNull;default:0;comment:传输方式,0完整程序包1增量硬链接2增量复制" json:"transfer_mode"`
+
+	DeployType      string `gorm:"column:deploy_type;size:20;notNull;default:package;comment:发布方式" json:"deploy_type"` // package/docker
+	DockerImage     string `gorm:"column:docker_image;size:300;notNull;default:'';comment:镜像地址,不含标签" json:"docker_image"`
+	DockerContainer string `gorm:"column:docker_container;size:100;notNull;default:'';comment:容器名称" json:"docker_container"`
+	DockerRunSpec   string `gorm:"column:docker_run_spec;size:2000;notNull;default:'';comment:docker run参数" json:"docker_run_spec"`
+
+	ServiceUnit         string `gorm:"column:service_unit;size:100;notNull;default:'';comment:发布后重启的systemd服务,为空时不处理" json:"service_unit"`
+	ServiceAction       string `gorm:"column:service_action;size:20;notNull;default:restart;comment:服务操作" json:"service_action"` // restart/reload
+	ServiceSudo         int8   `gorm:"column:service_sudo;notNull;default:0;comment:是否使用sudo操作服务" json:"service_sudo"`
+	ServiceWaitTimeout  int    `gorm:"column:service_wait_timeout;notNull;default:0;comment:等待服务启动超时时间(秒)" json:"service_wait_timeout"` //为0时使用默认值
+	ServiceJournalLines int    `gorm:"column:service_journal_lines;notNull;default:0;comment:失败时输出的日志行数" json:"service_journal_lines"`  //为0时使用默认值
+
+	HealthChecks   HealthChecks `gorm:"column:health_checks;type:text;comment:发布后健康检查" json:"health_checks"`
+	HealthTimeout  int          `gorm:"column:health_timeout;notNull;default:0;comment:健康检查超时时间(秒)" json:"health_timeout"`   //为0时使用默认值
+	HealthInterval int          `gorm:"column:health_interval;notNull;default:0;comment:健康检查重试间隔(秒)" json:"health_interval"` //为0时使用默认值
+
+	WebhookSecret      field.Encrypted `gorm:"column:webhook_secret;size:500;notNull;default:'';comment:webhook密钥,为空时不启用" json:"-"`
+	WebhookBranches    string          `gorm:"column:webhook_branches;size:500;notNull;default:'';comment:触发发布的分支规则" json:"webhook_branches"`
+	WebhookTags        string          `gorm:"column:webhook_tags;size:500;notNull;default:'';comment:触发发布的标签规则" json:"webhook_tags"`
+	WebhookAutoRelease int8            `gorm:"column:webhook_auto_release;notNull;default:0;comment:无需审核时是否立即发布" json:"webhook_auto_release"`
+
+	Master       string          `gorm:"column:master" json:"master"`
+	Version      string          `gorm:"column:version;size:100;notNull;default:'';comment:版本号" json:"version"`
+	NoticeType   string          `gorm:"column:notice_type;size:20;notNull;default:'';comment:通知方式" json:"notice_type"`
+	NoticeHook   string          `gorm:"column:notice_hook;size:500;notNull;default:'';comment:通知地址或收件人" json:"notice_hook"`
+	NoticeSecret field.Encrypted `gorm:"column:notice_secret;size:500;notNull;default:'';comment:通知签名密钥" json:"-"`
 
 	Status field.Status `gorm:"column:status;size:1;notNull;default:0;comment:状态" json:"status"`
 
@@ -58,6 +113,48 @@ type Project struct {
 	Servers     []Server     `gorm:"many2many:project_server" json:"servers,omitempty"`
 }
 
+// IsWebhookEnable 配置了webhook密钥才允许webhook触发
+func (p *Project) IsWebhookEnable() bool {
+	return p.WebhookSecret != ""
+}
+
 func (p *Project) IsTaskAudit() bool {
 	return p.TaskAudit == ProjectTaskAuditEnable
 }
+
+// IsDistribute 是否由服务器之间分发程序包
+func (p *Project) IsDistribute() bool {
+	return p.DistributeMode == ProjectDistributeSeed || p.DistributeMode == ProjectDistributeRelay
+}
+
+// IsIncremental 是否增量发布
+func (p *Project) IsIncremental() bool {
+	return p.TransferMode == ProjectTransferHardLink || p.TransferMode == ProjectTransferCopy
+}
+
+// IsDocker 是否以docker镜像发布
+func (p *Project) IsDocker() bool {
+	return p.DeployType == ProjectDeployDocker
+}
+
+// Image 指定标签的完整镜像地址
+func (p *Project) Image(tag string) string {
+	return p.DockerImage + ":" + tag
+}
+
+// BatchNum 每批发布的服务器数量
+func (p *Project) BatchNum(total int) int {
+	if p.ReleaseStrategy != ProjectReleaseRolling {
+		return total
+	}
+	if p.BatchSize > 0 {
+		return p.BatchSize
+	}
+	if p.BatchPercent > 0 {
+		n := (total*p.BatchPercent + 99) / 100
+		if n > 0 {
+			return n
+		}
+	}
+	return 1
+}
@@ -0,0 +1,25 @@
+package model
+
+import "testing"
+
+func TestBatchNum(t *testing.T) {
+	cases := []struct {
+		name    string
+		project Project
+		total   int
+		want    int
+	}{
+		{"all at once", Project{ReleaseStrategy: ProjectReleaseAll, BatchSize: 2}, 10, 10},
+		{"batch size", Project{ReleaseStrategy: ProjectReleaseRolling, BatchSize: 3, BatchPercent: 50}, 10, 3},
+		{"percent", Project{ReleaseStrategy: ProjectReleaseRolling, BatchPercent: 25}, 10, 3},
+		{"percent round up", Project{ReleaseStrategy: ProjectReleaseRolling, BatchPercent: 10}, 3, 1},
+		{"percent all", Project{ReleaseStrategy: ProjectReleaseRolling, BatchPercent: 100}, 7, 7},
+		{"default one", Project{ReleaseStrategy: ProjectReleaseRolling}, 10, 1},
+		{"no servers", Project{ReleaseStrategy: ProjectReleaseRolling, BatchPercent: 50}, 0, 1},
+	}
+	for _, c := range cases {
+		if got := c.project.BatchNum(c.total); got != c.want {
+			t.Errorf("%s: got %d, want %d", c.name, got, c.want)
+		}
+	}
+}
@@ -2,17 +2,26 @@ package model
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"time"
+	"yema.dev/app/model/field"
 )
 
 const (
-	TaskStatusWaiting         = 1 //新建提交，等待审核
-	TaskStatusAudit           = 2 //审核通过
-	TaskStatusReject          = 3 //审核拒绝
-	TaskStatusRelease         = 4 //上线发布中
-	TaskStatusReleaseFail     = 5 //上线失败
-	TaskStatusReleasePartFail = 6 //部分服务器失败
-	TaskStatusFinish          = 7 //上线完成
+	TaskStatusWaiting         = 1  //新建提交，等待审核
+	TaskStatusAudit           = 2  //审核通过
+	TaskStatusReject          = 3  //审核拒绝
+	TaskStatusRelease         = 4  //上线发布中
+	TaskStatusReleaseFail     = 5  //上线失败
+	TaskStatusReleasePartFail = 6  //部分服务器失败
+	TaskStatusFinish          = 7  //上线完成
+	TaskStatusQueue           = 8  //排队等待发布
+	TaskStatusCanary          = 9  //灰度发布完成，等待确认
+	TaskStatusCanaryAbort     = 10 //灰度发布已取消
+
+	TaskNotRollback = 0
+	TaskIsRollback  = 1 //回滚单
 )
 
 type Task struct {
@@ -29,11 +38,23 @@ type Task struct {
 	CommitId    string       `gorm:"column:commit_id;type:string;size:100;notNull;default:'';comment:commit哈希" json:"commit_id"`
 	Branch      string       `gorm:"column:branch;type:string;size:100;notNull;default:'';comment:分支" json:"branch"`
 	Tag         string       `gorm:"column:tag;type:string;size:100;notNull;default:'';comment:tag" json:"tag"`
+	ImageTag    string       `gorm:"column:image_tag;type:string;size:100;notNull;default:'';comment:镜像标签,docker发布时使用已有镜像" json:"image_tag"`
 	IsRollback  int8         `gorm:"column:is_rollback;notNull;default:0;comment:是否回滚" json:"is_rollback"`
 	LastError   string       `gorm:"column:last_error;type:string;notNull;default:'';comment:最后错误" json:"last_error"`
 	AuditUserId int64        `gorm:"column:audit_user_id;notNull;default:0;审核员" json:"audit_user_id"`
 	AuditTime   sql.NullTime `gorm:"column:audit_time;type:datetime;最后审核操作时间" json:"audit_time"`
 
+	//本次启动时负责人强制在发布窗口外发布，不保存，启动成功后记录到Overrides
+	OverrideUserId int64  `gorm:"-" json:"-"`
+	OverrideReason string `gorm:"-" json:"-"`
+
+	ScheduledAt    sql.NullTime `gorm:"column:scheduled_at;type:datetime;index;comment:定时发布时间" json:"scheduled_at"`
+	ScheduleUserId int64        `gorm:"column:schedule_user_id;notNull;default:0;comment:设置定时发布的用户" json:"schedule_user_id"`
+
+	CanaryServerIds field.Slices[int64] `gorm:"column:canary_server_ids;notNull;default:'';comment:灰度服务器" json:"canary_server_ids"`
+
+	PrevVersions ServerVersions `gorm:"column:prev_versions;type:text;comment:各服务器的上一个版本,灰度取消和回滚时使用" json:"prev_versions"`
+
 	CreatedAt time.Time `gorm:"column:created_at;type:datetime;notNull" json:"created_at"`
 	UpdatedAt time.Time `gorm:"column:updated_at;type:datetime;notNull" json:"updated_at"`
 
@@ -42,4 +63,30 @@ type Task struct {
 	Space       Space       `json:"space,omitempty"`
 	Environment Environment `json:"environment,omitempty"`
 	Servers     []Server    `gorm:"many2many:task_server" json:"servers"`
+	Approvals   []Approval  `json:"approvals,omitempty"`
+	Overrides   []Override  `json:"overrides,omitempty"`
+}
+
+// ServerPrevVersion 服务器发布前的版本，没有单独记录时为上线单的上一个版本
+func (t *Task) ServerPrevVersion(serverId int64) string {
+	if v, ok := t.PrevVersions[serverId]; ok {
+		return v
+	}
+	return t.PrevVersion
+}
+
+// ServerVersions 各服务器的版本，键为服务器id
+type ServerVersions map[int64]string
+
+func (v *ServerVersions) Scan(value any) error {
+	*v = make(ServerVersions)
+	return scanJSONList(value, v)
+}
+
+func (v ServerVersions) Value() (driver.Value, error) {
+	if len(v) == 0 {
+		return "", nil
+	}
+	r, err := json.Marshal(v)
+	return string(r), err
 }
@@ -16,7 +16,7 @@ import (
 
 type GitConfig struct {
 	Username           string `help:"BasicAuth授权模式下，git帐号" default:"git"`
-	Password           string `help:"BasicAuth授权模式下，git密码" default:"C-Bp2FAS2yBzYCuE7ECj"`
+	Password           string `help:"BasicAuth授权模式下，git密码" default:""`
 	PrivateKeyFile     string `help:"免密模式下，私钥证书地址" default:"$HOME/.ssh/id_rsa"`
 	PrivateKeyUsername string `help:"免密模式下，私钥证书用户" default:"git"`
 	PrivateKeyPassword string `help:"免密模式下，私钥证书密码" default:""`
@@ -25,6 +25,7 @@ type GitConfig struct {
 
 type Git struct {
 	config  *GitConfig
+	project *Auth //项目仓库授权，优先于全局配置
 	path    string
 	repoUrl string
 	repo    *git.Repository
@@ -32,9 +33,10 @@ type Git struct {
 	auth transport.AuthMethod //auth
 }
 
-func NewGit(cfg *GitConfig, url string, path string) (*Git, error) {
+func NewGit(cfg *GitConfig, auth *Auth, url string, path string) (*Git, error) {
 	repo := &Git{
 		config:  cfg,
+		project: auth,
 		path:    path,
 		repoUrl: url,
 	}
@@ -195,6 +197,15 @@ func (srv *Git) CheckoutToTag(tag string) (err error) {
 	return
 }
 
+// CurrentCommit 当前检出的提交hash
+func (srv *Git) CurrentCommit() (string, error) {
+	ref, err := srv.repo.Head()
+	if err != nil {
+		return "", ErrRepoGit.Wrap(err)
+	}
+	return ref.Hash().String(), nil
+}
+
 func (srv *Git) getBranch(branch string) (b *gitConfig.Branch, err error) {
 	b, err = srv.repo.Branch(branch)
 	if err == nil {
@@ -286,8 +297,12 @@ func (srv *Git) Commits(branch string) ([]Commit, error) {
 	return _commits, nil
 }
 
+// getAuth 优先使用项目配置的授权，没有则使用全局配置
 func (srv *Git) getAuth() (auth transport.AuthMethod, _ error) {
-	if srv.repoUrl[0:3] == "git" {
+	if isSshUrl(srv.repoUrl) {
+		if srv.project.PrivateKey != "" {
+			return ssh.NewPublicKeys(srv.config.PrivateKeyUsername, []byte(srv.project.PrivateKey), "")
+		}
 		_, err := os.Stat(srv.config.PrivateKeyFile)
 		if err != nil {
 			return nil, fmt.Errorf("git config PrivateKeyFile: %s not exisit\n", srv.config.PrivateKeyFile)
@@ -298,12 +313,32 @@ func (srv *Git) getAuth() (auth transport.AuthMethod, _ error) {
 		}
 		return publicKeys, nil
 	}
+	if srv.project.Username != "" || srv.project.Password != "" {
+		username := srv.project.Username
+		if username == "" {
+			//只配置token时，帐号可以为任意非空值
+			username = srv.config.Username
+		}
+		return &http.BasicAuth{
+			Username: username,
+			Password: srv.project.Password,
+		}, nil
+	}
+	if srv.config.Username == "" && srv.config.Password == "" {
+		return nil, nil
+	}
 	return &http.BasicAuth{
 		Username: srv.config.Username,
 		Password: srv.config.Password,
 	}, nil
 }
 
+// isSshUrl git@host:path 或者 ssh://host/path 形式的地址
+func isSshUrl(url string) bool {
+	return strings.HasPrefix(url, "git@") || strings.HasPrefix(url, "ssh://") ||
+		(!strings.Contains(url, "://") && strings.Contains(url, "@"))
+}
+
 func (srv *Git) Path() string {
 	return srv.path
 }
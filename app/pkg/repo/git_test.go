@@ -0,0 +1,88 @@
+package repo
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testPrivateKey(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func publicKey(t *testing.T, auth transport.AuthMethod) []byte {
+	keys, ok := auth.(*ssh.PublicKeys)
+	if !ok {
+		t.Fatalf("auth %T is not public keys", auth)
+	}
+	return keys.Signer.PublicKey().Marshal()
+}
+
+func TestGitAuth(t *testing.T) {
+	globalKey, projectKey := testPrivateKey(t), testPrivateKey(t)
+	keyFile := filepath.Join(t.TempDir(), "id_ecdsa")
+	if err := os.WriteFile(keyFile, globalKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := &GitConfig{Username: "git", Password: "global-pass", PrivateKeyFile: keyFile, PrivateKeyUsername: "git"}
+
+	tests := []struct {
+		name    string
+		url     string
+		project Auth
+		want    transport.AuthMethod
+		key     []byte
+	}{
+		{"http global", "https://git.example.com/app.git", Auth{}, &http.BasicAuth{Username: "git", Password: "global-pass"}, nil},
+		{"http project", "https://git.example.com/app.git", Auth{Username: "dev", Password: "dev-pass"}, &http.BasicAuth{Username: "dev", Password: "dev-pass"}, nil},
+		{"http project token", "https://git.example.com/app.git", Auth{Password: "token"}, &http.BasicAuth{Username: "git", Password: "token"}, nil},
+		{"ssh global", "git@git.example.com:app.git", Auth{}, nil, globalKey},
+		{"ssh project", "ssh://git@git.example.com/app.git", Auth{PrivateKey: string(projectKey)}, nil, projectKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			project := tt.project
+			g := &Git{config: config, project: &project, repoUrl: tt.url}
+			auth, err := g.getAuth()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.key == nil {
+				if *auth.(*http.BasicAuth) != *tt.want.(*http.BasicAuth) {
+					t.Fatalf("auth %+v, want %+v", auth, tt.want)
+				}
+				return
+			}
+			want, err := ssh.NewPublicKeys("git", tt.key, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(publicKey(t, auth), publicKey(t, want)) {
+				t.Fatal("private key not match")
+			}
+		})
+	}
+
+	//未配置任何帐号时匿名访问
+	g := &Git{config: &GitConfig{}, project: &Auth{}, repoUrl: "https://git.example.com/app.git"}
+	if auth, err := g.getAuth(); err != nil || auth != nil {
+		t.Fatalf("anonymous auth %v %v", auth, err)
+	}
+}
@@ -52,6 +52,13 @@ type Branch struct {
 	Hash string `json:"hash"`
 }
 
+// Auth 项目仓库授权信息，为空时使用全局配置
+type Auth struct {
+	Username   string //http授权帐号
+	Password   string //http授权密码或者token
+	PrivateKey string //ssh部署私钥(PEM)
+}
+
 type Repo interface {
 	Tags() ([]Tag, error)
 	Commits(branch string) ([]Commit, error)
@@ -59,16 +66,25 @@ type Repo interface {
 	CheckoutToBranch(branch string) error
 	CheckoutToCommit(branch, commit string) error
 	CheckoutToTag(tag string) error
+	CurrentCommit() (string, error)
 	Path() string
 	Type() TypeRepo
 }
 
-func (r *Repos) New(repoType TypeRepo, repoUrl, projectName string) (Repo, error) {
+// Dir 代码仓库存放目录
+func (r *Repos) Dir() string {
+	return r.config.RepoDir
+}
+
+func (r *Repos) New(repoType TypeRepo, repoUrl, projectName string, auth *Auth) (Repo, error) {
+	if auth == nil {
+		auth = &Auth{}
+	}
 	switch repoType {
 	case GitRepo:
-		return NewGit(&r.config.Git, repoUrl, filepath.Join(r.config.RepoDir, projectName))
+		return NewGit(&r.config.Git, auth, repoUrl, filepath.Join(r.config.RepoDir, projectName))
 	case SvnRepo:
-		return NewSvn(&r.config.Svn, repoUrl, filepath.Join(r.config.RepoDir, projectName))
+		return NewSvn(&r.config.Svn, auth, repoUrl, filepath.Join(r.config.RepoDir, projectName))
 	}
 	return nil, ErrRepo.New("仓库类型不支持")
 }
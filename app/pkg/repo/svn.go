@@ -1,41 +1,234 @@
 package repo
 
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	svnTrunk    = "trunk"
+	svnBranches = "branches"
+	svnTags     = "tags"
+)
+
 type SvnConfig struct {
-	Username string `help:"svn帐号" default:""`
-	Password string `help:"svn密码" default:""`
+	Username   string `help:"svn帐号" default:""`
+	Password   string `help:"svn密码" default:""`
+	FetchDepth int    `help:"记录数量" default:"50"`
 }
 
+// Svn 使用svn命令行操作仓库，仓库地址为标准布局(trunk/branches/tags)的根目录
 type Svn struct {
 	config *SvnConfig
+	auth   *Auth //项目仓库授权，优先于全局配置
 	path   string
 	url    string
 }
 
-func NewSvn(cfg *SvnConfig, url string, path string) (*Svn, error) {
-	return &Svn{config: cfg, url: url, path: path}, nil
+func NewSvn(cfg *SvnConfig, auth *Auth, url string, path string) (*Svn, error) {
+	if _, err := exec.LookPath("svn"); err != nil {
+		return nil, ErrRepoSvn.New("未安装svn命令行客户端: %s", err.Error())
+	}
+	return &Svn{config: cfg, auth: auth, url: strings.TrimRight(url, "/"), path: path}, nil
+}
+
+type svnEntry struct {
+	Kind   string `xml:"kind,attr"`
+	Name   string `xml:"name"`
+	Url    string `xml:"url"`
+	Commit struct {
+		Revision string    `xml:"revision,attr"`
+		Author   string    `xml:"author"`
+		Date     time.Time `xml:"date"`
+	} `xml:"commit"`
 }
 
+type svnLogEntry struct {
+	Revision string    `xml:"revision,attr"`
+	Author   string    `xml:"author"`
+	Date     time.Time `xml:"date"`
+	Msg      string    `xml:"msg"`
+}
+
+// Tags 获取tags目录下的所有标签
 func (srv *Svn) Tags() ([]Tag, error) {
-	return nil, ErrRepoSvn.New("todo")
+	entries, err := srv.list(svnTags)
+	if err != nil {
+		return nil, err
+	}
+	_tags := make([]Tag, 0, len(entries))
+	for _, v := range entries {
+		_tags = append(_tags, Tag{Name: v.Name, Hash: v.Commit.Revision})
+	}
+	return _tags, nil
 }
+
+// Commits 获取对应的分支的提交记录
 func (srv *Svn) Commits(branch string) ([]Commit, error) {
-	return nil, ErrRepoSvn.New("todo")
+	args := []string{"log", "--xml"}
+	if srv.config.FetchDepth > 0 {
+		args = append(args, "-l", fmt.Sprintf("%d", srv.config.FetchDepth))
+	}
+	out, err := srv.run(append(args, srv.branchUrl(branch))...)
+	if err != nil {
+		return nil, err
+	}
+	res := struct {
+		Entries []svnLogEntry `xml:"logentry"`
+	}{}
+	if err = xml.Unmarshal(out, &res); err != nil {
+		return nil, ErrRepoSvn.Wrap(err)
+	}
+	_commits := make([]Commit, 0, len(res.Entries))
+	for _, v := range res.Entries {
+		msg := strings.TrimSpace(v.Msg)
+		_commits = append(_commits, Commit{
+			Name:      "r" + v.Revision + "#" + msg,
+			Message:   msg,
+			Timestamp: v.Date,
+			Hash:      v.Revision,
+		})
+	}
+	return _commits, nil
 }
+
+// Branches 获取所有分支，trunk作为默认分支
 func (srv *Svn) Branches() ([]Branch, error) {
-	return nil, ErrRepoSvn.New("todo")
+	trunk, err := srv.info(srv.branchUrl(svnTrunk))
+	if err != nil {
+		return nil, err
+	}
+	entries, err := srv.list(svnBranches)
+	if err != nil {
+		return nil, err
+	}
+	_branches := make([]Branch, 0, len(entries)+1)
+	_branches = append(_branches, Branch{Name: svnTrunk, Hash: trunk.Commit.Revision})
+	for _, v := range entries {
+		_branches = append(_branches, Branch{Name: v.Name, Hash: v.Commit.Revision})
+	}
+	return _branches, nil
 }
+
 func (srv *Svn) CheckoutToBranch(branch string) error {
-	return ErrRepoSvn.New("todo")
+	return srv.checkout(srv.branchUrl(branch), "HEAD")
 }
+
 func (srv *Svn) CheckoutToCommit(branch, commit string) error {
-	return ErrRepoSvn.New("todo")
+	return srv.checkout(srv.branchUrl(branch), strings.TrimPrefix(commit, "r"))
 }
+
 func (srv *Svn) CheckoutToTag(tag string) error {
-	return ErrRepoSvn.New("todo")
+	return srv.checkout(srv.url+"/"+svnTags+"/"+tag, "HEAD")
+}
+
+// CurrentCommit 当前检出目录的最后修改版本号
+func (srv *Svn) CurrentCommit() (string, error) {
+	entry, err := srv.info(srv.path)
+	if err != nil {
+		return "", err
+	}
+	return entry.Commit.Revision, nil
 }
+
 func (srv *Svn) Path() string {
 	return srv.path
 }
+
 func (srv *Svn) Type() TypeRepo {
 	return SvnRepo
 }
+
+// checkout 检出到指定地址和版本，已存在同一仓库的工作副本则切换过去，否则重新检出
+func (srv *Svn) checkout(url, revision string) error {
+	if entry, err := srv.info(srv.path); err == nil && strings.HasPrefix(entry.Url, srv.url+"/") {
+		if _, err = srv.run("revert", "-R", srv.path); err != nil {
+			return err
+		}
+		_, err = srv.run("switch", "--ignore-ancestry", "--force", "-r", revision, url, srv.path)
+		return err
+	}
+	if err := os.RemoveAll(srv.path); err != nil {
+		return ErrRepoSvn.Wrap(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(srv.path), 0755); err != nil {
+		return ErrRepoSvn.Wrap(err)
+	}
+	_, err := srv.run("checkout", "-r", revision, url, srv.path)
+	return err
+}
+
+// branchUrl trunk为主干，其他为branches目录下的分支
+func (srv *Svn) branchUrl(branch string) string {
+	if branch == "" || branch == svnTrunk {
+		return srv.url + "/" + svnTrunk
+	}
+	return srv.url + "/" + svnBranches + "/" + branch
+}
+
+// list 列出仓库下某个目录中的子目录
+func (srv *Svn) list(dir string) ([]svnEntry, error) {
+	out, err := srv.run("list", "--xml", srv.url+"/"+dir)
+	if err != nil {
+		return nil, err
+	}
+	res := struct {
+		Entries []svnEntry `xml:"list>entry"`
+	}{}
+	if err = xml.Unmarshal(out, &res); err != nil {
+		return nil, ErrRepoSvn.Wrap(err)
+	}
+	dirs := make([]svnEntry, 0, len(res.Entries))
+	for _, v := range res.Entries {
+		if v.Kind == "dir" {
+			dirs = append(dirs, v)
+		}
+	}
+	return dirs, nil
+}
+
+// info 获取仓库地址或工作副本的信息
+func (srv *Svn) info(target string) (*svnEntry, error) {
+	out, err := srv.run("info", "--xml", target)
+	if err != nil {
+		return nil, err
+	}
+	res := struct {
+		Entry svnEntry `xml:"entry"`
+	}{}
+	if err = xml.Unmarshal(out, &res); err != nil {
+		return nil, ErrRepoSvn.Wrap(err)
+	}
+	return &res.Entry, nil
+}
+
+// run 执行svn命令，禁止交互，优先使用项目配置的帐号密码，密码不出现在命令行参数中
+func (srv *Svn) run(args ...string) ([]byte, error) {
+	args = append([]string{"--non-interactive", "--no-auth-cache"}, args...)
+	username, password := srv.config.Username, srv.config.Password
+	if srv.auth.Username != "" || srv.auth.Password != "" {
+		username, password = srv.auth.Username, srv.auth.Password
+	}
+	if username != "" {
+		args = append(args, "--username", username)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("svn", args...)
+	if password != "" {
+		//密码从标准输入传入，避免通过进程列表泄露，需要svn 1.10及以上版本
+		cmd.Args = append(cmd.Args, "--password-from-stdin")
+		cmd.Stdin = strings.NewReader(password + "\n")
+	}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, ErrRepoSvn.New("svn %s: %s %s", args[2], err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,188 @@
+package repo
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestSvnRepo 创建本地标准布局的svn仓库: trunk两次提交，分支dev，标签v1.0.0
+func newTestSvnRepo(t *testing.T) string {
+	for _, bin := range []string{"svn", "svnadmin"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("%s not installed", bin)
+		}
+	}
+	root := t.TempDir()
+	repoDir := filepath.Join(root, "repo")
+	url := "file://" + repoDir
+	wc := filepath.Join(root, "wc")
+	run := func(name string, args ...string) {
+		t.Helper()
+		out, err := exec.Command(name, args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s %v: %v %s", name, args, err, out)
+		}
+	}
+	run("svnadmin", "create", repoDir)
+	run("svn", "mkdir", "-m", "init", url+"/trunk", url+"/branches", url+"/tags")
+	run("svn", "checkout", url+"/trunk", wc)
+	writeFile(t, filepath.Join(wc, "version.txt"), "1")
+	run("svn", "add", filepath.Join(wc, "version.txt"))
+	run("svn", "commit", "-m", "first", wc)
+	run("svn", "copy", "-m", "tag v1.0.0", url+"/trunk", url+"/tags/v1.0.0")
+	writeFile(t, filepath.Join(wc, "version.txt"), "2")
+	run("svn", "commit", "-m", "second", wc)
+	run("svn", "copy", "-m", "branch dev", url+"/trunk", url+"/branches/dev")
+	return url
+}
+
+func writeFile(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readVersion(t *testing.T, r Repo) string {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(r.Path(), "version.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestSvn(t *testing.T) {
+	url := newTestSvnRepo(t)
+	repos, _ := NewRepos(&Config{RepoDir: t.TempDir()})
+	r, err := repos.New(SvnRepo, url, "svn_project", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	branches, err := r.Branches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(branches) != 2 || branches[0].Name != "trunk" || branches[1].Name != "dev" {
+		t.Fatalf("branches: %+v", branches)
+	}
+
+	tags, err := r.Tags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || tags[0].Name != "v1.0.0" {
+		t.Fatalf("tags: %+v", tags)
+	}
+
+	commits, err := r.Commits("trunk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 3 || commits[0].Message != "second" || commits[1].Message != "first" {
+		t.Fatalf("commits: %+v", commits)
+	}
+
+	if err = r.CheckoutToBranch("trunk"); err != nil {
+		t.Fatal(err)
+	}
+	if v := readVersion(t, r); v != "2" {
+		t.Fatalf("trunk version: %s", v)
+	}
+	if rev, _ := r.CurrentCommit(); rev != commits[0].Hash {
+		t.Fatalf("current commit: %s, want %s", rev, commits[0].Hash)
+	}
+
+	if err = r.CheckoutToCommit("trunk", commits[1].Hash); err != nil {
+		t.Fatal(err)
+	}
+	if v := readVersion(t, r); v != "1" {
+		t.Fatalf("commit version: %s", v)
+	}
+
+	if err = r.CheckoutToTag("v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if v := readVersion(t, r); v != "1" {
+		t.Fatalf("tag version: %s", v)
+	}
+
+	//本地修改在切换分支时被还原
+	writeFile(t, filepath.Join(r.Path(), "version.txt"), "local")
+	if err = r.CheckoutToBranch("dev"); err != nil {
+		t.Fatal(err)
+	}
+	if v := readVersion(t, r); v != "2" {
+		t.Fatalf("dev version: %s", v)
+	}
+}
+
+// fakeSvn 用脚本代替svn命令，记录参数和标准输入，输出list结果，不依赖svn安装
+func fakeSvn(t *testing.T) string {
+	dir := t.TempDir()
+	script := `#!/bin/sh
+echo "$@" > "$0.args"
+cat > "$0.stdin"
+cat <<'XML'
+<?xml version="1.0" encoding="UTF-8"?>
+<lists><list path="file:///repo/tags">
+<entry kind="dir"><name>v1.0.0</name><commit revision="3"><author>dev</author><date>2024-01-02T03:04:05.000000Z</date></commit></entry>
+<entry kind="file"><name>README</name><commit revision="2"><author>dev</author><date>2024-01-02T03:04:05.000000Z</date></commit></entry>
+</list></lists>
+XML
+`
+	if err := os.WriteFile(filepath.Join(dir, "svn"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return filepath.Join(dir, "svn")
+}
+
+func TestSvnAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   SvnConfig
+		auth     Auth
+		username string
+		password string
+	}{
+		{"global", SvnConfig{Username: "global", Password: "global-pass"}, Auth{}, "global", "global-pass"},
+		{"project", SvnConfig{Username: "global", Password: "global-pass"}, Auth{Username: "dev", Password: "dev-pass"}, "dev", "dev-pass"},
+		{"anonymous", SvnConfig{}, Auth{}, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bin := fakeSvn(t)
+			auth := tt.auth
+			r, err := NewSvn(&tt.config, &auth, "file:///repo", t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			tags, err := r.Tags()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tags) != 1 || tags[0].Name != "v1.0.0" || tags[0].Hash != "3" {
+				t.Fatalf("tags: %+v", tags)
+			}
+			args, _ := os.ReadFile(bin + ".args")
+			stdin, _ := os.ReadFile(bin + ".stdin")
+			if tt.password != "" && strings.Contains(string(args), tt.password) {
+				t.Fatalf("password in args: %s", args)
+			}
+			if tt.username != "" && !strings.Contains(string(args), "--username "+tt.username) {
+				t.Fatalf("username not in args: %s", args)
+			}
+			if got := strings.TrimSuffix(string(stdin), "\n"); got != tt.password {
+				t.Fatalf("stdin password %q, want %q", got, tt.password)
+			}
+			if hasFlag := strings.Contains(string(args), "--password-from-stdin"); hasFlag != (tt.password != "") {
+				t.Fatalf("password-from-stdin flag: %s", args)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/zeebo/errs"
+	"io"
+	"os"
+	"strings"
+)
+
+var Error = errs.Class("Secret")
+
+// prefix 密文前缀，用于区分未加密的历史数据，密文格式为 enc:密钥id:base64(nonce+密文)
+const prefix = "enc:"
+
+type Config struct {
+	Key     string   `help:"敏感数据加密密钥，为空时敏感数据不加密存储" default:""`
+	KeyFile string   `help:"敏感数据加密密钥文件，配置后优先于Key" default:""`
+	OldKeys []string `help:"历史加密密钥，密钥轮换时用于解密旧数据" default:""`
+}
+
+type key struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// Secret 使用AES-GCM加解密敏感数据，支持多个历史密钥解密
+type Secret struct {
+	current *key
+	keys    map[string]*key
+}
+
+// NewSecret 未配置密钥时返回nil
+func NewSecret(conf *Config) (*Secret, error) {
+	current := conf.Key
+	if conf.KeyFile != "" {
+		b, err := os.ReadFile(conf.KeyFile)
+		if err != nil {
+			return nil, Error.Wrap(err)
+		}
+		current = strings.TrimSpace(string(b))
+	}
+	if current == "" {
+		return nil, nil
+	}
+	s := &Secret{keys: make(map[string]*key)}
+	for i, v := range append([]string{current}, conf.OldKeys...) {
+		if v == "" {
+			continue
+		}
+		k, err := newKey(v)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			s.current = k
+		}
+		if _, ok := s.keys[k.id]; !ok {
+			s.keys[k.id] = k
+		}
+	}
+	return s, nil
+}
+
+func newKey(secret string) (*key, error) {
+	sum := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, Error.Wrap(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, Error.Wrap(err)
+	}
+	//密钥id只用于区分密钥，不能反推出密钥
+	idSum := sha256.Sum256(sum[:])
+	return &key{id: hex.EncodeToString(idSum[:4]), aead: aead}, nil
+}
+
+// Encrypt 使用当前密钥加密
+func (s *Secret) Encrypt(plain string) (string, error) {
+	nonce := make([]byte, s.current.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", Error.Wrap(err)
+	}
+	data := s.current.aead.Seal(nonce, nonce, []byte(plain), nil)
+	return prefix + s.current.id + ":" + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// Decrypt 解密，没有密文前缀的数据视为未加密的历史数据原样返回
+func (s *Secret) Decrypt(text string) (string, error) {
+	if !IsEncrypted(text) {
+		return text, nil
+	}
+	id, data, ok := strings.Cut(strings.TrimPrefix(text, prefix), ":")
+	if !ok {
+		return "", Error.New("密文格式错误")
+	}
+	k, ok := s.keys[id]
+	if !ok {
+		return "", Error.New("没有找到密钥[%s]，请检查是否配置了历史密钥", id)
+	}
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", Error.Wrap(err)
+	}
+	size := k.aead.NonceSize()
+	if len(raw) < size {
+		return "", Error.New("密文长度错误")
+	}
+	plain, err := k.aead.Open(nil, raw[:size], raw[size:], nil)
+	if err != nil {
+		return "", Error.Wrap(err)
+	}
+	return string(plain), nil
+}
+
+// NeedRotate 未加密或者不是使用当前密钥加密的数据需要重新加密
+func (s *Secret) NeedRotate(text string) bool {
+	if text == "" {
+		return false
+	}
+	return !strings.HasPrefix(text, prefix+s.current.id+":")
+}
+
+// IsEncrypted 是否为加密后的数据
+func IsEncrypted(text string) bool {
+	return strings.HasPrefix(text, prefix)
+}
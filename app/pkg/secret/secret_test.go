@@ -0,0 +1,61 @@
+package secret
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecret(t *testing.T) {
+	s, err := NewSecret(&Config{Key: "test-key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := s.Encrypt("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(enc) || enc == "password" {
+		t.Fatalf("not encrypted: %s", enc)
+	}
+	plain, err := s.Decrypt(enc)
+	if err != nil || plain != "password" {
+		t.Fatalf("decrypt: %s, %v", plain, err)
+	}
+	//未加密的历史数据原样返回
+	if plain, _ = s.Decrypt("plain"); plain != "plain" {
+		t.Fatalf("decrypt plain: %s", plain)
+	}
+	other, _ := NewSecret(&Config{Key: "other-key"})
+	if _, err = other.Decrypt(enc); err == nil {
+		t.Fatal("decrypt with other key should fail")
+	}
+}
+
+func TestSecretRotate(t *testing.T) {
+	old, _ := NewSecret(&Config{Key: "old-key"})
+	enc, _ := old.Encrypt("token")
+
+	keyFile := filepath.Join(t.TempDir(), "secret.key")
+	if err := os.WriteFile(keyFile, []byte("new-key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSecret(&Config{Key: "ignored", KeyFile: keyFile, OldKeys: []string{"old-key"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.NeedRotate(enc) || !s.NeedRotate("plain") || s.NeedRotate("") {
+		t.Fatal("need rotate error")
+	}
+	plain, err := s.Decrypt(enc)
+	if err != nil || plain != "token" {
+		t.Fatalf("decrypt with old key: %s, %v", plain, err)
+	}
+	enc, _ = s.Encrypt(plain)
+	if s.NeedRotate(enc) {
+		t.Fatal("encrypted with current key should not rotate")
+	}
+	if _, err = old.Decrypt(enc); err == nil {
+		t.Fatal("old secret should not decrypt new key data")
+	}
+}
@@ -7,16 +7,22 @@ import (
 	"io"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
-// client ssh方便复用tcp连接管理
+// client ssh方便复用tcp连接管理，引用为0后不立即关闭，由连接池空闲检测关闭
 type client struct {
 	mux          sync.Mutex
 	serverConfig *ServerConfig
 	client       *ssh.Client
 	ref          *int32
+	jump         *client //跳板机连接，当前连接关闭时释放
 
-	closeFn func()
+	createdAt time.Time
+	lastUsed  int64 //最后使用时间，UnixNano
+	broken    int32 //连接是否已断开
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 func (s *client) Key() string {
@@ -25,48 +31,154 @@ func (s *client) Key() string {
 
 func (s *client) add() {
 	atomic.AddInt32(s.ref, 1)
+	s.touch()
 }
 
 func (s *client) done() {
 	atomic.AddInt32(s.ref, -1)
+	s.touch()
 }
+
 func (s *client) Ref() int32 {
 	return atomic.LoadInt32(s.ref)
 }
 
+// Done 释放引用
 func (s *client) Done() {
-	s.mux.Lock()
-	defer s.mux.Unlock()
-	n := atomic.AddInt32(s.ref, -1)
-	if n == 0 {
-		if s.closeFn != nil {
-			s.closeFn()
+	s.done()
+}
+
+func (s *client) touch() {
+	atomic.StoreInt64(&s.lastUsed, time.Now().UnixNano())
+}
+
+// LastUsed 最后使用时间
+func (s *client) LastUsed() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastUsed))
+}
+
+// IsBroken 连接是否已断开
+func (s *client) IsBroken() bool {
+	return atomic.LoadInt32(&s.broken) == 1
+}
+
+// markBroken 标记连接已断开并关闭，下次获取连接时重新连接
+func (s *client) markBroken() {
+	atomic.StoreInt32(&s.broken, 1)
+	s.close()
+}
+
+// close 关闭连接并释放跳板机连接
+func (s *client) close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		_ = s.client.Close()
+		if s.jump != nil {
+			s.jump.done()
 		}
-		s.client.Close()
+	})
+}
+
+// alive 发送保活请求检测连接是否正常
+func (s *client) alive(timeout time.Duration) bool {
+	errCh := make(chan error, 1)
+	go func() {
+		_, _, err := s.client.SendRequest("keepalive@openssh.com", true, nil)
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		return err == nil
+	case <-time.After(timeout):
+		return false
 	}
 }
 
-func NewClient(conf *ServerConfig, closeFn func()) (_ *client, err error) {
+// keepAlive 定时发送保活请求，失败时标记连接断开
+func (s *client) keepAlive(interval time.Duration) {
+	go func() {
+		//连接被对端关闭
+		_ = s.client.Wait()
+		s.markBroken()
+	}()
+	if interval <= 0 {
+		return
+	}
+	tk := time.NewTicker(interval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-tk.C:
+			if !s.alive(interval) {
+				s.markBroken()
+				return
+			}
+		}
+	}
+}
+
+// checkBroken 创建会话等操作失败时检测连接是否已断开，已断开返回ErrConnBroken，调用方可以重新连接
+func (s *client) checkBroken(err error) error {
+	if s.IsBroken() || !s.alive(checkAliveTimeout) {
+		s.markBroken()
+		return ErrConnBroken.Wrap(err)
+	}
+	return err
+}
+
+func NewClient(conf *ServerConfig, jump *client, keepAlive time.Duration) (_ *client, err error) {
+	auth := []ssh.AuthMethod{ssh.Password(conf.Password)}
+	if conf.IdentitySigner != nil {
+		auth = append(auth, ssh.PublicKeys(conf.IdentitySigner))
+	}
 	config := &ssh.ClientConfig{
 		User:            conf.User,
-		Auth:            []ssh.AuthMethod{ssh.Password(conf.Password), ssh.PublicKeys(conf.IdentitySigner)},
+		Auth:            auth,
 		Timeout:         conf.Timeout,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: hostKeyCallback(conf),
 	}
 	config.SetDefaults()
 	tcpAddress := fmt.Sprintf("%s:%d", conf.Host, conf.Port)
-	sshClient, err := ssh.Dial("tcp", tcpAddress, config)
+	var sshClient *ssh.Client
+	if jump == nil {
+		sshClient, err = ssh.Dial("tcp", tcpAddress, config)
+	} else {
+		sshClient, err = jump.dial(tcpAddress, config)
+	}
 	if nil != err {
 		return nil, err
 	}
 	var ref int32
-	return &client{
+	c := &client{
 		serverConfig: conf,
 		client:       sshClient,
 		ref:          &ref,
+		jump:         jump,
+		createdAt:    time.Now(),
+		closed:       make(chan struct{}),
+	}
+	c.touch()
+	go c.keepAlive(keepAlive)
+	return c, nil
+}
 
-		closeFn: closeFn,
-	}, nil
+// dial 通过当前连接转发到目标服务器建立ssh连接，成功后占用当前连接直到目标连接关闭
+func (s *client) dial(addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	conn, err := s.client.Dial("tcp", addr)
+	if err != nil {
+		return nil, s.checkBroken(err)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	s.add()
+	return ssh.NewClient(c, chans, reqs), nil
 }
 
 // RunCmd 执行命令
@@ -76,7 +188,7 @@ func (s *client) RunCmd(cmd string) (output []byte, err error) {
 	session, err = s.client.NewSession()
 	if err != nil {
 		s.mux.Unlock()
-		return nil, err
+		return nil, s.checkBroken(err)
 	}
 	s.add()
 	s.mux.Unlock()
@@ -91,7 +203,7 @@ func (s *client) NewTerminal(cols, rows int) (term *Terminal, err error) {
 	defer s.mux.Unlock()
 	session, err := s.client.NewSession()
 	if err != nil {
-		return nil, err
+		return nil, s.checkBroken(err)
 	}
 	defer func() {
 		if err != nil {
@@ -138,7 +250,7 @@ func (s *client) NewSftp() (*Sftp, error) {
 	defer s.mux.Unlock()
 	scp, err := sftp.NewClient(s.client)
 	if err != nil {
-		return nil, err
+		return nil, s.checkBroken(err)
 	}
 	_sftp := &Sftp{
 		client:     s,
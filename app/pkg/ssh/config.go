@@ -1,6 +1,8 @@
 package ssh
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"golang.org/x/crypto/ssh"
 	"os"
@@ -12,6 +14,8 @@ type Config struct {
 	IdentityFile     string        `help:"免密登陆密钥地址" default:"$HOME/.ssh/id_rsa"`
 	IdentityPassword string        `help:"免密登陆密钥密码" default:""`
 	Timeout          time.Duration `help:"连接超时" default:"30s"`
+	KeepAlive        time.Duration `help:"连接保活请求间隔，为0时不发送" default:"30s"`
+	IdleTimeout      time.Duration `help:"连接空闲超时时间，超时后关闭，为0时不关闭" default:"5m"`
 }
 
 type ServerConfig struct {
@@ -21,10 +25,26 @@ type ServerConfig struct {
 	Port           int           `json:"port"`
 	Timeout        time.Duration `json:"timeout"`
 	IdentitySigner ssh.Signer    `json:"-"`
+	PrivateKey     string        `json:"-"`        //服务器使用的登录私钥，为空时使用全局免密登陆密钥
+	Passphrase     string        `json:"-"`        //登录私钥密码
+	HostKey        string        `json:"host_key"` //已记录的主机公钥，连接时校验，authorized_keys格式
+	Jump           *ServerConfig `json:"jump"`     //跳板机，不为空时通过跳板机连接
+	//OnNewHostKey 未记录主机公钥时调用，返回nil则信任首次连接的公钥，为空时拒绝连接
+	OnNewHostKey func(hostKey string) error `json:"-"`
 }
 
 func (s *ServerConfig) String() (key string) {
-	return fmt.Sprintf("%s:%s@%s:%d", s.User, s.Password, s.Host, s.Port)
+	//私钥只取摘要区分不同凭据
+	keyId := ""
+	if s.PrivateKey != "" {
+		sum := sha256.Sum256([]byte(s.PrivateKey))
+		keyId = hex.EncodeToString(sum[:8])
+	}
+	key = fmt.Sprintf("%s:%s@%s:%d#%s#%s", s.User, s.Password, s.Host, s.Port, keyId, s.HostKey)
+	if s.Jump != nil {
+		key += " via " + s.Jump.String()
+	}
+	return
 }
 
 func (conf *Config) IdentitySigner() (signer ssh.Signer, err error) {
@@ -39,9 +59,14 @@ func (conf *Config) IdentitySigner() (signer ssh.Signer, err error) {
 	if err != nil {
 		return nil, ErrSSH.Wrap(err)
 	}
-	signer, err = ssh.ParsePrivateKey(bytes)
+	return ParsePrivateKey(bytes, conf.IdentityPassword)
+}
+
+// ParsePrivateKey 解析私钥，私钥有密码时使用passphrase解密
+func ParsePrivateKey(key []byte, passphrase string) (signer ssh.Signer, err error) {
+	signer, err = ssh.ParsePrivateKey(key)
 	if _, ok := err.(*ssh.PassphraseMissingError); ok {
-		signer, err = ssh.ParsePrivateKeyWithPassphrase(bytes, []byte(conf.IdentityPassword))
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
 	}
 	if err != nil {
 		err = ErrSSH.Wrap(err)
@@ -0,0 +1,95 @@
+package ssh
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"golang.org/x/crypto/ssh"
+	"strings"
+	"testing"
+)
+
+// newPrivateKey 生成PEM格式私钥，同时返回authorized_keys格式公钥
+func newPrivateKey(t *testing.T) ([]byte, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), MarshalHostKey(pub)
+}
+
+func TestSigner(t *testing.T) {
+	globalKey, globalAuthKey := newPrivateKey(t)
+	serverKey, serverAuthKey := newPrivateKey(t)
+	identitySigner, err := ParsePrivateKey(globalKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Ssh{identitySigner: identitySigner}
+	cases := []struct {
+		name string
+		conf ServerConfig
+		want string
+		err  bool
+	}{
+		{"global", ServerConfig{}, globalAuthKey, false},
+		{"server", ServerConfig{PrivateKey: string(serverKey)}, serverAuthKey, false},
+		{"invalid", ServerConfig{PrivateKey: "invalid"}, "", true},
+	}
+	for _, c := range cases {
+		signer, err := s.Signer(c.conf)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if got := MarshalHostKey(signer.PublicKey()); got != c.want {
+			t.Errorf("%s: signer %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+// TestServerConfigString 连接池按配置区分连接，不同凭据不能复用同一个连接
+func TestServerConfigString(t *testing.T) {
+	key1, _ := newPrivateKey(t)
+	key2, _ := newPrivateKey(t)
+	base := ServerConfig{User: "root", Host: "10.0.0.1", Port: 22}
+	withKey1, withKey2, withPassword := base, base, base
+	withKey1.PrivateKey = string(key1)
+	withKey2.PrivateKey = string(key2)
+	withPassword.Password = "secret"
+
+	keys := map[string]bool{}
+	for _, conf := range []ServerConfig{base, withKey1, withKey2, withPassword} {
+		keys[conf.String()] = true
+	}
+	if len(keys) != 4 {
+		t.Fatalf("pool keys not distinct: %v", keys)
+	}
+	if same := withKey1; same.String() != withKey1.String() {
+		t.Fatal("same config has different pool key")
+	}
+	if strings.Contains(withKey1.String(), "PRIVATE KEY") {
+		t.Fatal("private key in pool key")
+	}
+	//通过跳板机连接的配置不能复用直连的连接
+	viaJump := base
+	viaJump.Jump = &ServerConfig{User: "root", Host: "bastion", Port: 22}
+	if viaJump.String() == base.String() {
+		t.Fatal("pool key should include jump server")
+	}
+}
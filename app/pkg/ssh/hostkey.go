@@ -0,0 +1,58 @@
+package ssh
+
+import (
+	"bytes"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"strings"
+)
+
+var (
+	//ErrHostKeyUnknown 服务器还没有记录主机公钥
+	ErrHostKeyUnknown = ErrSSH.New("未记录服务器主机公钥，请先校验服务器连接")
+	//ErrHostKeyMismatch 主机公钥和记录的不一致，可能是服务器重装或者遭受中间人攻击
+	ErrHostKeyMismatch = ErrSSH.New("服务器主机公钥与记录的不一致，可能存在中间人攻击，如确认服务器已重装请重置主机公钥")
+)
+
+// MarshalHostKey 主机公钥转为authorized_keys格式，用于保存
+func MarshalHostKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// ParseHostKey 解析保存的主机公钥
+func ParseHostKey(hostKey string) (ssh.PublicKey, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hostKey))
+	if err != nil {
+		return nil, ErrSSH.Wrap(err)
+	}
+	return key, nil
+}
+
+// Fingerprint 主机公钥的SHA256指纹，格式同ssh-keygen -l
+func Fingerprint(hostKey string) string {
+	key, err := ParseHostKey(hostKey)
+	if err != nil {
+		return ""
+	}
+	return ssh.FingerprintSHA256(key)
+}
+
+// hostKeyCallback 校验主机公钥，未记录时只有设置了OnNewHostKey才信任首次连接的公钥
+func hostKeyCallback(conf *ServerConfig) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if conf.HostKey == "" {
+			if conf.OnNewHostKey == nil {
+				return ErrHostKeyUnknown
+			}
+			return conf.OnNewHostKey(MarshalHostKey(key))
+		}
+		known, err := ParseHostKey(conf.HostKey)
+		if err != nil {
+			return err
+		}
+		if known.Type() != key.Type() || !bytes.Equal(known.Marshal(), key.Marshal()) {
+			return ErrHostKeyMismatch
+		}
+		return nil
+	}
+}
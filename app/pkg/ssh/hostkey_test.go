@@ -0,0 +1,50 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"testing"
+)
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	key, other := newHostKey(t), newHostKey(t)
+
+	conf := &ServerConfig{}
+	if err := hostKeyCallback(conf)("host:22", nil, key); !errors.Is(err, ErrHostKeyUnknown) {
+		t.Fatalf("unknown host key: %v", err)
+	}
+
+	var trusted string
+	conf.OnNewHostKey = func(hostKey string) error {
+		trusted = hostKey
+		return nil
+	}
+	if err := hostKeyCallback(conf)("host:22", nil, key); err != nil {
+		t.Fatal(err)
+	}
+	if Fingerprint(trusted) != ssh.FingerprintSHA256(key) {
+		t.Fatalf("trusted key: %s", trusted)
+	}
+
+	conf = &ServerConfig{HostKey: trusted}
+	if err := hostKeyCallback(conf)("host:22", nil, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := hostKeyCallback(conf)("host:22", nil, other); !errors.Is(err, ErrHostKeyMismatch) {
+		t.Fatalf("mismatch host key: %v", err)
+	}
+}
@@ -0,0 +1,27 @@
+package ssh
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"golang.org/x/crypto/ssh"
+)
+
+// GenerateKey 生成临时ecdsa密钥，返回PEM格式私钥和authorized_keys格式公钥，用于服务器之间临时授权
+func GenerateKey() (privateKey []byte, authorizedKey string, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, "", ErrSSH.Wrap(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, "", ErrSSH.Wrap(err)
+	}
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, "", ErrSSH.Wrap(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), MarshalHostKey(pub), nil
+}
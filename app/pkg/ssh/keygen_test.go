@@ -0,0 +1,19 @@
+package ssh
+
+import (
+	"testing"
+)
+
+func TestGenerateKey(t *testing.T) {
+	privateKey, authorizedKey, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ParsePrivateKey(privateKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := MarshalHostKey(signer.PublicKey()); got != authorizedKey {
+		t.Fatalf("public key mismatch: %s != %s", got, authorizedKey)
+	}
+}
@@ -0,0 +1,108 @@
+package ssh
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+type poolCounter struct {
+	created     atomic.Int64
+	reconnected atomic.Int64
+	evicted     atomic.Int64
+}
+
+// PoolStats 连接池统计
+type PoolStats struct {
+	Total       int          `json:"total"`       //当前连接数
+	Active      int          `json:"active"`      //使用中的连接数
+	Idle        int          `json:"idle"`        //空闲连接数
+	Broken      int          `json:"broken"`      //已断开等待清理的连接数
+	Created     int64        `json:"created"`     //累计创建连接数
+	Reconnected int64        `json:"reconnected"` //累计断线重连次数
+	Evicted     int64        `json:"evicted"`     //累计空闲或断开关闭的连接数
+	Clients     []ClientStat `json:"clients"`
+}
+
+// ClientStat 单个连接的状态
+type ClientStat struct {
+	User      string    `json:"user"`
+	Host      string    `json:"host"`
+	Port      int       `json:"port"`
+	Jump      string    `json:"jump"` //跳板机
+	Ref       int32     `json:"ref"`  //使用中的会话数
+	Broken    bool      `json:"broken"`
+	CreatedAt time.Time `json:"created_at"`
+	LastUsed  time.Time `json:"last_used"`
+}
+
+// Stats 连接池统计
+func (s *Ssh) Stats() PoolStats {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	stats := PoolStats{
+		Total:       len(s.clients),
+		Created:     s.stats.created.Load(),
+		Reconnected: s.stats.reconnected.Load(),
+		Evicted:     s.stats.evicted.Load(),
+		Clients:     make([]ClientStat, 0, len(s.clients)),
+	}
+	for _, c := range s.clients {
+		stat := ClientStat{
+			User:      c.serverConfig.User,
+			Host:      c.serverConfig.Host,
+			Port:      c.serverConfig.Port,
+			Ref:       c.Ref(),
+			Broken:    c.IsBroken(),
+			CreatedAt: c.createdAt,
+			LastUsed:  c.LastUsed(),
+		}
+		if c.serverConfig.Jump != nil {
+			stat.Jump = c.serverConfig.Jump.Host
+		}
+		switch {
+		case stat.Broken:
+			stats.Broken++
+		case stat.Ref > 0:
+			stats.Active++
+		default:
+			stats.Idle++
+		}
+		stats.Clients = append(stats.Clients, stat)
+	}
+	sort.Slice(stats.Clients, func(i, j int) bool {
+		return stats.Clients[i].CreatedAt.Before(stats.Clients[j].CreatedAt)
+	})
+	return stats
+}
+
+// janitor 定时关闭空闲超时和已断开的连接
+func (s *Ssh) janitor() {
+	interval := s.idleTimeout / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	tk := time.NewTicker(interval)
+	defer tk.Stop()
+	for range tk.C {
+		s.evict()
+	}
+}
+
+func (s *Ssh) evict() {
+	now := time.Now()
+	evicted := make([]*client, 0)
+	s.mux.Lock()
+	for key, c := range s.clients {
+		if c.IsBroken() || (c.Ref() <= 0 && now.Sub(c.LastUsed()) > s.idleTimeout) {
+			delete(s.clients, key)
+			evicted = append(evicted, c)
+		}
+	}
+	s.mux.Unlock()
+	//在锁外关闭，关闭连接会释放跳板机连接
+	for _, c := range evicted {
+		c.close()
+	}
+	s.stats.evicted.Add(int64(len(evicted)))
+}
@@ -0,0 +1,327 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"os/exec"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testServer 支持exec和sftp的ssh服务，记录所有连接方便模拟断线
+type testServer struct {
+	t      *testing.T
+	l      net.Listener
+	config *ssh.ServerConfig
+	mux    sync.Mutex
+	conns  []net.Conn
+
+	forwarded atomic.Int32 //作为跳板机转发的连接数
+}
+
+func newTestServer(t *testing.T) *testServer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &testServer{t: t, l: l, config: config}
+	t.Cleanup(func() {
+		_ = l.Close()
+		srv.dropAll()
+	})
+	go srv.serve()
+	return srv
+}
+
+func (srv *testServer) serve() {
+	for {
+		conn, err := srv.l.Accept()
+		if err != nil {
+			return
+		}
+		srv.mux.Lock()
+		srv.conns = append(srv.conns, conn)
+		srv.mux.Unlock()
+		go srv.handle(conn)
+	}
+}
+
+func (srv *testServer) handle(conn net.Conn) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, srv.config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for ch := range chans {
+		if ch.ChannelType() == "direct-tcpip" {
+			go srv.forward(ch)
+			continue
+		}
+		channel, requests, err := ch.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				switch req.Type {
+				case "exec":
+					_ = req.Reply(true, nil)
+					go runExec(channel, string(req.Payload[4:]))
+				case "subsystem":
+					_ = req.Reply(string(req.Payload[4:]) == "sftp", nil)
+					if server, err := sftp.NewServer(channel); err == nil {
+						go func() {
+							_ = server.Serve()
+							_ = channel.Close()
+						}()
+					}
+				default:
+					_ = req.Reply(false, nil)
+				}
+			}
+		}()
+	}
+}
+
+// forward 作为跳板机转发到目标地址
+func (srv *testServer) forward(ch ssh.NewChannel) {
+	target := struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}{}
+	if err := ssh.Unmarshal(ch.ExtraData(), &target); err != nil {
+		_ = ch.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+	if err != nil {
+		_ = ch.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := ch.Accept()
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	srv.forwarded.Add(1)
+	go ssh.DiscardRequests(requests)
+	go func() {
+		_, _ = io.Copy(conn, channel)
+		_ = conn.Close()
+	}()
+	go func() {
+		_, _ = io.Copy(channel, conn)
+		_ = channel.Close()
+	}()
+}
+
+// runExec 在本机执行命令模拟服务器执行
+func runExec(channel ssh.Channel, cmd string) {
+	c := exec.Command("sh", "-c", cmd)
+	c.Stdout = channel
+	c.Stderr = channel.Stderr()
+	code := 0
+	if err := c.Run(); err != nil {
+		code = 1
+		if e, ok := err.(*exec.ExitError); ok {
+			code = e.ExitCode()
+		}
+	}
+	status := make([]byte, 4)
+	binary.BigEndian.PutUint32(status, uint32(code))
+	_, _ = channel.SendRequest("exit-status", false, status)
+	_ = channel.Close()
+}
+
+// dropAll 断开所有连接，模拟网络中断
+func (srv *testServer) dropAll() {
+	srv.mux.Lock()
+	defer srv.mux.Unlock()
+	for _, c := range srv.conns {
+		_ = c.Close()
+	}
+	srv.conns = nil
+}
+
+func (srv *testServer) serverConfig() ServerConfig {
+	host, port, _ := net.SplitHostPort(srv.l.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return ServerConfig{
+		User: "test", Host: host, Port: p, Timeout: time.Second,
+		OnNewHostKey: func(hostKey string) error { return nil },
+	}
+}
+
+func newTestSsh(idleTimeout time.Duration) *Ssh {
+	return &Ssh{
+		mux:         &sync.RWMutex{},
+		clients:     make(map[string]*client),
+		timeout:     time.Second,
+		keepAlive:   time.Hour,
+		idleTimeout: idleTimeout,
+	}
+}
+
+func TestPoolReconnect(t *testing.T) {
+	srv := newTestServer(t)
+	s := newTestSsh(time.Minute)
+	conf := srv.serverConfig()
+
+	out, err := s.RunCmd(conf, "echo ok")
+	if err != nil || string(out) != "ok\n" {
+		t.Fatalf("run: %q %v", out, err)
+	}
+	if _, err = s.RunCmd(conf, "pwd"); err != nil {
+		t.Fatal(err)
+	}
+	if stats := s.Stats(); stats.Total != 1 || stats.Created != 1 || stats.Idle != 1 {
+		t.Fatalf("stats: %+v", stats)
+	}
+
+	srv.dropAll()
+	if _, err = s.RunCmd(conf, "pwd"); err != nil {
+		t.Fatalf("run after network blip: %v", err)
+	}
+	if stats := s.Stats(); stats.Total != 1 || stats.Created != 2 || stats.Reconnected != 1 {
+		t.Fatalf("stats after reconnect: %+v", stats)
+	}
+}
+
+func TestPoolEvictIdle(t *testing.T) {
+	srv := newTestServer(t)
+	s := newTestSsh(time.Millisecond * 50)
+	conf := srv.serverConfig()
+
+	re, err := s.NewRemoteExec(conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	s.evict()
+	if stats := s.Stats(); stats.Active != 1 {
+		t.Fatalf("client in use should not be evicted: %+v", stats)
+	}
+	if err = re.Run("pwd"); err != nil {
+		t.Fatal(err)
+	}
+	_ = re.Close()
+
+	time.Sleep(time.Millisecond * 100)
+	s.evict()
+	if stats := s.Stats(); stats.Total != 0 || stats.Evicted != 1 {
+		t.Fatalf("idle client should be evicted: %+v", stats)
+	}
+}
+
+func TestPoolJump(t *testing.T) {
+	jumpSrv, targetSrv := newTestServer(t), newTestServer(t)
+	s := newTestSsh(time.Minute)
+	jump := jumpSrv.serverConfig()
+	conf1, conf2 := targetSrv.serverConfig(), targetSrv.serverConfig()
+	conf2.User = "deploy"
+	conf1.Jump, conf2.Jump = &jump, &jump
+
+	for _, conf := range []ServerConfig{conf1, conf2, conf1} {
+		out, err := s.RunCmd(conf, "echo ok")
+		if err != nil || string(out) != "ok\n" {
+			t.Fatalf("run via jump: %q %v", out, err)
+		}
+	}
+	//两台目标服务器复用同一个跳板机连接
+	if stats := s.Stats(); stats.Total != 3 || stats.Created != 3 {
+		t.Fatalf("stats: %+v", stats)
+	}
+	if n := jumpSrv.forwarded.Load(); n != 2 {
+		t.Fatalf("forwarded %d connections", n)
+	}
+	if direct := targetSrv.serverConfig(); conf1.String() == direct.String() {
+		t.Fatal("pool key should include jump server")
+	}
+
+	//跳板机断开后重新连接
+	jumpSrv.dropAll()
+	if _, err := s.RunCmd(conf1, "pwd"); err != nil {
+		t.Fatalf("run after jump dropped: %v", err)
+	}
+}
+
+// TestPoolDialConcurrent 连接无响应的服务器时不阻塞其他服务器，同一服务器同时获取只建立一个连接
+func TestPoolDialConcurrent(t *testing.T) {
+	//接受连接但不握手的服务器
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	conns := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conns <- conn
+		}
+	}()
+	srv := newTestServer(t)
+	s := newTestSsh(time.Minute)
+	stalled := srv.serverConfig()
+	stalled.Port = l.Addr().(*net.TCPAddr).Port
+	done := make(chan struct{})
+	go func() {
+		_, _ = s.newClient(stalled)
+		close(done)
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.newClient(srv.serverConfig()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	waited := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(time.Second * 3):
+		_ = (<-conns).Close()
+		t.Fatal("blocked by stalled server")
+	}
+	if stats := s.Stats(); stats.Total != 1 || stats.Created != 1 {
+		t.Fatalf("stats: %+v", stats)
+	}
+	//握手没有超时，关闭连接后结束
+	_ = (<-conns).Close()
+	<-done
+}
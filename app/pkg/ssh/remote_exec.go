@@ -3,14 +3,16 @@ package ssh
 import (
 	"context"
 	"fmt"
+	"golang.org/x/crypto/ssh"
 	"io"
 	"strings"
 )
 
 type RemoteExec struct {
-	client *client
-	envs   *Envs
-	output io.Writer
+	client    *client
+	envs      *Envs
+	output    io.Writer
+	reconnect func() (*client, error) //连接断开时重新获取连接
 }
 
 func (e *RemoteExec) Close() error {
@@ -24,7 +26,7 @@ func (e *RemoteExec) WithEnvs(envs *Envs) Command {
 }
 
 func (e *RemoteExec) RunCtx(ctx context.Context, cmd string) error {
-	sess, err := e.client.client.NewSession()
+	sess, err := e.newSession()
 	if err != nil {
 		return err
 	}
@@ -65,3 +67,22 @@ func (e *RemoteExec) RunCtx(ctx context.Context, cmd string) error {
 func (e *RemoteExec) Run(cmd string) error {
 	return e.RunCtx(nil, cmd)
 }
+
+// newSession 连接已断开时重新连接后再创建会话
+func (e *RemoteExec) newSession() (*ssh.Session, error) {
+	sess, err := e.client.client.NewSession()
+	if err == nil {
+		return sess, nil
+	}
+	if err = e.client.checkBroken(err); !ErrConnBroken.Has(err) || e.reconnect == nil {
+		return nil, err
+	}
+	c, err := e.reconnect()
+	if err != nil {
+		return nil, err
+	}
+	c.add()
+	e.client.Done()
+	e.client = c
+	return e.client.client.NewSession()
+}
@@ -1,9 +1,14 @@
 package ssh
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"github.com/pkg/sftp"
+	"github.com/zeebo/errs"
 	"io"
 	"os"
+	"strings"
 )
 
 type Sftp struct {
@@ -31,3 +36,152 @@ func (s *Sftp) Copy(localFile, remoteFile string) error {
 	_, err = io.Copy(rf, lf)
 	return err
 }
+
+// WriteFile 写入远程文件并设置权限，先设置权限再写入内容，避免内容短暂可被其他用户读取
+func (s *Sftp) WriteFile(remoteFile string, data []byte, perm os.FileMode) error {
+	rf, err := s.sftpClient.OpenFile(remoteFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	defer rf.Close()
+	if err = rf.Chmod(perm); err != nil {
+		return err
+	}
+	_, err = rf.Write(data)
+	return err
+}
+
+// Progress 上传进度回调，uploaded包含续传前已上传的部分
+type Progress func(uploaded, total int64)
+
+// UploadResult 上传结果
+type UploadResult struct {
+	Size    int64  //文件大小
+	Resumed int64  //续传时已上传的大小
+	Sha256  string //文件sha256
+}
+
+// ErrChecksum 上传后远程文件sha256和本地不一致
+var ErrChecksum = errs.Class("上传文件sha256校验失败")
+
+// partSuffix 上传中的临时文件后缀，上传完成校验通过后重命名
+const partSuffix = ".part"
+
+// Upload 断点续传上传文件，先上传到临时文件，已存在时从临时文件末尾续传，
+// 上传完成后校验远程文件sha256，续传的文件校验失败时重新完整上传一次
+func (s *Sftp) Upload(localFile, remoteFile string, progress Progress) (*UploadResult, error) {
+	sum, err := FileSha256(localFile)
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.upload(localFile, remoteFile, sum, progress, true)
+	if ErrChecksum.Has(err) && result.Resumed > 0 {
+		result, err = s.upload(localFile, remoteFile, sum, progress, false)
+	}
+	return result, err
+}
+
+func (s *Sftp) upload(localFile, remoteFile, sum string, progress Progress, resume bool) (*UploadResult, error) {
+	lf, err := os.Open(localFile)
+	if err != nil {
+		return nil, err
+	}
+	defer lf.Close()
+	stat, err := lf.Stat()
+	if err != nil {
+		return nil, err
+	}
+	result := &UploadResult{Size: stat.Size(), Sha256: sum}
+	partFile := remoteFile + partSuffix
+	if resume {
+		if rs, err := s.sftpClient.Stat(partFile); err == nil && rs.Size() <= result.Size {
+			result.Resumed = rs.Size()
+		}
+	}
+	flags := os.O_WRONLY | os.O_CREATE
+	if result.Resumed == 0 {
+		flags |= os.O_TRUNC
+	}
+	rf, err := s.sftpClient.OpenFile(partFile, flags)
+	if err != nil {
+		return result, err
+	}
+	defer rf.Close()
+	if _, err = lf.Seek(result.Resumed, io.SeekStart); err != nil {
+		return result, err
+	}
+	if _, err = rf.Seek(result.Resumed, io.SeekStart); err != nil {
+		return result, err
+	}
+	w := &progressWriter{w: rf, uploaded: result.Resumed, total: result.Size, progress: progress}
+	if _, err = io.Copy(w, lf); err != nil {
+		return result, err
+	}
+	if err = rf.Close(); err != nil {
+		return result, err
+	}
+	remoteSum, err := s.remoteSha256(partFile)
+	if err != nil {
+		return result, err
+	}
+	if remoteSum != sum {
+		//校验失败的临时文件删除，下次重新上传
+		_ = s.sftpClient.Remove(partFile)
+		return result, ErrChecksum.New("本地：%s，远程：%s", sum, remoteSum)
+	}
+	return result, s.sftpClient.PosixRename(partFile, remoteFile)
+}
+
+// remoteSha256 优先在服务器执行sha256sum计算，命令不存在时读取远程文件计算
+func (s *Sftp) remoteSha256(remoteFile string) (string, error) {
+	file := ShellQuote(remoteFile)
+	output, err := s.client.RunCmd(fmt.Sprintf("sha256sum %s 2>/dev/null || shasum -a 256 %s", file, file))
+	if fields := strings.Fields(string(output)); err == nil && len(fields) > 0 {
+		return strings.ToLower(fields[0]), nil
+	}
+	rf, err := s.sftpClient.Open(remoteFile)
+	if err != nil {
+		return "", err
+	}
+	defer rf.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, rf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// FileSha256 计算本地文件sha256
+func FileSha256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type progressWriter struct {
+	w        io.Writer
+	uploaded int64
+	total    int64
+	progress Progress
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.uploaded += int64(n)
+	if p.progress != nil {
+		p.progress(p.uploaded, p.total)
+	}
+	return n, err
+}
+
+// ShellQuote 转义为shell单引号字符串
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,64 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSftpUpload(t *testing.T) {
+	srv := newTestServer(t)
+	s := newTestSsh(time.Minute)
+	dir := t.TempDir()
+	localFile := filepath.Join(dir, "release.tar.gz")
+	remoteFile := filepath.Join(dir, "remote.tar.gz")
+	data := make([]byte, 1<<20)
+	_, _ = rand.Read(data)
+	if err := os.WriteFile(localFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	upload := func() (*UploadResult, int64) {
+		sftp, err := s.NewSftp(srv.serverConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sftp.Close()
+		var last int64
+		result, err := sftp.Upload(localFile, remoteFile, func(uploaded, total int64) {
+			last = uploaded
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		remote, _ := os.ReadFile(remoteFile)
+		if !bytes.Equal(remote, data) {
+			t.Fatal("remote file content mismatch")
+		}
+		return result, last
+	}
+	sum, _ := FileSha256(localFile)
+
+	result, last := upload()
+	if result.Resumed != 0 || result.Sha256 != sum || last != int64(len(data)) {
+		t.Fatalf("full upload: %+v, last progress: %d", result, last)
+	}
+
+	//续传
+	half := len(data) / 2
+	_ = os.WriteFile(remoteFile+partSuffix, data[:half], 0644)
+	if result, _ = upload(); result.Resumed != int64(half) {
+		t.Fatalf("resume upload: %+v", result)
+	}
+
+	//临时文件内容错误，校验失败后重新完整上传
+	_ = os.WriteFile(remoteFile+partSuffix, make([]byte, half), 0644)
+	if result, _ = upload(); result.Resumed != 0 {
+		t.Fatalf("reupload after checksum mismatch: %+v", result)
+	}
+	if _, err := os.Stat(remoteFile + partSuffix); !os.IsNotExist(err) {
+		t.Fatalf("part file should be renamed: %v", err)
+	}
+}
@@ -1,25 +1,33 @@
 package ssh
 
 import (
-	"fmt"
 	"github.com/zeebo/errs"
 	"golang.org/x/crypto/ssh"
 	"io"
 	"sync"
 	"time"
-	"yema.dev/app/utils"
 )
 
 var (
 	ErrSSH = errs.Class("ssh")
+	//ErrConnBroken 连接已断开，重新获取连接后可以重试
+	ErrConnBroken = errs.Class("ssh连接已断开")
 )
 
+// checkAliveTimeout 操作失败时检测连接是否正常的超时时间
+const checkAliveTimeout = time.Second * 5
+
 type Ssh struct {
 	mux     *sync.RWMutex
 	clients map[string]*client
+	dialMux sync.Map //每个服务器的连接锁，同一服务器同时只创建一个连接，不同服务器连接时不互相等待
 
 	identitySigner ssh.Signer
 	timeout        time.Duration
+	keepAlive      time.Duration
+	idleTimeout    time.Duration
+
+	stats poolCounter
 }
 
 func NewSSH(conf *Config) (*Ssh, error) {
@@ -33,93 +41,126 @@ func NewSSH(conf *Config) (*Ssh, error) {
 
 		identitySigner: iSigner,
 		timeout:        conf.Timeout,
+		keepAlive:      conf.KeepAlive,
+		idleTimeout:    conf.IdleTimeout,
 	}
-
-	if utils.IsDev() {
-		go func() {
-			tk := time.NewTicker(time.Second * 5)
-			defer tk.Stop()
-			for {
-				select {
-				case <-tk.C:
-					sh.mux.RLock()
-					if len(sh.clients) == 0 {
-						fmt.Printf("当前clients:[0] \r\n")
-					} else {
-						for _, v := range sh.clients {
-							fmt.Printf("当前clients:[%s], sessions:[%d]\r\n", v.serverConfig.String(), v.Ref())
-						}
-					}
-					sh.mux.RUnlock()
-				}
-			}
-		}()
+	if sh.idleTimeout > 0 {
+		go sh.janitor()
 	}
 	return sh, nil
 }
 
 func (s *Ssh) newClient(conf ServerConfig) (sc *client, err error) {
-	s.mux.Lock()
-	defer s.mux.Unlock()
+	return s.getClient(conf)
+}
+
+// getClient 获取或创建连接，已断开的连接重新连接，配置了跳板机时先获取跳板机的连接，
+// 连接在连接池的锁外建立，只持有该服务器的连接锁
+func (s *Ssh) getClient(conf ServerConfig) (sc *client, err error) {
 	key := conf.String()
-	if v, ok := s.clients[key]; ok {
-		return v, nil
+	if sc = s.loadClient(key); sc != nil {
+		return sc, nil
+	}
+	dialMux := s.dialLock(key)
+	dialMux.Lock()
+	defer dialMux.Unlock()
+	//等待期间其他调用已经建立了连接
+	if sc = s.loadClient(key); sc != nil {
+		return sc, nil
 	}
 	if conf.Timeout == 0 {
 		conf.Timeout = s.timeout
 	}
-	conf.IdentitySigner = s.identitySigner
-	sc, err = NewClient(&conf, func() {
-		s.mux.Lock()
-		defer s.mux.Unlock()
-		key := conf.String()
-		if _, ok := s.clients[key]; ok {
-			delete(s.clients, key)
+	if conf.IdentitySigner, err = s.Signer(conf); err != nil {
+		return
+	}
+	var jump *client
+	if conf.Jump != nil {
+		if jump, err = s.getClient(*conf.Jump); err != nil {
+			return nil, ErrSSH.New("连接跳板机[%s:%d]失败：%s", conf.Jump.Host, conf.Jump.Port, err)
 		}
-	})
+	}
+	sc, err = NewClient(&conf, jump, s.keepAlive)
 	if err != nil {
 		return
 	}
+	s.mux.Lock()
 	s.clients[key] = sc
+	s.mux.Unlock()
+	s.stats.created.Add(1)
 	return
 }
 
-func (s *Ssh) removeClient(conf *ServerConfig) {
+// loadClient 从连接池取出未断开的连接，已断开的连接移除
+func (s *Ssh) loadClient(key string) *client {
 	s.mux.Lock()
 	defer s.mux.Unlock()
-	key := conf.String()
-	if _, ok := s.clients[key]; ok {
-		delete(s.clients, key)
+	v, ok := s.clients[key]
+	if !ok {
+		return nil
 	}
+	if !v.IsBroken() {
+		//避免刚取出的连接被空闲检测关闭
+		v.touch()
+		return v
+	}
+	delete(s.clients, key)
+	s.stats.reconnected.Add(1)
+	return nil
+}
+
+// dialLock 服务器的连接锁
+func (s *Ssh) dialLock(key string) *sync.Mutex {
+	v, _ := s.dialMux.LoadOrStore(key, &sync.Mutex{})
+	return v.(*sync.Mutex)
+}
+
+// retry 连接已断开时重新连接再试一次
+func retry(fn func() error) (err error) {
+	for i := 0; i < 2; i++ {
+		if err = fn(); !ErrConnBroken.Has(err) {
+			return
+		}
+	}
+	return
 }
 
 // NewTerminal 获取会话终端
 func (s *Ssh) NewTerminal(conf ServerConfig, cols, rows int) (sess *Terminal, err error) {
-	sshClient, err := s.newClient(conf)
-	if err != nil {
-		err = ErrSSH.Wrap(err)
-		return
-	}
-	return sshClient.NewTerminal(cols, rows)
+	err = retry(func() error {
+		sshClient, err := s.newClient(conf)
+		if err != nil {
+			return ErrSSH.Wrap(err)
+		}
+		sess, err = sshClient.NewTerminal(cols, rows)
+		return err
+	})
+	return
 }
 
 // RunCmd 直接连接执行命令
 func (s *Ssh) RunCmd(conf ServerConfig, cmd string) (output []byte, err error) {
-	sshClient, err := s.newClient(conf)
-	if err != nil {
-		err = ErrSSH.Wrap(err)
-		return
-	}
-	return sshClient.RunCmd(cmd)
+	err = retry(func() error {
+		sshClient, err := s.newClient(conf)
+		if err != nil {
+			return ErrSSH.Wrap(err)
+		}
+		output, err = sshClient.RunCmd(cmd)
+		return err
+	})
+	return
 }
 
-func (s *Ssh) NewSftp(conf ServerConfig) (*Sftp, error) {
-	sshClient, err := s.newClient(conf)
-	if err != nil {
-		err = ErrSSH.Wrap(err)
-		return nil, err
-	}
-	return sshClient.NewSftp()
+func (s *Ssh) NewSftp(conf ServerConfig) (sftp *Sftp, err error) {
+	err = retry(func() error {
+		sshClient, err := s.newClient(conf)
+		if err != nil {
+			return ErrSSH.Wrap(err)
+		}
+		sftp, err = sshClient.NewSftp()
+		return err
+	})
+	return
 }
 
 func (s *Ssh) NewRemoteExec(conf ServerConfig, output io.Writer) (*RemoteExec, error) {
@@ -128,9 +169,24 @@ func (s *Ssh) NewRemoteExec(conf ServerConfig, output io.Writer) (*RemoteExec, e
 		err = ErrSSH.Wrap(err)
 		return nil, err
 	}
-	return sshClient.NewRemoteExec(output)
+	re, err := sshClient.NewRemoteExec(output)
+	if err != nil {
+		return nil, err
+	}
+	re.reconnect = func() (*client, error) {
+		return s.newClient(conf)
+	}
+	return re, nil
 }
 
 func (s *Ssh) GetIdentitySigner() ssh.Signer {
 	return s.identitySigner
 }
+
+// Signer 服务器配置了私钥时使用该私钥，否则使用全局免密登陆密钥
+func (s *Ssh) Signer(conf ServerConfig) (ssh.Signer, error) {
+	if conf.PrivateKey == "" {
+		return s.identitySigner, nil
+	}
+	return ParsePrivateKey([]byte(conf.PrivateKey), conf.Passphrase)
+}
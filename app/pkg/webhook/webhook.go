@@ -0,0 +1,168 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/zeebo/errs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+var (
+	Error = errs.Class("webhook")
+	//ErrIgnored 不需要处理的事件，比如删除分支
+	ErrIgnored = Error.New("事件已忽略")
+	//ErrSignature 签名校验失败
+	ErrSignature = Error.New("签名校验失败")
+)
+
+const (
+	ProviderGithub = "github"
+	ProviderGitlab = "gitlab"
+	ProviderGitea  = "gitea"
+
+	refBranchPrefix = "refs/heads/"
+	refTagPrefix    = "refs/tags/"
+	zeroCommit      = "0000000000000000000000000000000000000000"
+)
+
+// Event push或者tag事件
+type Event struct {
+	Provider string
+	Ref      string
+	Branch   string //分支推送时的分支名
+	Tag      string //标签推送时的标签名
+	CommitId string
+	Pusher   string
+	Message  string
+}
+
+// pushPayload 三种平台推送事件的公共字段
+type pushPayload struct {
+	Ref         string `json:"ref"`
+	After       string `json:"after"`
+	CheckoutSha string `json:"checkout_sha"` //gitlab
+	UserName    string `json:"user_name"`    //gitlab
+	Pusher      struct {
+		Name     string `json:"name"`
+		Login    string `json:"login"`
+		Username string `json:"username"`
+	} `json:"pusher"`
+	HeadCommit struct {
+		Message string `json:"message"`
+	} `json:"head_commit"`
+	Commits []struct {
+		Id      string `json:"id"`
+		Message string `json:"message"`
+	} `json:"commits"`
+}
+
+// Parse 根据请求头识别平台，校验签名后解析推送事件
+func Parse(header http.Header, body []byte, secret string) (*Event, error) {
+	event := &Event{}
+	var eventType string
+	switch {
+	case header.Get("X-Gitea-Event") != "":
+		event.Provider = ProviderGitea
+		eventType = header.Get("X-Gitea-Event")
+		if !verifyHmac(body, secret, header.Get("X-Gitea-Signature")) {
+			return nil, ErrSignature
+		}
+	case header.Get("X-Gitlab-Event") != "":
+		event.Provider = ProviderGitlab
+		eventType = header.Get("X-Gitlab-Event")
+		token := header.Get("X-Gitlab-Token")
+		if secret == "" || subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			return nil, ErrSignature
+		}
+	case header.Get("X-GitHub-Event") != "":
+		event.Provider = ProviderGithub
+		eventType = header.Get("X-GitHub-Event")
+		if !verifyHmac(body, secret, strings.TrimPrefix(header.Get("X-Hub-Signature-256"), "sha256=")) {
+			return nil, ErrSignature
+		}
+	default:
+		return nil, Error.New("不支持的webhook请求")
+	}
+	switch eventType {
+	case "push", "Push Hook", "Tag Push Hook":
+	default:
+		return nil, ErrIgnored
+	}
+
+	payload := pushPayload{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, Error.Wrap(err)
+	}
+	event.Ref = payload.Ref
+	event.CommitId = payload.After
+	if payload.CheckoutSha != "" {
+		event.CommitId = payload.CheckoutSha
+	}
+	if event.CommitId == "" || event.CommitId == zeroCommit {
+		return nil, ErrIgnored
+	}
+	switch {
+	case strings.HasPrefix(payload.Ref, refBranchPrefix):
+		event.Branch = strings.TrimPrefix(payload.Ref, refBranchPrefix)
+	case strings.HasPrefix(payload.Ref, refTagPrefix):
+		event.Tag = strings.TrimPrefix(payload.Ref, refTagPrefix)
+	default:
+		return nil, ErrIgnored
+	}
+	event.Pusher = firstNotEmpty(payload.Pusher.Login, payload.Pusher.Username, payload.Pusher.Name, payload.UserName)
+	event.Message = payload.HeadCommit.Message
+	for _, v := range payload.Commits {
+		if v.Id == event.CommitId {
+			event.Message = v.Message
+		}
+	}
+	event.Message = strings.TrimSpace(event.Message)
+	return event, nil
+}
+
+// Match 分支或标签名是否匹配规则，多个规则用换行或逗号分隔，支持通配符，比如 release/*
+func Match(patterns, name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, p := range strings.FieldsFunc(patterns, func(r rune) bool {
+		return r == '\n' || r == ','
+	}) {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign 计算hmac-sha256签名
+func Sign(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func verifyHmac(body []byte, secret, signature string) bool {
+	if secret == "" || signature == "" {
+		return false
+	}
+	return hmac.Equal([]byte(Sign(body, secret)), []byte(strings.ToLower(signature)))
+}
+
+func firstNotEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,97 @@
+package webhook
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+const secret = "s3cret"
+
+func TestParseGithub(t *testing.T) {
+	body := []byte(`{"ref":"refs/heads/main","after":"1111111111111111111111111111111111111111",
+"pusher":{"name":"alice"},"head_commit":{"message":"fix bug\n"}}`)
+	header := http.Header{}
+	header.Set("X-GitHub-Event", "push")
+	header.Set("X-Hub-Signature-256", "sha256="+Sign(body, secret))
+	event, err := Parse(header, body, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Provider != ProviderGithub || event.Branch != "main" || event.Tag != "" ||
+		event.CommitId != "1111111111111111111111111111111111111111" || event.Pusher != "alice" || event.Message != "fix bug" {
+		t.Fatalf("event: %+v", event)
+	}
+
+	if _, err = Parse(header, body, "wrong"); !errors.Is(err, ErrSignature) {
+		t.Fatalf("wrong secret: %v", err)
+	}
+	header.Set("X-GitHub-Event", "issues")
+	if _, err = Parse(header, body, secret); !errors.Is(err, ErrIgnored) {
+		t.Fatalf("issues event: %v", err)
+	}
+}
+
+func TestParseGitlab(t *testing.T) {
+	body := []byte(`{"object_kind":"tag_push","ref":"refs/tags/v1.2.0","after":"2222222222222222222222222222222222222222",
+"checkout_sha":"3333333333333333333333333333333333333333","user_name":"bob"}`)
+	header := http.Header{}
+	header.Set("X-Gitlab-Event", "Tag Push Hook")
+	header.Set("X-Gitlab-Token", secret)
+	event, err := Parse(header, body, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Provider != ProviderGitlab || event.Tag != "v1.2.0" || event.Branch != "" ||
+		event.CommitId != "3333333333333333333333333333333333333333" || event.Pusher != "bob" {
+		t.Fatalf("event: %+v", event)
+	}
+	header.Set("X-Gitlab-Token", "wrong")
+	if _, err = Parse(header, body, secret); !errors.Is(err, ErrSignature) {
+		t.Fatalf("wrong token: %v", err)
+	}
+}
+
+func TestParseGitea(t *testing.T) {
+	body := []byte(`{"ref":"refs/heads/release/1.0","after":"4444444444444444444444444444444444444444",
+"pusher":{"login":"carol","username":"carol"},"commits":[{"id":"4444444444444444444444444444444444444444","message":"release"}]}`)
+	header := http.Header{}
+	//gitea同时会发送github的请求头
+	header.Set("X-GitHub-Event", "push")
+	header.Set("X-Gitea-Event", "push")
+	header.Set("X-Gitea-Signature", Sign(body, secret))
+	event, err := Parse(header, body, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Provider != ProviderGitea || event.Branch != "release/1.0" || event.Pusher != "carol" || event.Message != "release" {
+		t.Fatalf("event: %+v", event)
+	}
+
+	//删除分支
+	body = []byte(`{"ref":"refs/heads/dev","after":"0000000000000000000000000000000000000000"}`)
+	header.Set("X-Gitea-Signature", Sign(body, secret))
+	if _, err = Parse(header, body, secret); !errors.Is(err, ErrIgnored) {
+		t.Fatalf("delete branch: %v", err)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		patterns, name string
+		want           bool
+	}{
+		{"main", "main", true},
+		{"main\ndev", "dev", true},
+		{"release/*", "release/1.0", true},
+		{"release/*", "release", false},
+		{"v*, hotfix-*", "v1.0.0", true},
+		{"", "main", false},
+		{"*", "", false},
+	}
+	for _, c := range cases {
+		if got := Match(c.patterns, c.name); got != c.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", c.patterns, c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package common
+
+import (
+	"strconv"
+	"yema.dev/app/model"
+	"yema.dev/app/pkg/repo"
+)
+
+// NewRepo 根据项目配置获取代码仓库，使用项目配置的仓库授权
+func NewRepo(repos *repo.Repos, project *model.Project) (repo.Repo, error) {
+	return repos.New(repo.TypeRepo(project.RepoType), project.RepoUrl, strconv.FormatInt(project.ID, 10), &repo.Auth{
+		Username:   project.RepoUsername,
+		Password:   project.RepoPassword.String(),
+		PrivateKey: project.RepoPrivateKey.String(),
+	})
+}
@@ -0,0 +1,67 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"yema.dev/app/model"
+	"yema.dev/app/pkg/ssh"
+)
+
+// MaxJumpDepth 跳板机最多嵌套层数
+const MaxJumpDepth = 3
+
+// SshConfig 服务器的ssh连接配置，使用服务器指定的登录凭据，未指定时使用空间默认凭据，
+// 都没有时使用全局免密登陆密钥，连接时校验已记录的主机公钥，配置了跳板机时通过跳板机连接
+func SshConfig(db *gorm.DB, server *model.Server) (ssh.ServerConfig, error) {
+	return sshConfig(db, server, 0)
+}
+
+func sshConfig(db *gorm.DB, server *model.Server, depth int) (ssh.ServerConfig, error) {
+	conf := ssh.ServerConfig{
+		User:    server.User,
+		Host:    server.Host,
+		Port:    server.Port,
+		HostKey: server.HostKey,
+	}
+	if server.JumpServerId > 0 {
+		if depth >= MaxJumpDepth {
+			return conf, fmt.Errorf("服务器[%s]的跳板机嵌套超过%d层", server.Hostname(), MaxJumpDepth)
+		}
+		jumpServer := model.Server{}
+		err := db.Where("space_id = ? and id = ?", server.SpaceId, server.JumpServerId).First(&jumpServer).Error
+		if err != nil {
+			return conf, fmt.Errorf("服务器[%s]的跳板机不存在：%w", server.Hostname(), err)
+		}
+		jump, err := sshConfig(db, &jumpServer, depth+1)
+		if err != nil {
+			return conf, err
+		}
+		conf.Jump = &jump
+	}
+	credential := model.Credential{}
+	_db := db.Where("space_id = ?", server.SpaceId)
+	if server.CredentialId > 0 {
+		_db = _db.Where("id = ?", server.CredentialId)
+	} else {
+		_db = _db.Where("is_default = ?", model.CredentialIsDefault)
+	}
+	err := _db.First(&credential).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if server.CredentialId > 0 {
+			return conf, errors.New("服务器[" + server.Hostname() + "]的登录凭据不存在")
+		}
+		return conf, nil
+	}
+	if err != nil {
+		return conf, err
+	}
+	switch credential.Type {
+	case model.CredentialTypePassword:
+		conf.Password = credential.Password.String()
+	case model.CredentialTypeKey:
+		conf.PrivateKey = credential.PrivateKey.String()
+		conf.Passphrase = credential.Passphrase.String()
+	}
+	return conf, nil
+}
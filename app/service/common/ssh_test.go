@@ -0,0 +1,105 @@
+package common
+
+import (
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"path/filepath"
+	"testing"
+	"yema.dev/app/model"
+)
+
+func newTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.AutoMigrate(&model.Server{}, &model.Credential{}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func createTestServer(t *testing.T, db *gorm.DB, server *model.Server) *model.Server {
+	server.User, server.Port = "root", 22
+	if err := db.Create(server).Error; err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestSshConfigCredential(t *testing.T) {
+	db := newTestDB(t)
+	credentials := []*model.Credential{
+		{SpaceId: 1, Name: "default", Type: model.CredentialTypePassword, Password: "default-pass", IsDefault: model.CredentialIsDefault},
+		{SpaceId: 1, Name: "deploy", Type: model.CredentialTypeKey, PrivateKey: "server-key", Passphrase: "phrase"},
+		{SpaceId: 2, Name: "other", Type: model.CredentialTypeKey, PrivateKey: "other-key"},
+	}
+	for _, c := range credentials {
+		if err := db.Create(c).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	cases := []struct {
+		name       string
+		server     model.Server
+		password   string
+		privateKey string
+		passphrase string
+		err        bool
+	}{
+		{"server credential", model.Server{SpaceId: 1, Host: "10.0.0.1", CredentialId: credentials[1].ID}, "", "server-key", "phrase", false},
+		{"space default", model.Server{SpaceId: 1, Host: "10.0.0.2"}, "default-pass", "", "", false},
+		{"global identity", model.Server{SpaceId: 2, Host: "10.0.0.3"}, "", "", "", false},
+		{"other space credential", model.Server{SpaceId: 1, Host: "10.0.0.4", CredentialId: credentials[2].ID}, "", "", "", true},
+		{"missing credential", model.Server{SpaceId: 1, Host: "10.0.0.5", CredentialId: 100}, "", "", "", true},
+	}
+	for _, c := range cases {
+		server := createTestServer(t, db, &c.server)
+		conf, err := SshConfig(db, server)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if conf.Password != c.password || conf.PrivateKey != c.privateKey || conf.Passphrase != c.passphrase {
+			t.Errorf("%s: got %q %q %q", c.name, conf.Password, conf.PrivateKey, conf.Passphrase)
+		}
+		if conf.Host != server.Host || conf.User != "root" || conf.Port != 22 {
+			t.Errorf("%s: server config %+v", c.name, conf)
+		}
+	}
+}
+
+func TestSshConfigJump(t *testing.T) {
+	db := newTestDB(t)
+	bastion := createTestServer(t, db, &model.Server{SpaceId: 1, Host: "bastion"})
+	inner := createTestServer(t, db, &model.Server{SpaceId: 1, Host: "inner", JumpServerId: bastion.ID})
+	app := createTestServer(t, db, &model.Server{SpaceId: 1, Host: "app", JumpServerId: inner.ID})
+	otherSpace := createTestServer(t, db, &model.Server{SpaceId: 2, Host: "other", JumpServerId: bastion.ID})
+
+	conf, err := SshConfig(db, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Jump == nil || conf.Jump.Host != "inner" || conf.Jump.Jump == nil || conf.Jump.Jump.Host != "bastion" || conf.Jump.Jump.Jump != nil {
+		t.Fatalf("jump chain error: %+v", conf)
+	}
+	//跳板机只能使用同一空间的服务器
+	if _, err = SshConfig(db, otherSpace); err == nil {
+		t.Fatal("expected jump server not found")
+	}
+
+	//超出最大嵌套层数
+	last := bastion
+	for i := 0; i <= MaxJumpDepth; i++ {
+		last = createTestServer(t, db, &model.Server{SpaceId: 1, Host: "nested", JumpServerId: last.ID})
+	}
+	if _, err = SshConfig(db, last); err == nil {
+		t.Fatal("expected jump depth error")
+	}
+}
@@ -0,0 +1,45 @@
+package credential
+
+import (
+	"yema.dev/app/model"
+	"yema.dev/app/pkg/db"
+)
+
+type CreateReq struct {
+	SpaceId     int64  `json:"-" binding:"required,gt=0"`
+	Name        string `json:"name" binding:"required,max=100"`
+	Type        string `json:"type" binding:"required,oneof=password key"`
+	Password    string `json:"password" binding:"required_if=Type password,max=100"`
+	PrivateKey  string `json:"private_key" binding:"required_if=Type key,max=10000"`
+	Passphrase  string `json:"passphrase" binding:"omitempty,max=100"`
+	IsDefault   int8   `json:"is_default" binding:"omitempty,oneof=0 1"`
+	Description string `json:"description" binding:"omitempty,max=500"`
+}
+
+type UpdateReq struct {
+	SpaceId     int64  `json:"-" binding:"required,gt=0"`
+	ID          int64  `json:"id" binding:"required,gt=0"`
+	Name        string `json:"name" binding:"required,max=100"`
+	Password    string `json:"password" binding:"omitempty,max=100"`
+	PrivateKey  string `json:"private_key" binding:"omitempty,max=10000"`
+	Passphrase  string `json:"passphrase" binding:"omitempty,max=100"`
+	IsDefault   int8   `json:"is_default" binding:"omitempty,oneof=0 1"`
+	Description string `json:"description" binding:"omitempty,max=500"`
+}
+
+// Fields 凭据类型不可修改，密码和私钥为空时不修改
+func (r *UpdateReq) Fields(typ string) []string {
+	fields := []string{"name", "is_default", "description"}
+	if typ == model.CredentialTypePassword && r.Password != "" {
+		fields = append(fields, "password")
+	}
+	if typ == model.CredentialTypeKey && r.PrivateKey != "" {
+		fields = append(fields, "private_key", "passphrase", "public_key", "fingerprint")
+	}
+	return fields
+}
+
+type ListReq struct {
+	SpaceId int64 `json:"-" binding:"required,gt=0"`
+	db.Paginator
+}
@@ -0,0 +1,126 @@
+package credential
+
+import (
+	"errors"
+	"gorm.io/gorm"
+	"strings"
+	"sync"
+	"yema.dev/app/model"
+	"yema.dev/app/model/field"
+	"yema.dev/app/pkg/ssh"
+	"yema.dev/app/service/common"
+)
+
+var (
+	service     *Service
+	onceService sync.Once
+)
+
+type Service struct {
+	db *gorm.DB
+}
+
+func NewService(db *gorm.DB) *Service {
+	onceService.Do(func() {
+		service = &Service{db: db}
+	})
+	return service
+}
+
+func (srv *Service) List(params *ListReq) (total int64, list []*model.Credential, err error) {
+	_db := srv.db.Model(&model.Credential{}).Where(model.Credential{SpaceId: params.SpaceId})
+	err = _db.Count(&total).Error
+	if err != nil || total == 0 {
+		return
+	}
+	err = _db.Scopes(params.PageQuery()).Order("id desc").Find(&list).Error
+	return
+}
+
+func (srv *Service) Create(params *CreateReq) error {
+	m := &model.Credential{
+		SpaceId:     params.SpaceId,
+		Name:        params.Name,
+		Type:        params.Type,
+		IsDefault:   params.IsDefault,
+		Description: params.Description,
+	}
+	if m.Type == model.CredentialTypePassword {
+		m.Password = field.Encrypted(params.Password)
+	} else if err := setPrivateKey(m, params.PrivateKey, params.Passphrase); err != nil {
+		return err
+	}
+	return srv.db.Transaction(func(tx *gorm.DB) error {
+		if err := clearDefault(tx, m); err != nil {
+			return err
+		}
+		return tx.Create(m).Error
+	})
+}
+
+func (srv *Service) Update(params *UpdateReq) error {
+	m := &model.Credential{}
+	err := srv.db.Where(model.Credential{SpaceId: params.SpaceId, ID: params.ID}).First(m).Error
+	if err != nil {
+		return err
+	}
+	m.Name = params.Name
+	m.IsDefault = params.IsDefault
+	m.Description = params.Description
+	if m.Type == model.CredentialTypePassword {
+		m.Password = field.Encrypted(params.Password)
+	} else if params.PrivateKey != "" {
+		if err = setPrivateKey(m, params.PrivateKey, params.Passphrase); err != nil {
+			return err
+		}
+	}
+	return srv.db.Transaction(func(tx *gorm.DB) error {
+		if err := clearDefault(tx, m); err != nil {
+			return err
+		}
+		return tx.Model(m).Select(params.Fields(m.Type)).Updates(m).Error
+	})
+}
+
+// Delete 还有服务器使用该凭据时不允许删除
+func (srv *Service) Delete(spaceWithId *common.SpaceWithId) error {
+	var total int64
+	err := srv.db.Model(&model.Server{}).Where("space_id = ? and credential_id = ?", spaceWithId.SpaceId, spaceWithId.ID).Count(&total).Error
+	if err != nil {
+		return err
+	}
+	if total > 0 {
+		return errors.New("还有服务器使用该凭据，不允许删除，请先修改这些服务器的登录凭据")
+	}
+	result := srv.db.Where(spaceWithId).Delete(&model.Credential{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("删除失败")
+	}
+	return nil
+}
+
+// setPrivateKey 校验私钥并记录公钥，方便添加到服务器的authorized_keys
+func setPrivateKey(m *model.Credential, privateKey, passphrase string) error {
+	privateKey = strings.TrimSpace(privateKey) + "\n"
+	signer, err := ssh.ParsePrivateKey([]byte(privateKey), passphrase)
+	if err != nil {
+		return errors.New("私钥格式错误或私钥密码错误：" + err.Error())
+	}
+	m.PrivateKey = field.Encrypted(privateKey)
+	m.Passphrase = field.Encrypted(passphrase)
+	m.PublicKey = ssh.MarshalHostKey(signer.PublicKey())
+	m.Fingerprint = ssh.Fingerprint(m.PublicKey)
+	return nil
+}
+
+// clearDefault 每个空间只有一个默认凭据
+func clearDefault(tx *gorm.DB, m *model.Credential) error {
+	if m.IsDefault != model.CredentialIsDefault {
+		return nil
+	}
+	return tx.Model(&model.Credential{}).Where("space_id = ? and id <> ? and is_default = ?", m.SpaceId, m.ID, model.CredentialIsDefault).
+		UpdateColumn("is_default", model.CredentialNotDefault).Error
+}
@@ -0,0 +1,171 @@
+package deploy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/wuzfei/go-helper/files"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"yema.dev/app/model"
+)
+
+// artifactEvictInterval 定时清理过期缓存的间隔
+const artifactEvictInterval = time.Hour
+
+// artifactStore 构建产物缓存，按仓库、提交和构建脚本缓存打包好的程序包
+type artifactStore struct {
+	mux     sync.Mutex
+	db      *gorm.DB
+	log     *zap.Logger
+	dir     string
+	maxSize int64         //缓存最大容量(byte)
+	maxAge  time.Duration //缓存最长保留时间
+}
+
+// newArtifactStore 未配置缓存目录时不启用缓存，返回nil
+func newArtifactStore(db *gorm.DB, log *zap.Logger, conf *Config) *artifactStore {
+	if conf == nil || conf.ArtifactDir == "" {
+		return nil
+	}
+	return &artifactStore{
+		db:      db,
+		log:     log,
+		dir:     conf.ArtifactDir,
+		maxSize: conf.ArtifactMaxSize << 20,
+		maxAge:  conf.ArtifactMaxAge,
+	}
+}
+
+// artifactKey 缓存key，同一空间下仓库、提交和构建脚本都相同的产物可以复用
+func artifactKey(spaceId int64, repoUrl, commitId, buildHash string) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%d\n%s\n%s\n%s", spaceId, repoUrl, commitId, buildHash)))
+	return hex.EncodeToString(h[:])
+}
+
+// buildHash 影响打包结果的项目配置hash
+func buildHash(project *model.Project) string {
+	h := sha256.New()
+	for _, v := range []string{project.PrevDeploy, project.PostDeploy, project.Excludes, fmt.Sprintf("%d", project.IsInclude), project.TaskVars.String()} {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Get 获取缓存，超过保留时间或者程序包文件不存在时删除缓存
+func (s *artifactStore) Get(key string) (*model.Artifact, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	m := &model.Artifact{}
+	if err := s.db.Where("cache_key = ?", key).First(m).Error; err != nil {
+		return nil, false
+	}
+	if s.expired(m) {
+		if err := s.remove(m); err != nil {
+			s.log.Error("清理构建产物缓存出错", zap.String("path", m.Path), zap.Error(err))
+		}
+		return nil, false
+	}
+	if _, err := os.Stat(m.Path); err != nil {
+		s.log.Warn("构建产物缓存文件不存在", zap.String("path", m.Path), zap.Error(err))
+		s.db.Delete(m)
+		return nil, false
+	}
+	m.LastUsedAt = time.Now()
+	s.db.Model(m).UpdateColumn("last_used_at", m.LastUsedAt)
+	return m, true
+}
+
+// Put 保存程序包到缓存目录，并清理过期缓存
+func (s *artifactStore) Put(m *model.Artifact, pkg string) (err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if err = os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	m.Path = filepath.Join(s.dir, m.Key+".tar.gz")
+	tmp := m.Path + ".tmp"
+	if m.Size, err = files.CopyFileToFile(tmp, pkg); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, m.Path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	m.LastUsedAt = time.Now()
+	err = s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "cache_key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"task_id", "project_id", "path", "size", "last_used_at", "updated_at"}),
+	}).Create(m).Error
+	if err != nil {
+		return err
+	}
+	s.evict()
+	return nil
+}
+
+// Remove 删除缓存
+func (s *artifactStore) Remove(m *model.Artifact) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.remove(m)
+}
+
+func (s *artifactStore) remove(m *model.Artifact) error {
+	if err := os.Remove(m.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.db.Delete(m).Error
+}
+
+// evictor 定时清理超过保留时间的缓存，没有新的发布时过期缓存也会被清理
+func (s *artifactStore) evictor(stop <-chan struct{}) {
+	tk := time.NewTicker(artifactEvictInterval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-tk.C:
+			s.Evict()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Evict 清理过期和超出容量的缓存
+func (s *artifactStore) Evict() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.evict()
+}
+
+func (s *artifactStore) expired(m *model.Artifact) bool {
+	return s.maxAge > 0 && time.Since(m.LastUsedAt) > s.maxAge
+}
+
+// evict 清理超过保留时间的缓存，超出最大容量时按最后使用时间清理，调用方需持有锁
+func (s *artifactStore) evict() {
+	list := make([]*model.Artifact, 0)
+	if err := s.db.Order("last_used_at desc, id desc").Find(&list).Error; err != nil {
+		s.log.Error("获取构建产物缓存出错", zap.Error(err))
+		return
+	}
+	var total int64
+	for _, m := range list {
+		total += m.Size
+		if !s.expired(m) && (s.maxSize <= 0 || total <= s.maxSize) {
+			continue
+		}
+		total -= m.Size
+		if err := s.remove(m); err != nil {
+			s.log.Error("清理构建产物缓存出错", zap.String("path", m.Path), zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package deploy
+
+import (
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"yema.dev/app/model"
+)
+
+func newTestArtifactStore(t *testing.T, maxSize int64, maxAge time.Duration) *artifactStore {
+	return &artifactStore{db: newTestDB(t), log: zap.NewNop(), dir: t.TempDir(), maxSize: maxSize, maxAge: maxAge}
+}
+
+// putArtifact 保存size字节的程序包到缓存
+func putArtifact(t *testing.T, s *artifactStore, key string, size int) *model.Artifact {
+	pkg := filepath.Join(t.TempDir(), key+".tar.gz")
+	if err := os.WriteFile(pkg, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := &model.Artifact{SpaceId: 1, Key: key}
+	if err := s.Put(m, pkg); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestBuildHash(t *testing.T) {
+	base := model.Project{PrevDeploy: "npm ci", PostDeploy: "npm run build", Excludes: "node_modules"}
+	tests := []struct {
+		name   string
+		change func(p *model.Project)
+	}{
+		{"prev deploy", func(p *model.Project) { p.PrevDeploy = "npm install" }},
+		{"post deploy", func(p *model.Project) { p.PostDeploy = "npm run build:prod" }},
+		{"excludes", func(p *model.Project) { p.Excludes = "" }},
+		{"include", func(p *model.Project) { p.IsInclude = 1 }},
+		{"task vars", func(p *model.Project) { p.TaskVars = "ENV=prod" }},
+	}
+	for _, tt := range tests {
+		p := base
+		tt.change(&p)
+		if buildHash(&p) == buildHash(&base) {
+			t.Errorf("%s: build hash not changed", tt.name)
+		}
+	}
+	p := base
+	p.PrevRelease, p.TargetRoot = "echo", "/data/www"
+	if buildHash(&p) != buildHash(&base) {
+		t.Error("release config should not change build hash")
+	}
+}
+
+func TestArtifactGet(t *testing.T) {
+	s := newTestArtifactStore(t, 0, time.Hour)
+	m := putArtifact(t, s, "hit", 10)
+	if cached, ok := s.Get("hit"); !ok || cached.Path != m.Path || cached.Size != 10 {
+		t.Fatalf("cache miss: %+v", cached)
+	}
+	if _, ok := s.Get("miss"); ok {
+		t.Fatal("unexpected cache hit")
+	}
+
+	//程序包文件被删除
+	_ = os.Remove(m.Path)
+	if _, ok := s.Get("hit"); ok {
+		t.Fatal("hit without package file")
+	}
+	var count int64
+	s.db.Model(&model.Artifact{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("record not removed, count %d", count)
+	}
+
+	//超过保留时间
+	m = putArtifact(t, s, "expired", 10)
+	s.db.Model(m).UpdateColumn("last_used_at", time.Now().Add(-2*time.Hour))
+	if _, ok := s.Get("expired"); ok {
+		t.Fatal("hit expired artifact")
+	}
+	if _, err := os.Stat(m.Path); !os.IsNotExist(err) {
+		t.Fatal("expired package not removed")
+	}
+}
+
+func TestArtifactEvict(t *testing.T) {
+	s := newTestArtifactStore(t, 25, time.Hour)
+	old := putArtifact(t, s, "old", 10)
+	mid := putArtifact(t, s, "mid", 10)
+	s.db.Model(old).UpdateColumn("last_used_at", time.Now().Add(-time.Minute))
+	s.db.Model(mid).UpdateColumn("last_used_at", time.Now().Add(-time.Second))
+	//超出容量时清理最久未使用的
+	putArtifact(t, s, "new", 10)
+	if _, ok := s.Get("old"); ok {
+		t.Fatal("least recently used artifact not evicted")
+	}
+	for _, key := range []string{"mid", "new"} {
+		if _, ok := s.Get(key); !ok {
+			t.Fatalf("%s evicted", key)
+		}
+	}
+
+	//没有新的缓存保存时也清理超过保留时间的
+	s.db.Model(&model.Artifact{}).Where("cache_key = ?", "mid").UpdateColumn("last_used_at", time.Now().Add(-2*time.Hour))
+	s.Evict()
+	var keys []string
+	s.db.Model(&model.Artifact{}).Pluck("cache_key", &keys)
+	if len(keys) != 1 || keys[0] != "new" {
+		t.Fatalf("artifacts after evict: %v", keys)
+	}
+}
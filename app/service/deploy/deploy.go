@@ -10,11 +10,18 @@ import (
 	"yema.dev/app/model"
 	"yema.dev/app/pkg/repo"
 	"yema.dev/app/pkg/ssh"
+	"yema.dev/app/service/notice"
 )
 
 var Error = errs.Class("Deploy")
 var ErrorTaskFinish = Error.New("部署任务已完成或未创建,未在发布队列中")
 
+// ErrTaskLocked 同一项目环境或服务器已有正在发布的任务
+var ErrTaskLocked = errs.Class("TaskLocked")
+
+const defaultDispatchInterval = time.Second * 30
+const defaultScheduleInterval = time.Second * 30
+
 type taskRunning struct {
 	task   *Task
 	cancel func()
@@ -24,31 +31,59 @@ type deploy struct {
 	mux   sync.Mutex
 	tasks map[int64]*taskRunning
 
-	db   *gorm.DB
-	log  *zap.Logger
-	ssh  *ssh.Ssh
-	repo *repo.Repos
+	db     *gorm.DB
+	log    *zap.Logger
+	ssh    *ssh.Ssh
+	repo   *repo.Repos
+	notice *notice.Service
+
+	dispatch  chan struct{} //有发布任务完成时通知调度发布队列
+	stop      chan struct{} //关闭时停止调度
+	stopOnce  sync.Once
+	artifacts *artifactStore //构建产物缓存
 
 	MaxDeployNum      int           //最大同时部署任务数量
 	MaxReleaseTimeout time.Duration //最大部署超时时间
+	DispatchInterval  time.Duration //发布队列检查间隔
+	ScheduleInterval  time.Duration //定时发布检查间隔
+	LockServer        bool          //同一服务器同时只允许一个发布任务
 }
 
-func newDeploy(db *gorm.DB, log *zap.Logger, ssh *ssh.Ssh, repo *repo.Repos, conf *Config) *deploy {
+func newDeploy(db *gorm.DB, log *zap.Logger, ssh *ssh.Ssh, repo *repo.Repos, notice *notice.Service, conf *Config) *deploy {
 	d := &deploy{
-		tasks: make(map[int64]*taskRunning),
-		db:    db,
-		log:   log,
-		ssh:   ssh,
-		repo:  repo,
+		tasks:    make(map[int64]*taskRunning),
+		db:       db,
+		log:      log,
+		ssh:      ssh,
+		repo:     repo,
+		notice:   notice,
+		dispatch: make(chan struct{}, 1),
+		stop:     make(chan struct{}),
 	}
 	if conf != nil {
 		d.MaxDeployNum = conf.MaxDeploy
 		d.MaxReleaseTimeout = conf.MaxReleaseTimeout
+		d.DispatchInterval = conf.DispatchInterval
+		d.ScheduleInterval = conf.ScheduleInterval
+		d.LockServer = conf.LockServer
+	}
+	d.artifacts = newArtifactStore(db, log, conf)
+	if d.DispatchInterval <= 0 {
+		d.DispatchInterval = defaultDispatchInterval
+	}
+	if d.ScheduleInterval <= 0 {
+		d.ScheduleInterval = defaultScheduleInterval
+	}
+	d.recoverInterrupted()
+	go d.dispatcher()
+	go d.scheduler()
+	if d.artifacts != nil {
+		go d.artifacts.evictor(d.stop)
 	}
 	return d
 }
 
-// Start 开始部署
+// Start 开始部署，超出最大同时部署数量时进入发布队列等待调度
 func (d *deploy) Start(taskModel *model.Task) error {
 	d.mux.Lock()
 	defer d.mux.Unlock()
@@ -56,43 +91,259 @@ func (d *deploy) Start(taskModel *model.Task) error {
 		return Error.New("该任务[%d]已在部署中", taskModel.ID)
 	}
 	if len(d.tasks) >= d.MaxDeployNum {
-		return Error.New("已经超出部署队列最大数量(%d)，请稍后再试", d.MaxDeployNum)
+		return d.enqueue(taskModel)
+	}
+	return d.run(taskModel, stageRelease)
+}
+
+// Promote 灰度确认，发布剩余服务器
+func (d *deploy) Promote(taskModel *model.Task) error {
+	return d.startStage(taskModel, stagePromote)
+}
+
+// AbortCanary 取消灰度，灰度服务器回滚到上一个版本
+func (d *deploy) AbortCanary(taskModel *model.Task) error {
+	return d.startStage(taskModel, stageAbort)
+}
+
+// startStage 灰度确认或取消，不进入发布队列
+func (d *deploy) startStage(taskModel *model.Task, stage int) error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if _, ok := d.tasks[taskModel.ID]; ok {
+		return Error.New("该任务[%d]已在部署中", taskModel.ID)
+	}
+	if len(d.tasks) >= d.MaxDeployNum {
+		return Error.New("超出最大同时部署数量[%d]，请稍后再试", d.MaxDeployNum)
+	}
+	return d.run(taskModel, stage)
+}
+
+// run 启动发布任务，调用方需持有锁
+func (d *deploy) run(taskModel *model.Task, stage int) error {
+	holder, err := d.lockHolder(taskModel)
+	if err != nil {
+		return Error.Wrap(err)
+	}
+	if holder != nil && holder.Status == model.TaskStatusCanary {
+		return ErrTaskLocked.New("上线单[%d]%s灰度发布完成等待确认，同一项目环境或服务器同时只能有一个发布任务，请先确认或取消灰度", holder.ID, holder.Name)
+	}
+	if holder != nil {
+		return ErrTaskLocked.New("上线单[%d]%s正在发布，同一项目环境或服务器同时只能有一个发布任务，请等待发布完成", holder.ID, holder.Name)
 	}
 	task, err := NewTask(taskModel, d.db, d.log, d.ssh, d.repo)
 	if err != nil {
 		return err
 	}
+	task.stage = stage
+	task.artifacts = d.artifacts
 	ctx, cancel := context.WithTimeout(context.Background(), d.MaxReleaseTimeout)
+	//开始部署
+	if err = task.Start(ctx); err != nil {
+		cancel()
+		return err
+	}
 	d.tasks[taskModel.ID] = &taskRunning{
-		task: task,
-		cancel: func() {
-			cancel()
-		},
+		task:   task,
+		cancel: cancel,
 	}
-	//开始部署
-	err = d.tasks[taskModel.ID].task.Start(ctx)
-	if err == nil {
-		//等待完成处理
-		go func() {
-			err := d.tasks[taskModel.ID].task.Wait()
-			if err != nil {
-				d.log.Error("部署任务完成，有错误",
-					zap.Int64("taskId", taskModel.ID), zap.Error(err))
-			} else {
-				d.log.Info("部署任务完成，成功",
-					zap.Int64("taskId", taskModel.ID))
+	d.sendNotice(notice.EventReleaseStart, taskModel, &taskModel.Project)
+	//等待完成处理
+	go func() {
+		err := task.Wait()
+		if err != nil {
+			d.log.Error("部署任务完成，有错误",
+				zap.Int64("taskId", taskModel.ID), zap.Error(err))
+		} else {
+			d.log.Info("部署任务完成，成功",
+				zap.Int64("taskId", taskModel.ID))
+		}
+		cancel()
+		d.mux.Lock()
+		delete(d.tasks, taskModel.ID)
+		d.mux.Unlock()
+		d.notify()
+		d.sendNotice(releaseEvent(taskModel.Status), taskModel, &taskModel.Project)
+	}()
+	return nil
+}
+
+// lockHolder 同一项目环境，或者开启服务器锁时使用了相同服务器的正在发布或灰度待确认的任务，调用方需持有锁；
+// 正在发布的任务结束后从tasks中移除，发布失败、中止或超时都会释放，灰度待确认的任务确认或取消后释放
+func (d *deploy) lockHolder(taskModel *model.Task) (*model.Task, error) {
+	conflict := func(m *model.Task) bool {
+		if m.ID == taskModel.ID {
+			return false
+		}
+		return m.ProjectId == taskModel.ProjectId && m.EnvironmentId == taskModel.EnvironmentId ||
+			d.LockServer && shareServer(m.Servers, taskModel.Servers)
+	}
+	for _, running := range d.tasks {
+		if conflict(running.task.model) {
+			return running.task.model, nil
+		}
+	}
+	canary := make([]*model.Task, 0)
+	_db := d.db.Where("status = ? and id <> ?", model.TaskStatusCanary, taskModel.ID)
+	if !d.LockServer {
+		_db = _db.Where("project_id = ? and environment_id = ?", taskModel.ProjectId, taskModel.EnvironmentId)
+	}
+	if err := _db.Preload("Servers").Find(&canary).Error; err != nil {
+		return nil, err
+	}
+	for _, m := range canary {
+		if conflict(m) {
+			return m, nil
+		}
+	}
+	return nil, nil
+}
+
+func shareServer(a, b []model.Server) bool {
+	for i := range a {
+		for j := range b {
+			if a[i].ID == b[j].ID {
+				return true
 			}
-		}()
+		}
 	}
-	return err
+	return false
 }
 
-// Stop 中止部署
+// enqueue 加入发布队列
+func (d *deploy) enqueue(taskModel *model.Task) error {
+	task, err := NewTask(taskModel, d.db, d.log, d.ssh, d.repo)
+	if err != nil {
+		return err
+	}
+	if err = task.check(); err != nil {
+		return Error.Wrap(err)
+	}
+	//强制发布只对本次启动有效，不能排队
+	if taskModel.OverrideReason != "" {
+		return Error.New("超出最大同时部署数量[%d]，强制发布不能进入发布队列，请稍后再试", d.MaxDeployNum)
+	}
+	if taskModel.Status == model.TaskStatusQueue {
+		return nil
+	}
+	//进入发布队列后清除定时，中止排队时不会再被定时启动
+	res := d.db.Model(model.Task{}).Where("id = ? and status = ?", taskModel.ID, model.TaskStatusAudit).
+		Updates(map[string]any{"status": model.TaskStatusQueue, "scheduled_at": nil})
+	if res.Error != nil {
+		return Error.Wrap(res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return Error.New("该任务[%d]状态已变更，无法加入发布队列", taskModel.ID)
+	}
+	taskModel.Status = model.TaskStatusQueue
+	d.log.Info("超出部署队列最大数量，进入发布队列",
+		zap.Int64("taskId", taskModel.ID), zap.Int("maxDeploy", d.MaxDeployNum))
+	return nil
+}
+
+// notify 通知调度发布队列
+func (d *deploy) notify() {
+	select {
+	case d.dispatch <- struct{}{}:
+	default:
+	}
+}
+
+// dispatcher 发布队列调度，有发布任务完成或定时检查时启动排队中的任务
+func (d *deploy) dispatcher() {
+	tk := time.NewTicker(d.DispatchInterval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-tk.C:
+		case <-d.dispatch:
+		case <-d.stop:
+			return
+		}
+		d.dispatchQueue()
+	}
+}
+
+// Close 停止发布队列、定时发布和缓存清理的调度，正在发布的任务不受影响
+func (d *deploy) Close() {
+	d.stopOnce.Do(func() {
+		close(d.stop)
+	})
+}
+
+// dispatchQueue 按进入队列的先后顺序启动排队中的发布任务
+func (d *deploy) dispatchQueue() {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if len(d.tasks) >= d.MaxDeployNum {
+		return
+	}
+	//不限制读取数量，不在发布窗口内或者等待锁的任务跳过，不阻塞后面可以发布的任务
+	queued := make([]*model.Task, 0)
+	err := d.db.Where("status = ?", model.TaskStatusQueue).
+		Preload("Project").
+		Preload("Environment").
+		Preload("Servers").
+		Order("updated_at asc, id asc").
+		Find(&queued).Error
+	if err != nil {
+		d.log.Error("读取发布队列出错", zap.Error(err))
+		return
+	}
+	for _, taskModel := range queued {
+		if len(d.tasks) >= d.MaxDeployNum {
+			return
+		}
+		if _, ok := d.tasks[taskModel.ID]; ok {
+			continue
+		}
+		//之前启动时的强制发布不沿用
+		taskModel.OverrideUserId, taskModel.OverrideReason = 0, ""
+		err = d.run(taskModel, stageRelease)
+		if ErrDeployWindow.Has(err) || ErrTaskLocked.Has(err) {
+			//不在发布窗口内或者同项目有任务正在发布的继续排队
+			continue
+		}
+		if err != nil {
+			d.log.Error("启动队列中的发布任务出错", zap.Int64("taskId", taskModel.ID), zap.Error(err))
+			//启动失败的任务移出队列，避免一直阻塞
+			_err := d.db.Model(model.Task{}).Where("id = ? and status = ?", taskModel.ID, model.TaskStatusQueue).
+				Updates(map[string]any{"status": model.TaskStatusReleaseFail, "last_error": err.Error()}).Error
+			if _err != nil {
+				d.log.Error("更新队列任务状态出错", zap.Int64("taskId", taskModel.ID), zap.Error(_err))
+			}
+		}
+	}
+}
+
+// recoverInterrupted 服务启动时，将上次运行中断的发布任务标记为失败
+func (d *deploy) recoverInterrupted() {
+	res := d.db.Model(model.Task{}).Where("status = ?", model.TaskStatusRelease).
+		Updates(map[string]any{"status": model.TaskStatusReleaseFail, "last_error": "服务重启，发布任务中断"})
+	if res.Error != nil {
+		d.log.Error("检查中断的发布任务出错", zap.Error(res.Error))
+		return
+	}
+	if res.RowsAffected > 0 {
+		d.log.Warn("发布任务因服务重启中断，已标记为发布失败", zap.Int64("total", res.RowsAffected))
+	}
+}
+
+// Stop 中止部署，排队中的任务移出发布队列
 func (d *deploy) Stop(taskId int64) error {
 	d.mux.Lock()
 	defer d.mux.Unlock()
 	if _, ok := d.tasks[taskId]; ok {
 		d.tasks[taskId].cancel()
+		return nil
+	}
+	res := d.db.Model(model.Task{}).Where("id = ? and status = ?", taskId, model.TaskStatusQueue).
+		Update("status", model.TaskStatusAudit)
+	if res.Error != nil {
+		return Error.Wrap(res.Error)
+	}
+	if res.RowsAffected > 0 {
+		return nil
 	}
 	return ErrorTaskFinish
 }
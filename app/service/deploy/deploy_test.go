@@ -1,9 +1,13 @@
 package deploy
 
 import (
+	"context"
+	"go.uber.org/zap"
 	"gorm.io/gorm"
 	"testing"
+	"time"
 	"yema.dev/app/model"
+	"yema.dev/app/model/field"
 	"yema.dev/app/pkg/db"
 	"yema.dev/app/pkg/log"
 )
@@ -54,3 +58,238 @@ func TestDeployStart(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestLockHolder(t *testing.T) {
+	running := &model.Task{ID: 1, Name: "running", ProjectId: 1, EnvironmentId: 1, Servers: []model.Server{{ID: 1}, {ID: 2}}}
+	d := &deploy{db: newTestDB(t), tasks: map[int64]*taskRunning{running.ID: {task: &Task{model: running}}}}
+	//灰度待确认的任务保存在数据库
+	canary := &model.Task{ID: 5, Name: "canary", ProjectId: 3, EnvironmentId: 1, Status: model.TaskStatusCanary,
+		Servers: []model.Server{{ID: 5}}}
+	if err := d.db.Create(canary).Error; err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name       string
+		task       *model.Task
+		lockServer bool
+		holder     int64
+	}{
+		{"same task", &model.Task{ID: 1, ProjectId: 1, EnvironmentId: 1}, false, 0},
+		{"same project", &model.Task{ID: 2, ProjectId: 1, EnvironmentId: 1}, false, 1},
+		{"other project", &model.Task{ID: 3, ProjectId: 2, EnvironmentId: 1, Servers: []model.Server{{ID: 2}}}, false, 0},
+		{"shared server", &model.Task{ID: 3, ProjectId: 2, EnvironmentId: 1, Servers: []model.Server{{ID: 2}}}, true, 1},
+		{"other server", &model.Task{ID: 4, ProjectId: 2, EnvironmentId: 1, Servers: []model.Server{{ID: 3}}}, true, 0},
+		{"canary project", &model.Task{ID: 6, ProjectId: 3, EnvironmentId: 1}, false, 5},
+		{"canary promote", &model.Task{ID: 5, ProjectId: 3, EnvironmentId: 1}, false, 0},
+		{"canary server", &model.Task{ID: 7, ProjectId: 4, EnvironmentId: 1, Servers: []model.Server{{ID: 5}}}, true, 5},
+		{"canary other env", &model.Task{ID: 8, ProjectId: 3, EnvironmentId: 2}, false, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d.LockServer = c.lockServer
+			holder, err := d.lockHolder(c.task)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var id int64
+			if holder != nil {
+				id = holder.ID
+			}
+			if id != c.holder {
+				t.Fatalf("holder: %+v, want %d", holder, c.holder)
+			}
+		})
+	}
+}
+
+// newQueueDeploy 测试发布队列，项目没有配置仓库类型，启动后在检出代码时失败
+func newQueueDeploy(t *testing.T, maxDeploy int) *deploy {
+	return &deploy{
+		db:                newTestDB(t),
+		log:               zap.NewNop(),
+		tasks:             make(map[int64]*taskRunning),
+		dispatch:          make(chan struct{}, 1),
+		stop:              make(chan struct{}),
+		MaxDeployNum:      maxDeploy,
+		MaxReleaseTimeout: time.Minute,
+		DispatchInterval:  time.Hour,
+		ScheduleInterval:  time.Hour,
+	}
+}
+
+// createQueueTask 创建项目、环境和上线单
+func createQueueTask(t *testing.T, d *deploy, env *model.Environment, status int8) *model.Task {
+	env.Status = field.StatusEnable
+	if env.ID == 0 {
+		if err := d.db.Create(env).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	project := &model.Project{Name: "project", EnvironmentId: env.ID, Status: field.StatusEnable, RepoType: "none"}
+	if err := d.db.Create(project).Error; err != nil {
+		t.Fatal(err)
+	}
+	m := &model.Task{Name: "task", ProjectId: project.ID, EnvironmentId: env.ID, Status: status,
+		Servers: []model.Server{{Name: "server"}}}
+	if err := d.db.Create(m).Error; err != nil {
+		t.Fatal(err)
+	}
+	return loadTask(t, d, m.ID)
+}
+
+func loadTask(t *testing.T, d *deploy, id int64) *model.Task {
+	m := &model.Task{}
+	if err := d.db.Preload("Project").Preload("Environment").Preload("Servers").First(m, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// waitIdle 等待发布任务全部结束
+func waitIdle(t *testing.T, d *deploy) {
+	for i := 0; i < 500; i++ {
+		d.mux.Lock()
+		n := len(d.tasks)
+		d.mux.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("deploy tasks not finished")
+}
+
+func TestDispatchQueue(t *testing.T) {
+	d := newQueueDeploy(t, 1)
+	frozen := &model.Environment{Name: "frozen", DeployFreezes: model.DeployFreezes{{
+		Start: time.Now().Add(-time.Hour), End: time.Now().Add(time.Hour), Reason: "freeze",
+	}}}
+	blocked := createQueueTask(t, d, frozen, model.TaskStatusQueue)
+	runnable := createQueueTask(t, d, &model.Environment{Name: "dev"}, model.TaskStatusQueue)
+
+	d.dispatchQueue()
+	waitIdle(t, d)
+	if m := loadTask(t, d, blocked.ID); m.Status != model.TaskStatusQueue {
+		t.Fatalf("blocked task status %d", m.Status)
+	}
+	if m := loadTask(t, d, runnable.ID); m.Status != model.TaskStatusReleaseFail {
+		t.Fatalf("runnable task status %d, last error: %s", m.Status, m.LastError)
+	}
+}
+
+func TestOverride(t *testing.T) {
+	d := newQueueDeploy(t, 1)
+	frozen := &model.Environment{Name: "frozen", DeployFreezes: model.DeployFreezes{{
+		Start: time.Now().Add(-time.Hour), End: time.Now().Add(time.Hour), Reason: "freeze",
+	}}}
+	m := createQueueTask(t, d, frozen, model.TaskStatusAudit)
+	if err := d.Start(m); !ErrDeployWindow.Has(err) {
+		t.Fatalf("start without override: %v", err)
+	}
+	m.OverrideUserId, m.OverrideReason = 1, "hotfix"
+	if err := d.Start(m); err != nil {
+		t.Fatal(err)
+	}
+	waitIdle(t, d)
+	overrides := func() []model.Override {
+		var res []model.Override
+		if err := d.db.Where("task_id = ?", m.ID).Order("id").Find(&res).Error; err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	if o := overrides(); len(o) != 1 || o[0].Reason != "hotfix" || o[0].UserId != 1 || o[0].CreatedAt.IsZero() {
+		t.Fatalf("override not recorded: %+v", o)
+	}
+
+	//排队的任务不沿用之前的强制发布
+	if err := d.db.Model(&model.Task{ID: m.ID}).Update("status", model.TaskStatusQueue).Error; err != nil {
+		t.Fatal(err)
+	}
+	d.dispatchQueue()
+	waitIdle(t, d)
+	if m = loadTask(t, d, m.ID); m.Status != model.TaskStatusQueue {
+		t.Fatalf("queued task status %d", m.Status)
+	}
+
+	//超出最大部署数量时强制发布不进入队列
+	d.MaxDeployNum = 0
+	m.Status = model.TaskStatusAudit
+	m.OverrideUserId, m.OverrideReason = 1, "hotfix"
+	if err := d.Start(m); err == nil {
+		t.Fatal("override task should not be queued")
+	}
+	//没有启动的强制发布不记录
+	if o := overrides(); len(o) != 1 {
+		t.Fatalf("overrides: %+v", o)
+	}
+}
+
+func TestQueueTransition(t *testing.T) {
+	d := newQueueDeploy(t, 0)
+	m := createQueueTask(t, d, &model.Environment{Name: "dev"}, model.TaskStatusAudit)
+	//超出最大部署数量进入队列
+	if err := d.Start(m); err != nil {
+		t.Fatal(err)
+	}
+	if m = loadTask(t, d, m.ID); m.Status != model.TaskStatusQueue {
+		t.Fatalf("status %d, want queue", m.Status)
+	}
+	//中止排队回到审核通过
+	if err := d.Stop(m.ID); err != nil {
+		t.Fatal(err)
+	}
+	if m = loadTask(t, d, m.ID); m.Status != model.TaskStatusAudit {
+		t.Fatalf("status %d, want audit", m.Status)
+	}
+	if err := d.Stop(m.ID); err != ErrorTaskFinish {
+		t.Fatalf("stop again: %v", err)
+	}
+	//重新排队，有空闲时由调度启动
+	if err := d.Start(m); err != nil {
+		t.Fatal(err)
+	}
+	d.MaxDeployNum = 1
+	d.dispatchQueue()
+	waitIdle(t, d)
+	if m = loadTask(t, d, m.ID); m.Status != model.TaskStatusReleaseFail {
+		t.Fatalf("status %d, want release fail", m.Status)
+	}
+}
+
+func TestStartOnce(t *testing.T) {
+	d := newQueueDeploy(t, 1)
+	m := createQueueTask(t, d, &model.Environment{Name: "dev"}, model.TaskStatusAudit)
+	first, _ := NewTask(loadTask(t, d, m.ID), d.db, d.log, nil, nil)
+	second, _ := NewTask(loadTask(t, d, m.ID), d.db, d.log, nil, nil)
+	if err := first.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	//状态已被另一个启动修改
+	if err := second.Start(context.Background()); err == nil {
+		t.Fatal("task started twice")
+	}
+	_ = first.Wait()
+}
+
+func TestDeployClose(t *testing.T) {
+	d := newQueueDeploy(t, 1)
+	done := make(chan struct{}, 2)
+	go func() {
+		d.dispatcher()
+		done <- struct{}{}
+	}()
+	go func() {
+		d.scheduler()
+		done <- struct{}{}
+	}()
+	d.Close()
+	d.Close()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("scheduler not stopped")
+		}
+	}
+}
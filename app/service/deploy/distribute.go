@@ -0,0 +1,281 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"github.com/wuzfei/go-helper/slices"
+	"go.uber.org/zap"
+	"path/filepath"
+	"strings"
+	"sync"
+	"yema.dev/app/model"
+	"yema.dev/app/pkg/ssh"
+	"yema.dev/app/service/common"
+)
+
+// distribution 程序包分发来源，来源服务器上传完成后其他服务器从它拉取
+type distribution struct {
+	source *model.Server
+	hosts  []string //允许拉取的服务器地址，临时公钥只能从这些地址登录
+	ready  chan struct{}
+	once   sync.Once
+	err    error
+
+	authOnce sync.Once //来源服务器只授权一次临时公钥
+	authErr  error
+}
+
+func newDistribution(source *model.Server, servers []model.Server) *distribution {
+	hosts := slices.Map(servers, func(item model.Server, k int) string {
+		return item.Host
+	})
+	return &distribution{source: source, hosts: slices.Unique(hosts), ready: make(chan struct{})}
+}
+
+// done 来源服务器上传结束，失败时拉取方改为直接推送；
+// 中转服务器同时是发布目标时会再次调用，只保留第一次的结果
+func (d *distribution) done(err error) {
+	d.once.Do(func() {
+		d.err = err
+		close(d.ready)
+	})
+}
+
+func (d *distribution) wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ErrStopDeploy
+	case <-d.ready:
+		return d.err
+	}
+}
+
+// prepareDistribute 开启服务器间分发时计算程序包校验值，中转分发先推送到中转服务器，失败时改为直接推送
+func (t *Task) prepareDistribute(ctx context.Context) (relay *distribution) {
+	t.distributions = make(map[int64]*distribution)
+	project := t.model.Project
+	//增量发布只传输有变化的文件，docker发布由服务器拉取镜像，都不需要服务器间分发
+	if t.isRollback() || !project.IsDistribute() || project.IsIncremental() || project.IsDocker() {
+		return nil
+	}
+	var err error
+	if t.distributeKey, t.distributeAuthKey, err = ssh.GenerateKey(); err != nil {
+		_ = t.newRecordLocal("ssh-keygen", nil).Save(1, "生成分发临时密钥失败，改为直接推送:"+err.Error())
+		return nil
+	}
+	if t.packageSha256, err = ssh.FileSha256(t.deployDirs.localCodePackage); err != nil {
+		_ = t.newRecordLocal("sha256sum "+t.deployDirs.localCodePackage, nil).Save(1, "计算程序包校验值失败，改为直接推送:"+err.Error())
+		return nil
+	}
+	if project.DistributeMode != model.ProjectDistributeRelay {
+		return nil
+	}
+	server := &model.Server{}
+	if err = t.db.Where("space_id = ? and id = ?", project.SpaceId, project.DistributeRelayId).First(server).Error; err != nil {
+		_ = t.newRecordLocal(fmt.Sprintf("relay server %d", project.DistributeRelayId), nil).Save(1, "中转服务器不存在，改为直接推送")
+		return nil
+	}
+	if server.JumpServerId > 0 {
+		_ = t.newRecordLocal("relay server "+server.Hostname(), nil).Save(1, "中转服务器通过跳板机连接，其他服务器无法拉取，改为直接推送")
+		return nil
+	}
+	record := t.newRecordLocal(fmt.Sprintf("upload %s to relay %s:%s", t.deployDirs.localCodePackage, server.Hostname(), t.deployDirs.remoteReleasePackage), nil)
+	record.SetSaveTime()
+	if err = t.uploadRelay(ctx, server); err != nil {
+		_ = record.Save(1, "推送到中转服务器失败，改为直接推送:"+err.Error())
+		return nil
+	}
+	_ = record.Save(0, "success, sha256: "+t.packageSha256)
+	relay = newDistribution(server, directServers(t.servers()))
+	relay.done(nil)
+	return relay
+}
+
+// uploadRelay 中转服务器不一定是发布目标，先创建存放目录
+func (t *Task) uploadRelay(ctx context.Context, server *model.Server) error {
+	sshConf, err := common.SshConfig(t.db, server)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(t.deployDirs.remoteReleasePackage)
+	if output, err := t.ssh.RunCmd(sshConf, "mkdir -p "+ssh.ShellQuote(dir)); err != nil {
+		return Error.New("创建目录失败：%s %s", err, output)
+	}
+	_, err = t.upload(ctx, server, t.deployDirs.localCodePackage, t.deployDirs.remoteReleasePackage, t.taskLogs[localServerId])
+	return err
+}
+
+// distribute 设置本批服务器的程序包来源，种子分发时本批第一台服务器上传完成后其余服务器从它拉取。
+// 拉取时服务器直接连接来源服务器，不经过跳板机，通过跳板机连接的服务器不参与分发，仍然直接推送
+func (t *Task) distribute(batch []model.Server, relay *distribution) {
+	project := t.model.Project
+	direct := directServers(batch)
+	switch {
+	case t.isRollback() || t.packageSha256 == "":
+	case project.DistributeMode == model.ProjectDistributeRelay && relay != nil:
+		for _, s := range direct {
+			t.distributions[s.ID] = relay
+		}
+	case project.DistributeMode == model.ProjectDistributeSeed && len(direct) > 1:
+		seed := newDistribution(&direct[0], direct)
+		for _, s := range direct {
+			t.distributions[s.ID] = seed
+		}
+	}
+}
+
+// directServers 不通过跳板机连接的服务器
+func directServers(servers []model.Server) []model.Server {
+	return slices.FilterFunc(servers, func(v model.Server) bool {
+		return v.JumpServerId == 0
+	})
+}
+
+// pull 服务器从分发来源拉取程序包，来源服务器授权本次发布的临时公钥，私钥通过sftp写入服务器，拉取完成后删除，
+// 不转发平台密钥，目标服务器无法登录其他服务器
+func (t *Task) pull(ctx context.Context, server *model.Server, dist *distribution) error {
+	if err := dist.wait(ctx); err != nil {
+		return err
+	}
+	sourceConf, err := common.SshConfig(t.db, dist.source)
+	if err != nil {
+		return err
+	}
+	dist.authOnce.Do(func() {
+		dist.authErr = t.authorizeSource(dist, sourceConf)
+	})
+	if dist.authErr != nil {
+		return dist.authErr
+	}
+	sshConf, err := common.SshConfig(t.db, server)
+	if err != nil {
+		return err
+	}
+	keyFile := t.deployDirs.remoteReleasePackage + ".key"
+	if err = t.writeKey(sshConf, keyFile); err != nil {
+		return err
+	}
+	cmd, err := pullCommand(sourceConf, t.deployDirs.remoteReleasePackage, keyFile, t.model.Project.DistributeLimit, t.packageSha256)
+	if err != nil {
+		return err
+	}
+	t.log.Debug("4.1、从分发服务器拉取程序包", zap.String("server", server.Hostname()), zap.String("source", dist.source.Hostname()))
+	if err = t.newRecordRemote(cmd, server, nil).Run(ctx); err != nil {
+		//命令没有执行到清理时删除私钥
+		_, _ = t.ssh.RunCmd(sshConf, "rm -f "+ssh.ShellQuote(keyFile))
+	}
+	return err
+}
+
+// writeKey 临时私钥写入服务器，只有登录用户可读
+func (t *Task) writeKey(sshConf ssh.ServerConfig, keyFile string) error {
+	if output, err := t.ssh.RunCmd(sshConf, "mkdir -p "+ssh.ShellQuote(filepath.Dir(keyFile))); err != nil {
+		return Error.New("创建目录失败：%s %s", err, output)
+	}
+	client, err := t.ssh.NewSftp(sshConf)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.WriteFile(keyFile, t.distributeKey, 0600)
+}
+
+// distributeKeyComment 临时公钥的注释，撤销时按注释删除
+func (t *Task) distributeKeyComment() string {
+	return fmt.Sprintf("yema-distribute-task-%d", t.model.ID)
+}
+
+// authorizeSource 来源服务器授权临时公钥，restrict禁止转发和分配终端，from只允许本次拉取的服务器登录，
+// 强制命令只允许读取程序包，服务器之间经过NAT时来源地址不符，拉取失败后改为直接推送
+func (t *Task) authorizeSource(dist *distribution, sourceConf ssh.ServerConfig) error {
+	source := dist.source
+	line := distributeKeyLine(t.distributeAuthKey, t.distributeKeyComment(), t.deployDirs.remoteReleasePackage, dist.hosts)
+	cmd := fmt.Sprintf(`umask 077 && mkdir -p "$HOME/.ssh" && echo %s >> "$HOME/.ssh/authorized_keys"`, ssh.ShellQuote(line))
+	t.distributeSources.Store(source.ID, source)
+	if output, err := t.ssh.RunCmd(sourceConf, cmd); err != nil {
+		return Error.New("分发服务器[%s]授权临时密钥失败：%s %s", source.Hostname(), err, output)
+	}
+	return nil
+}
+
+// distributeKeyLine 临时公钥在authorized_keys中的配置
+func distributeKeyLine(authKey, comment, file string, hosts []string) string {
+	command := strings.ReplaceAll(pullOnlyCommand(file), `"`, `\"`)
+	return fmt.Sprintf(`restrict,from="%s",command="%s" %s %s`, strings.Join(hosts, ","), command, authKey, comment)
+}
+
+// pullOnlyCommand 临时公钥的强制命令，只允许scp -f或rsync --server --sender读取程序包，
+// rsync只允许不带参数的短选项和--partial、--bwlimit，其他命令都拒绝
+func pullOnlyCommand(file string) string {
+	q := ssh.ShellQuote
+	return strings.Join([]string{
+		"set -f",
+		"set -- $SSH_ORIGINAL_COMMAND",
+		fmt.Sprintf(`if [ "$*" = %s ]; then exec scp -f %s; fi`, q("scp -f "+file), q(file)),
+		`[ "$1 $2 $3" = 'rsync --server --sender' ] || exit 1`,
+		"shift 3",
+		`while [ $# -gt 2 ]; do case $1 in --partial|--bwlimit=[0-9]*) ;; --*|-*[!a-zA-Z.]*|-*M*) exit 1 ;; -?*) ;; *) exit 1 ;; esac; shift; done`,
+		fmt.Sprintf(`[ "$#" -eq 2 ] && [ "$1 $2" = %s ] || exit 1`, q(". "+file)),
+		"exec $SSH_ORIGINAL_COMMAND",
+	}, "; ")
+}
+
+// revokeDistributeKey 发布结束后从来源服务器删除临时公钥
+func (t *Task) revokeDistributeKey() {
+	t.distributeSources.Range(func(key, value any) bool {
+		source := value.(*model.Server)
+		sshConf, err := common.SshConfig(t.db, source)
+		if err == nil {
+			_, err = t.ssh.RunCmd(sshConf, revokeKeyCommand(t.distributeKeyComment()))
+		}
+		if err != nil {
+			t.log.Error("撤销分发临时密钥出错", zap.String("server", source.Hostname()), zap.Error(err))
+		}
+		return true
+	})
+}
+
+// revokeKeyCommand 删除authorized_keys中以注释结尾的公钥，保留文件权限，注释只包含字母数字和-
+func revokeKeyCommand(comment string) string {
+	return strings.Join([]string{
+		`f="$HOME/.ssh/authorized_keys"`,
+		`[ -f "$f" ] || exit 0`,
+		fmt.Sprintf(`grep -v -- %s "$f" > "$f.yema" || true`, ssh.ShellQuote(" "+comment+"$")),
+		`cat "$f.yema" > "$f"`,
+		`rm -f "$f.yema"`,
+	}, "; ")
+}
+
+// pullCommand 在服务器上从来源服务器拉取程序包的命令，优先使用rsync断点续传，不可用时使用scp，完成后校验sha256，
+// 来源服务器的强制命令不允许sftp，新版scp加-O使用原有协议；
+// keyFile 临时私钥，命令结束时删除；limit 限速KB/s，为0时不限速
+func pullCommand(source ssh.ServerConfig, file, keyFile string, limit int, sum string) (string, error) {
+	if source.HostKey == "" {
+		return "", Error.New("分发服务器[%s]未记录主机公钥", source.Host)
+	}
+	knownHost := source.Host
+	if source.Port != 22 {
+		knownHost = fmt.Sprintf("[%s]:%d", source.Host, source.Port)
+	}
+	src := ssh.ShellQuote(fmt.Sprintf("%s@%s:%s", source.User, source.Host, file))
+	dst := ssh.ShellQuote(file)
+	rsyncLimit, scpLimit := "", ""
+	if limit > 0 {
+		rsyncLimit = fmt.Sprintf(" --bwlimit=%d", limit)
+		scpLimit = fmt.Sprintf(" -l %d", limit*8) //scp限速单位为Kbit/s
+	}
+	check := ssh.ShellQuote(sum + "  " + file)
+	return strings.Join([]string{
+		"set -e",
+		"key=" + ssh.ShellQuote(keyFile),
+		"kh=$(mktemp)",
+		`trap 'rm -f "$kh" "$key"' EXIT`,
+		fmt.Sprintf(`echo %s > "$kh"`, ssh.ShellQuote(knownHost+" "+source.HostKey)),
+		`opts="-o BatchMode=yes -o StrictHostKeyChecking=yes -o UserKnownHostsFile=$kh -o IdentitiesOnly=yes -i $key"`,
+		"mkdir -p " + ssh.ShellQuote(filepath.Dir(file)),
+		`legacy=-O; if scp -O 2>&1 | grep -q 'option -- O'; then legacy=; fi`,
+		fmt.Sprintf(`if command -v rsync >/dev/null 2>&1 && rsync --partial --progress%s -e "ssh -p %d $opts" %s %s; then :; else scp $legacy -P %d $opts%s %s %s; fi`,
+			rsyncLimit, source.Port, src, dst, source.Port, scpLimit, src, dst),
+		fmt.Sprintf("if command -v sha256sum >/dev/null 2>&1; then echo %s | sha256sum -c -; else echo %s | shasum -a 256 -c -; fi", check, check),
+	}, "; "), nil
+}
@@ -0,0 +1,192 @@
+package deploy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"yema.dev/app/model"
+)
+
+// TestRelayInBatch 中转服务器同时是发布目标时，上传结束会对中转来源再次调用done
+func TestRelayInBatch(t *testing.T) {
+	batch := []model.Server{{ID: 1}, {ID: 2}, {ID: 3}}
+	task := &Task{
+		model: &model.Task{Project: model.Project{DistributeMode: model.ProjectDistributeRelay}},
+
+		distributions: make(map[int64]*distribution),
+		packageSha256: "sum",
+	}
+	relay := newDistribution(&batch[1], batch)
+	relay.done(nil)
+	task.distribute(batch, relay)
+	for _, s := range batch {
+		if task.distributions[s.ID] != relay {
+			t.Fatalf("server %d: distribution not relay", s.ID)
+		}
+	}
+	//中转服务器作为发布目标直接推送失败
+	task.distributions[batch[1].ID].done(errors.New("upload failed"))
+	if err := relay.wait(context.Background()); err != nil {
+		t.Fatalf("relay result changed: %v", err)
+	}
+}
+
+func TestSeedDistribute(t *testing.T) {
+	batch := []model.Server{{ID: 1, Host: "10.0.0.1"}, {ID: 2, Host: "10.0.0.2"}}
+	task := &Task{
+		model: &model.Task{Project: model.Project{DistributeMode: model.ProjectDistributeSeed}},
+
+		distributions: make(map[int64]*distribution),
+		packageSha256: "sum",
+	}
+	task.distribute(batch, nil)
+	seed := task.distributions[2]
+	if seed == nil || seed.source.ID != 1 || task.distributions[1] != seed {
+		t.Fatalf("seed source error: %+v", seed)
+	}
+	if strings.Join(seed.hosts, ",") != "10.0.0.1,10.0.0.2" {
+		t.Fatalf("seed hosts: %v", seed.hosts)
+	}
+	seed.done(errors.New("upload failed"))
+	seed.done(nil)
+	if err := seed.wait(context.Background()); err == nil {
+		t.Fatal("expected seed upload error")
+	}
+}
+
+// TestDistributeJumpServer 通过跳板机连接的服务器不参与分发
+func TestDistributeJumpServer(t *testing.T) {
+	batch := []model.Server{{ID: 1, Host: "10.0.0.1", JumpServerId: 9}, {ID: 2, Host: "10.0.0.2"}, {ID: 3, Host: "10.0.0.3"}}
+	task := &Task{
+		model: &model.Task{Project: model.Project{DistributeMode: model.ProjectDistributeSeed}},
+
+		distributions: make(map[int64]*distribution),
+		packageSha256: "sum",
+	}
+	task.distribute(batch, nil)
+	seed := task.distributions[3]
+	if seed == nil || seed.source.ID != 2 || task.distributions[1] != nil {
+		t.Fatalf("seed source error: %+v", seed)
+	}
+	if strings.Join(seed.hosts, ",") != "10.0.0.2,10.0.0.3" {
+		t.Fatalf("seed hosts: %v", seed.hosts)
+	}
+
+	//只有一台服务器可以直接连接时不分发
+	task.distributions = make(map[int64]*distribution)
+	task.distribute(batch[:2], nil)
+	if len(task.distributions) > 0 {
+		t.Fatalf("distributions: %+v", task.distributions)
+	}
+
+	task.model.Project.DistributeMode = model.ProjectDistributeRelay
+	relay := newDistribution(&model.Server{ID: 4}, directServers(batch))
+	task.distribute(batch, relay)
+	if task.distributions[1] != nil || task.distributions[2] != relay || task.distributions[3] != relay {
+		t.Fatalf("relay distributions: %+v", task.distributions)
+	}
+}
+
+func TestRevokeKeyCommand(t *testing.T) {
+	home := t.TempDir()
+	if err := os.Mkdir(filepath.Join(home, ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	keys := filepath.Join(home, ".ssh", "authorized_keys")
+	content := "ssh-ed25519 AAAA user@host\nrestrict ecdsa-sha2-nistp256 BBBB yema-distribute-task-1\nrestrict ecdsa-sha2-nistp256 CCCC yema-distribute-task-12\n"
+	if err := os.WriteFile(keys, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		cmd := exec.Command("sh", "-c", revokeKeyCommand("yema-distribute-task-1"))
+		cmd.Env = append(os.Environ(), "HOME="+home)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
+	}
+	b, err := os.ReadFile(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "ssh-ed25519 AAAA user@host\nrestrict ecdsa-sha2-nistp256 CCCC yema-distribute-task-12\n"; string(b) != want {
+		t.Fatalf("authorized_keys: %q", b)
+	}
+	if info, _ := os.Stat(keys); info.Mode().Perm() != 0600 {
+		t.Fatalf("mode changed: %v", info.Mode())
+	}
+}
+
+func TestDistributeKeyLine(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+	file := "/data/releases/v1.tar.gz"
+	line := distributeKeyLine(authKey, "yema-distribute-task-1", file, []string{"10.0.0.1", "10.0.0.2"})
+	_, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comment != "yema-distribute-task-1" || len(options) != 3 || options[0] != "restrict" || options[1] != `from="10.0.0.1,10.0.0.2"` {
+		t.Fatalf("comment %q options %q", comment, options)
+	}
+	command := strings.ReplaceAll(strings.TrimSuffix(strings.TrimPrefix(options[2], `command="`), `"`), `\"`, `"`)
+	if command != pullOnlyCommand(file) {
+		t.Fatalf("command: %s", command)
+	}
+}
+
+// TestPullOnlyCommand 临时公钥只能读取程序包
+func TestPullOnlyCommand(t *testing.T) {
+	bin := t.TempDir()
+	for _, name := range []string{"scp", "rsync"} {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte("#!/bin/sh\necho "+name+" \"$*\"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file := "/data/releases/v1.tar.gz"
+	tests := []struct {
+		command string
+		allowed bool
+	}{
+		{"scp -f /data/releases/v1.tar.gz", true},
+		{"rsync --server --sender -logDtpre.iLsfxCIvu . /data/releases/v1.tar.gz", true},
+		{"rsync --server --sender -logDtpre.iLsfxCIvu --partial --bwlimit=100 . /data/releases/v1.tar.gz", true},
+		{"scp -f /etc/passwd", false},
+		{"scp -t /data/releases/v1.tar.gz", false},
+		{"scp -f /data/releases/v1.tar.gz; sh", false},
+		{"scp -f /data/releases/*", false},
+		{"rsync --server --sender -logDtpre.iLsfxCIvu . /etc/passwd", false},
+		{"rsync --server --sender -logDtpre.iLsfxCIvu . /data/releases/v1.tar.gz /etc/passwd", false},
+		{"rsync --server -logDtpre.iLsfxCIvu . /data/releases/v1.tar.gz", false},
+		{"rsync --server --sender --log-file=/tmp/x . /data/releases/v1.tar.gz", false},
+		{"rsync --server --sender -M--log-file=/tmp/x . /data/releases/v1.tar.gz", false},
+		{"rsync --server --sender -e.sh;id . /data/releases/v1.tar.gz", false},
+		{"sh -c id", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		cmd := exec.Command("sh", "-c", pullOnlyCommand(file))
+		cmd.Env = append(os.Environ(), "PATH="+bin+":"+os.Getenv("PATH"), "SSH_ORIGINAL_COMMAND="+tt.command)
+		out, err := cmd.CombinedOutput()
+		if tt.allowed && (err != nil || strings.TrimSpace(string(out)) != tt.command) {
+			t.Errorf("%q: denied: %v %s", tt.command, err, out)
+		}
+		if !tt.allowed && (err == nil || len(out) > 0) {
+			t.Errorf("%q: allowed: %s", tt.command, out)
+		}
+	}
+}
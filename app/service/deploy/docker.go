@@ -0,0 +1,149 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"strings"
+	"yema.dev/app/model"
+	"yema.dev/app/pkg/ssh"
+)
+
+// image 本次发布的镜像，标签为发布版本，指定了已有镜像标签时版本即为该标签，灰度取消时为灰度发布前的镜像
+func (t *Task) image() string {
+	if t.stage == stageAbort {
+		return t.model.Project.Image(t.model.PrevVersion)
+	}
+	return t.model.Project.Image(t.model.Version)
+}
+
+// serverImage 服务器发布的镜像，灰度取消时各服务器使用各自灰度发布前的镜像
+func (t *Task) serverImage(serverId int64) string {
+	if t.stage == stageAbort {
+		return t.model.Project.Image(t.rollbackVersion(serverId))
+	}
+	return t.image()
+}
+
+// currentImageTag 服务器当前容器的镜像标签
+func (t *Task) currentImageTag(ctx context.Context, server *model.Server) (string, error) {
+	project := t.model.Project
+	t.log.Debug("5.1、获取当前容器的镜像，保存下来", zap.String("server", server.Hostname()))
+	cmd := fmt.Sprintf("docker inspect -f '{{.Config.Image}}' %s 2>/dev/null || echo \"\"", ssh.ShellQuote(project.DockerContainer))
+	record := t.newRecordRemote(cmd, server, nil)
+	if err := record.Run(ctx); err != nil {
+		return "", err
+	}
+	return imageTag(strings.TrimSpace(record.Output()), project.DockerImage), nil
+}
+
+// buildImage step3.执行用户命令构建并推送镜像，未配置命令时使用docker build和docker push
+func (t *Task) buildImage(ctx context.Context) error {
+	if t.model.ImageTag != "" {
+		return nil
+	}
+	t.log.Debug("3.1、构建并推送镜像", zap.String("image", t.image()))
+	commands := parseCommands(t.model.Project.PostDeploy)
+	if len(commands) == 0 {
+		image := ssh.ShellQuote(t.image())
+		commands = []string{"docker build -t " + image + " .", "docker push " + image}
+	}
+	for _, cmd := range commands {
+		cmd = fmt.Sprintf("cd %s && %s", t.deployDirs.localWarehouseDir, cmd)
+		r := t.newRecordLocal(cmd, t.envs())
+		if err := r.Run(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dockerPull step4.服务器拉取镜像，回滚时镜像可能已被清理，同样需要拉取
+func (t *Task) dockerPull(ctx context.Context, server *model.Server) (err error) {
+	t.steps[server.ID].step = 4
+	defer func() {
+		if err != nil {
+			t.steps[server.ID].status = 2
+		} else {
+			t.steps[server.ID].status = 1
+		}
+	}()
+	t.log.Debug("4.1、拉取镜像", zap.String("server", server.Hostname()))
+	r := t.newRecordRemote("docker pull "+ssh.ShellQuote(t.serverImage(server.ID)), server, nil)
+	if err = r.Run(ctx); err != nil {
+		return err
+	}
+	if t.isRollback() {
+		return nil
+	}
+	t.log.Debug("4.2、执行用户命令", zap.String("server", server.Hostname()))
+	for _, cmd := range parseCommands(t.model.Project.PrevRelease) {
+		r = t.newRecordRemote(cmd, server, t.envs())
+		if err = r.Run(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dockerRelease step5.用新镜像替换容器，当前容器的镜像标签在发布前已记录用于回滚
+func (t *Task) dockerRelease(ctx context.Context, server *model.Server) (err error) {
+	t.steps[server.ID].step = 5
+	defer func() {
+		if err != nil {
+			t.steps[server.ID].status = 2
+		} else {
+			t.steps[server.ID].status = 1
+		}
+	}()
+	project := t.model.Project
+	t.log.Debug("5.2、替换容器", zap.String("server", server.Hostname()))
+	record := t.newRecordRemote(dockerRunCommand(project.DockerContainer, project.DockerRunSpec, t.serverImage(server.ID)), server, nil)
+	return record.Run(ctx)
+}
+
+// cleanImages 清理服务器上超出保留数量的历史镜像，只清理平台构建的版本标签
+func (t *Task) cleanImages(ctx context.Context, server *model.Server) (err error) {
+	keepNum := t.model.Project.KeepVersionNum
+	if keepNum <= 0 {
+		return nil
+	}
+	t.log.Debug("6.3、清理历史镜像", zap.String("server", server.Hostname()))
+	cmd := fmt.Sprintf("docker images --format '{{.Tag}}' %s", ssh.ShellQuote(t.model.Project.DockerImage))
+	record := t.newRecordRemote(cmd, server, nil)
+	if err = record.Run(ctx); err != nil {
+		return err
+	}
+	current := t.model.Version
+	if t.isRollback() {
+		current = t.rollbackVersion(server.ID)
+	}
+	for _, version := range expiredVersions(record.Output(), t.model.Project.ID, keepNum, t.keepVersions(server.ID, current)) {
+		record = t.newRecordRemote("docker rmi "+ssh.ShellQuote(t.model.Project.Image(version)), server, nil)
+		if err = record.Run(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// imageTag 容器镜像属于项目镜像地址时返回标签，否则无法回滚返回空
+func imageTag(image, repository string) string {
+	if !strings.HasPrefix(image, repository+":") {
+		return ""
+	}
+	return strings.TrimPrefix(image, repository+":")
+}
+
+// dockerRunCommand 先停止旧容器并改名保留，新容器启动成功后删除旧容器，失败时恢复旧容器
+func dockerRunCommand(container, spec, image string) string {
+	name, old := ssh.ShellQuote(container), ssh.ShellQuote(container+"_old")
+	return strings.Join([]string{
+		"set -e",
+		fmt.Sprintf("docker rm -f %s >/dev/null 2>&1 || true", old),
+		fmt.Sprintf("if docker inspect %s >/dev/null 2>&1; then docker stop %s >/dev/null; docker rename %s %s; fi", name, name, name, old),
+		fmt.Sprintf("if docker run -d --name %s %s %s; then docker rm -f %s >/dev/null 2>&1 || true; "+
+			"else docker rm -f %s >/dev/null 2>&1 || true; if docker inspect %s >/dev/null 2>&1; then docker rename %s %s; docker start %s; fi; exit 1; fi",
+			name, spec, ssh.ShellQuote(image), old, name, old, old, name, name),
+	}, "; ")
+}
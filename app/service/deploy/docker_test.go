@@ -0,0 +1,139 @@
+package deploy
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"yema.dev/app/model"
+	"yema.dev/app/model/field"
+)
+
+func TestImageTag(t *testing.T) {
+	tests := []struct {
+		image, repository, tag string
+	}{
+		{"registry.example.com/app:1_2_20240101_000000", "registry.example.com/app", "1_2_20240101_000000"},
+		{"registry.example.com/app:v1.0.0", "registry.example.com/app", "v1.0.0"},
+		{"registry.example.com/app-canary:v1.0.0", "registry.example.com/app", ""},
+		{"nginx:latest", "registry.example.com/app", ""},
+		{"", "registry.example.com/app", ""},
+	}
+	for _, tt := range tests {
+		if tag := imageTag(tt.image, tt.repository); tag != tt.tag {
+			t.Errorf("%s: tag %q, want %q", tt.image, tag, tt.tag)
+		}
+	}
+}
+
+func TestTaskImage(t *testing.T) {
+	project := model.Project{DeployType: model.ProjectDeployDocker, DockerImage: "registry/app"}
+	tests := []struct {
+		name  string
+		task  *Task
+		image string
+	}{
+		{"release", &Task{model: &model.Task{Project: project, Version: "1_2_20240101_000000"}}, "registry/app:1_2_20240101_000000"},
+		{"abort", &Task{stage: stageAbort, model: &model.Task{Project: project, Version: "1_2_20240101_000000", PrevVersion: "v1.0.0"}}, "registry/app:v1.0.0"},
+	}
+	for _, tt := range tests {
+		if image := tt.task.image(); image != tt.image {
+			t.Errorf("%s: image %s, want %s", tt.name, image, tt.image)
+		}
+	}
+}
+
+// fakeDocker 用脚本模拟docker命令，容器以状态目录中的文件表示，文件内容为容器的镜像，
+// 状态目录为空时使用模拟服务器的根目录
+func fakeDocker(t *testing.T) string {
+	bin, state := t.TempDir(), t.TempDir()
+	script := `#!/bin/sh
+cd "${FAKE_DOCKER_STATE:-$ROOT}"
+case "$1" in
+inspect) if [ "$2" = "-f" ]; then cat "$4"; else [ -e "$2" ]; fi ;;
+stop|start) [ -e "$2" ] ;;
+rm) [ "$2" = "-f" ] && rm -f "$3" ;;
+rename) mv "$2" "$3" ;;
+run) eval image=\${$#}; [ -z "$FAKE_DOCKER_RUN_FAIL" ] && echo "$image" > "$4" ;;
+esac
+`
+	if err := os.WriteFile(filepath.Join(bin, "docker"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("FAKE_DOCKER_STATE", state)
+	return state
+}
+
+func TestDockerRunCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing bool
+		runFail  bool
+		success  bool
+		running  bool
+	}{
+		{"replace", true, false, true, true},
+		{"first run", false, false, true, true},
+		{"restore old", true, true, false, true},
+		{"first run fail", false, true, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := fakeDocker(t)
+			if tt.existing {
+				writeFiles(t, state, map[string]string{"app": ""})
+			}
+			if tt.runFail {
+				t.Setenv("FAKE_DOCKER_RUN_FAIL", "1")
+			}
+			err := exec.Command("sh", "-c", dockerRunCommand("app", "-p 80:80", "registry/app:v2")).Run()
+			if (err == nil) != tt.success {
+				t.Fatalf("run error: %v", err)
+			}
+			if _, err = os.Stat(filepath.Join(state, "app")); (err == nil) != tt.running {
+				t.Fatalf("container running: %v", err)
+			}
+			if _, err = os.Stat(filepath.Join(state, "app_old")); err == nil {
+				t.Fatal("old container not removed")
+			}
+		})
+	}
+}
+
+// TestAbortDockerServers docker灰度取消时各服务器恢复各自灰度发布前的镜像
+func TestAbortDockerServers(t *testing.T) {
+	fakeDocker(t)
+	t.Setenv("FAKE_DOCKER_STATE", "")
+	first, second := newTestRemote(t), newTestRemote(t)
+	writeFiles(t, first.root, map[string]string{"app": "registry/app:1_3_20240103_000000"})
+	writeFiles(t, second.root, map[string]string{"app": "registry/app:1_3_20240103_000000"})
+	m := &model.Task{Name: "canary", Version: "1_3_20240103_000000", Status: model.TaskStatusCanary,
+		Project: model.Project{DeployType: model.ProjectDeployDocker, DockerImage: "registry/app", DockerContainer: "app"}}
+	task := newRemoteTask(t, m, first, second)
+	m.CanaryServerIds = field.Slices[int64]{m.Servers[0].ID, m.Servers[1].ID}
+	m.PrevVersion = "v1"
+	m.PrevVersions = model.ServerVersions{m.Servers[0].ID: "v1", m.Servers[1].ID: "v0"}
+	task.stage = stageAbort
+	if err := task.prevRollback(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := task.remoteRelease(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		remote *testRemote
+		image  string
+	}{{first, "registry/app:v1"}, {second, "registry/app:v0"}} {
+		data, err := os.ReadFile(c.remote.path("app"))
+		if err != nil || strings.TrimSpace(string(data)) != c.image {
+			t.Errorf("container image %q %v, want %s", data, err, c.image)
+		}
+	}
+	//灰度发布前的版本是当前容器的镜像标签
+	if v := task.prevVersion(m.Servers[0].ID); v != "1_3_20240103_000000" {
+		t.Fatalf("prev version %q", v)
+	}
+}
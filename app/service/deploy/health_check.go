@@ -0,0 +1,143 @@
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"yema.dev/app/model"
+	"yema.dev/app/pkg/ssh"
+	"yema.dev/app/service/common"
+)
+
+const (
+	defaultHealthTimeout  = 60   //健康检查默认超时时间(秒)
+	defaultHealthInterval = 3    //健康检查默认重试间隔(秒)
+	healthOutputMax       = 4096 //检查失败时记录的输出长度
+)
+
+// healthCheck step6.发布后按项目配置检查服务是否正常，失败重试直到超时，
+// 最终失败时服务器切换回发布前的版本，检查结果保存为执行记录
+func (t *Task) healthCheck(ctx context.Context, server *model.Server) (err error) {
+	project := t.model.Project
+	if len(project.HealthChecks) == 0 {
+		return nil
+	}
+	defer func() {
+		if err != nil {
+			t.steps[server.ID].status = 2
+		}
+	}()
+	sshConf, err := common.SshConfig(t.db, server)
+	if err != nil {
+		return err
+	}
+	timeout, interval := project.HealthTimeout, project.HealthInterval
+	if timeout <= 0 {
+		timeout = defaultHealthTimeout
+	}
+	if interval <= 0 {
+		interval = defaultHealthInterval
+	}
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+	for _, check := range project.HealthChecks {
+		t.log.Debug("6.4、健康检查", zap.String("server", server.Hostname()), zap.String("type", check.Type))
+		cmd := healthCheckCommand(check, t.deployDirs.remoteRootLink, project.IsDocker())
+		record := t.newRecordRemote(cmd, server, nil)
+		record.SetSaveTime()
+		var output []byte
+		var checkErr error
+		attempts := 0
+		for {
+			attempts++
+			output, checkErr = t.ssh.RunCmd(sshConf, cmd)
+			if checkErr = healthCheckResult(check, output, checkErr); checkErr == nil || !time.Now().Before(deadline) {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				_ = record.Save(1, "发布已终止")
+				return ErrStopDeploy
+			case <-time.After(time.Duration(interval) * time.Second):
+			}
+		}
+		if checkErr == nil {
+			_ = record.Save(0, fmt.Sprintf("健康检查通过，尝试%d次", attempts))
+			continue
+		}
+		if len(output) > healthOutputMax {
+			output = output[:healthOutputMax]
+		}
+		_ = record.Save(1, fmt.Sprintf("健康检查失败，尝试%d次：%s\r\n%s", attempts, checkErr, output))
+		return t.rollbackServer(ctx, server, Error.New("健康检查失败：%s", checkErr))
+	}
+	return nil
+}
+
+// rollbackServer 健康检查失败时服务器切换回发布前的版本，回滚单不再自动回滚
+func (t *Task) rollbackServer(ctx context.Context, server *model.Server, checkErr error) error {
+	prevVersion := t.prevVersion(server.ID)
+	if t.isRollback() || prevVersion == "" {
+		return checkErr
+	}
+	project := t.model.Project
+	t.log.Info("健康检查失败，自动回滚", zap.String("server", server.Hostname()), zap.String("version", prevVersion))
+	cmd := fmt.Sprintf("ln -sfn %[1]s %[2]s_tmp && mv -fT %[2]s_tmp %[2]s", prevVersion, t.deployDirs.remoteRootLink)
+	if project.IsDocker() {
+		cmd = dockerRunCommand(project.DockerContainer, project.DockerRunSpec, project.Image(prevVersion))
+	}
+	if err := t.newRecordRemote(cmd, server, nil).Run(ctx); err != nil {
+		return Error.New("%s，自动回滚失败：%s", checkErr, err)
+	}
+	if err := t.restartService(ctx, server); err != nil {
+		return Error.New("%s，已回滚到%s，%s", checkErr, prevVersion, err)
+	}
+	return Error.New("%s，已回滚到%s", checkErr, prevVersion)
+}
+
+// healthCheckCommand 在服务器上执行一次检查的命令，http检查输出响应内容，最后一行为状态码
+func healthCheckCommand(check model.HealthCheck, releaseDir string, docker bool) string {
+	switch check.Type {
+	case model.HealthCheckHttp:
+		u := ssh.ShellQuote(check.Url)
+		return fmt.Sprintf(`if command -v curl >/dev/null 2>&1; then curl -sS -m 10 -w '\n%%{http_code}' %s; else wget -q -T 10 -O - %s && printf '\n200'; fi`, u, u)
+	case model.HealthCheckTcp:
+		return fmt.Sprintf("if command -v nc >/dev/null 2>&1; then nc -z -w 5 127.0.0.1 %[1]d; else timeout 5 bash -c 'exec 3<>/dev/tcp/127.0.0.1/%[1]d'; fi", check.Port)
+	}
+	if docker {
+		return check.Command
+	}
+	return fmt.Sprintf("cd %s && %s", releaseDir, check.Command)
+}
+
+// healthCheckResult 判断检查结果
+func healthCheckResult(check model.HealthCheck, output []byte, err error) error {
+	if err != nil {
+		return err
+	}
+	if check.Type != model.HealthCheckHttp {
+		return nil
+	}
+	body, status := output, 0
+	if i := bytes.LastIndexByte(output, '\n'); i >= 0 {
+		body = output[:i]
+		status, _ = strconv.Atoi(strings.TrimSpace(string(output[i+1:])))
+	}
+	if check.ExpectStatus == 0 && (status < 200 || status > 299) || check.ExpectStatus != 0 && status != check.ExpectStatus {
+		return Error.New("状态码%d", status)
+	}
+	if check.ExpectBody != "" {
+		re, err := regexp.Compile(check.ExpectBody)
+		if err != nil {
+			return err
+		}
+		if !re.Match(body) {
+			return Error.New("响应内容不匹配%s", check.ExpectBody)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package deploy
+
+import (
+	"errors"
+	"testing"
+	"yema.dev/app/model"
+)
+
+func TestHealthCheckResult(t *testing.T) {
+	cases := []struct {
+		name    string
+		check   model.HealthCheck
+		output  string
+		err     error
+		success bool
+	}{
+		{"2xx", model.HealthCheck{Type: model.HealthCheckHttp}, "ok\n204", nil, true},
+		{"5xx", model.HealthCheck{Type: model.HealthCheckHttp}, "error\n502", nil, false},
+		{"expect status", model.HealthCheck{Type: model.HealthCheckHttp, ExpectStatus: 401}, "\n401", nil, true},
+		{"body match", model.HealthCheck{Type: model.HealthCheckHttp, ExpectBody: `"status":\s*"UP"`}, `{"status": "UP"}` + "\n200", nil, true},
+		{"body mismatch", model.HealthCheck{Type: model.HealthCheckHttp, ExpectBody: "UP"}, "DOWN\n200", nil, false},
+		{"no status", model.HealthCheck{Type: model.HealthCheckHttp}, "", nil, false},
+		{"command", model.HealthCheck{Type: model.HealthCheckCommand, Command: "true"}, "", nil, true},
+		{"command error", model.HealthCheck{Type: model.HealthCheckTcp, Port: 80}, "", errors.New("exit status 1"), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := healthCheckResult(c.check, []byte(c.output), c.err); (err == nil) != c.success {
+				t.Fatalf("err: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package deploy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"strings"
+	"yema.dev/app/model"
+	"yema.dev/app/pkg/ssh"
+	"yema.dev/app/service/common"
+)
+
+const (
+	manifestSuffix = ".manifest"     //版本文件清单后缀，和版本目录放在一起
+	deltaSuffix    = ".delta.tar.gz" //增量包后缀
+)
+
+// manifest 本次发布的文件清单，首次使用时根据程序包生成并保存到本地，
+// 灰度确认时直接使用灰度发布时保存的清单
+func (t *Task) manifest() (manifest, error) {
+	t.manifestOnce.Do(func() {
+		if t.stage == stagePromote {
+			if data, err := os.ReadFile(t.deployDirs.localManifest); err == nil {
+				t.localManifest, t.manifestErr = parseManifest(data)
+				return
+			}
+		}
+		t.localManifest, t.manifestErr = packageManifest(t.deployDirs.localCodePackage)
+		if t.manifestErr == nil {
+			t.manifestErr = os.WriteFile(t.deployDirs.localManifest, t.localManifest.marshal(), 0644)
+		}
+	})
+	return t.localManifest, t.manifestErr
+}
+
+// deltaPackage 根据上一个版本的清单生成增量包，各服务器上一个版本相同时只生成一次
+func (t *Task) deltaPackage(prev manifest, prevData []byte) (string, int, error) {
+	current, err := t.manifest()
+	if err != nil {
+		return "", 0, err
+	}
+	changed := current.changed(prev)
+	h := sha256.Sum256(prevData)
+	key := hex.EncodeToString(h[:])
+
+	t.deltaMux.Lock()
+	defer t.deltaMux.Unlock()
+	if pkg, ok := t.deltas[key]; ok {
+		return pkg, len(changed), nil
+	}
+	if err = os.MkdirAll(t.deployDirs.localDeltaDir, 0755); err != nil {
+		return "", 0, err
+	}
+	pkg := filepath.Join(t.deployDirs.localDeltaDir, key[:16]+deltaSuffix)
+	if err = packDelta(t.deployDirs.localCodePackage, pkg, changed); err != nil {
+		return "", 0, err
+	}
+	t.deltas[key] = pkg
+	return pkg, len(changed), nil
+}
+
+// syncIncremental 增量发布，复制服务器上当前版本目录为新版本，再传输有变化的文件，
+// 失败时返回错误由调用方改为完整程序包发布
+func (t *Task) syncIncremental(ctx context.Context, server *model.Server) error {
+	current, err := t.manifest()
+	if err != nil {
+		return err
+	}
+	sshConf, err := common.SshConfig(t.db, server)
+	if err != nil {
+		return err
+	}
+	output, err := t.ssh.RunCmd(sshConf, "readlink "+ssh.ShellQuote(t.deployDirs.remoteRootLink))
+	prevDir := strings.TrimSpace(string(output))
+	if err != nil || prevDir == "" {
+		return Error.New("服务器上没有正在运行的版本")
+	}
+	prevData, err := t.ssh.RunCmd(sshConf, "cat "+ssh.ShellQuote(prevDir+manifestSuffix))
+	if err != nil {
+		return Error.New("当前版本[%s]没有文件清单", filepath.Base(prevDir))
+	}
+	prev, err := parseManifest(prevData)
+	if err != nil {
+		return err
+	}
+	delta, changed, err := t.deltaPackage(prev, prevData)
+	if err != nil {
+		return err
+	}
+	t.taskLogs[server.ID].Write([]byte(fmt.Sprintf("增量发布：基于版本%s，共%d个文件，%d个有变化\r\n", filepath.Base(prevDir), len(current), changed)))
+
+	t.log.Debug("4.1、上传文件清单和增量包", zap.String("server", server.Hostname()))
+	if err = t.uploadFile(ctx, server, t.deployDirs.localManifest, t.deployDirs.remoteReleaseManifest); err != nil {
+		return err
+	}
+	if err = t.uploadFile(ctx, server, delta, t.deployDirs.remoteReleaseDelta); err != nil {
+		return err
+	}
+
+	t.log.Debug("4.2、在服务器复制当前版本并解压增量包", zap.String("server", server.Hostname()))
+	cmd := incrementalCommand(prevDir, t.deployDirs.remoteReleaseDir, t.deployDirs.remoteReleaseManifest, t.deployDirs.remoteReleaseDelta,
+		t.model.Project.TransferMode == model.ProjectTransferHardLink)
+	return t.newRecordRemote(cmd, server, nil).Run(ctx)
+}
+
+// uploadFile 上传文件并记录到发布日志
+func (t *Task) uploadFile(ctx context.Context, server *model.Server, localFile, remoteFile string) error {
+	_saveCmd := fmt.Sprintf("scp -P%d %s %s:%s", server.Port, localFile, server.Hostname(), remoteFile)
+	record := t.newRecordRemote(_saveCmd, server, nil)
+	record.SetSaveTime()
+	result, err := t.upload(ctx, server, localFile, remoteFile, t.taskLogs[server.ID])
+	if err != nil {
+		_ = record.Save(254, "上传文件出错:"+err.Error())
+		return err
+	}
+	return record.Save(0, fmt.Sprintf("success, size: %d, sha256: %s", result.Size, result.Sha256))
+}
+
+// incrementalCommand 在服务器上生成新版本目录：复制当前版本，删除新版本中没有的文件，
+// 有变化的文件先删除再从增量包解压，避免修改硬链接影响当前版本，最后核对文件数量
+func incrementalCommand(prevDir, releaseDir, manifestFile, deltaFile string, hardLink bool) string {
+	cp := "cp -a"
+	if hardLink {
+		cp = "cp -al"
+	}
+	q := ssh.ShellQuote
+	return strings.Join([]string{
+		"set -e",
+		"export LC_ALL=C",
+		"rm -rf " + q(releaseDir),
+		fmt.Sprintf("%s %s %s", cp, q(prevDir), q(releaseDir)),
+		"cd " + q(releaseDir),
+		"keep=$(mktemp)",
+		`trap 'rm -f "$keep"' EXIT`,
+		fmt.Sprintf(`cut -f3- %s | sort > "$keep"`, q(manifestFile)),
+		`find . -mindepth 1 ! -type d | sed 's|^\./||' | sort | comm -23 - "$keep" | while IFS= read -r f; do rm -f -- "$f"; done`,
+		`find . -mindepth 1 -depth -type d -empty -exec rmdir {} \;`,
+		fmt.Sprintf(`tar -tzf %s | while IFS= read -r f; do rm -rf -- "$f"; done`, q(deltaFile)),
+		fmt.Sprintf("tar -zxf %s -C .", q(deltaFile)),
+		fmt.Sprintf(`[ "$(find . ! -type d | wc -l)" -eq "$(wc -l < %s)" ]`, q(manifestFile)),
+	}, "; ")
+}
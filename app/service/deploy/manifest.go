@@ -0,0 +1,148 @@
+package deploy
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// manifest 程序包文件清单，增量发布时和上一个版本的清单对比，只传输变化的文件
+// 每行格式：sha256\t权限\t路径，路径放最后方便服务器上用cut -f3-取出
+type manifest map[string]manifestEntry
+
+type manifestEntry struct {
+	sum  string
+	mode int64
+}
+
+// packageManifest 读取程序包生成文件清单，程序包中只有普通文件，目录由文件路径隐含
+func packageManifest(pkg string) (manifest, error) {
+	m := make(manifest)
+	err := walkPackage(pkg, func(header *tar.Header, r io.Reader) error {
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+		if strings.ContainsAny(header.Name, "\t\n") {
+			return Error.New("文件名包含制表符或换行，不支持增量发布：%q", header.Name)
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, r); err != nil {
+			return err
+		}
+		m[header.Name] = manifestEntry{sum: hex.EncodeToString(h.Sum(nil)), mode: header.Mode}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func parseManifest(data []byte) (manifest, error) {
+	m := make(manifest)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "\t", 3)
+		if len(parts) != 3 {
+			return nil, Error.New("文件清单格式错误：%s", line)
+		}
+		mode, err := strconv.ParseInt(parts[1], 8, 64)
+		if err != nil {
+			return nil, Error.New("文件清单格式错误：%s", line)
+		}
+		m[parts[2]] = manifestEntry{sum: parts[0], mode: mode}
+	}
+	return m, nil
+}
+
+func (m manifest) marshal() []byte {
+	paths := make([]string, 0, len(m))
+	for p := range m {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	buf := bytes.Buffer{}
+	for _, p := range paths {
+		buf.WriteString(fmt.Sprintf("%s\t%o\t%s\n", m[p].sum, m[p].mode, p))
+	}
+	return buf.Bytes()
+}
+
+// changed 相比上一个版本新增或者内容、权限有变化的文件
+func (m manifest) changed(prev manifest) map[string]bool {
+	res := make(map[string]bool)
+	for p, e := range m {
+		if old, ok := prev[p]; !ok || old != e {
+			res[p] = true
+		}
+	}
+	return res
+}
+
+// packDelta 从完整程序包中复制有变化的文件生成增量包
+func packDelta(pkg, dest string, changed map[string]bool) (err error) {
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if _err := f.Close(); _err != nil && err == nil {
+			err = _err
+		}
+	}()
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	err = walkPackage(pkg, func(header *tar.Header, r io.Reader) error {
+		if !changed[header.Name] {
+			return nil
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, r)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func walkPackage(pkg string, fn func(header *tar.Header, r io.Reader) error) error {
+	f, err := os.Open(pkg)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(header, tr); err != nil {
+			return err
+		}
+	}
+}
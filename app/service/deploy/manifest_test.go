@@ -0,0 +1,129 @@
+package deploy
+
+import (
+	"github.com/wuzfei/go-helper/compress"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// packRelease 打包版本代码并生成文件清单
+func packRelease(t *testing.T, root, version string, files map[string]string) (string, manifest) {
+	src := filepath.Join(root, "src_"+version)
+	writeFiles(t, src, files)
+	pkg := filepath.Join(root, version+".tar.gz")
+	if err := compress.PackMatch(pkg, src, nil); err != nil {
+		t.Fatal(err)
+	}
+	m, err := packageManifest(pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != len(files) {
+		t.Fatalf("manifest: %v", m)
+	}
+	return pkg, m
+}
+
+func TestIncrementalRelease(t *testing.T) {
+	root := t.TempDir()
+	releases := filepath.Join(root, "releases")
+	prevDir := filepath.Join(releases, "v1")
+
+	_, prev := packRelease(t, root, "v1", map[string]string{
+		"index.php":      "v1",
+		"lib/a.php":      "a",
+		"lib/old.php":    "old",
+		"static/app.css": "css",
+	})
+	writeFiles(t, prevDir, map[string]string{
+		"index.php":      "v1",
+		"lib/a.php":      "a",
+		"lib/old.php":    "old",
+		"static/app.css": "css",
+		"runtime/cache":  "生成的文件",
+	})
+	if err := os.WriteFile(prevDir+manifestSuffix, prev.marshal(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pkg, current := packRelease(t, root, "v2", map[string]string{
+		"index.php":      "v2",
+		"lib/a.php":      "a",
+		"lib/new.php":    "new",
+		"static/app.css": "css",
+	})
+	parsed, err := parseManifest(current.marshal())
+	if err != nil || len(parsed) != len(current) || len(parsed.changed(current)) != 0 {
+		t.Fatalf("parse manifest: %v %v", parsed, err)
+	}
+	changed := current.changed(prev)
+	if len(changed) != 2 || !changed["index.php"] || !changed["lib/new.php"] {
+		t.Fatalf("changed: %v", changed)
+	}
+
+	releaseDir := filepath.Join(releases, "v2")
+	deltaFile := releaseDir + deltaSuffix
+	if err = packDelta(pkg, deltaFile, changed); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(releaseDir+manifestSuffix, current.marshal(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := incrementalCommand(prevDir, releaseDir, releaseDir+manifestSuffix, deltaFile, true)
+	if out, err := exec.Command("sh", "-c", cmd).CombinedOutput(); err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+
+	for name, content := range map[string]string{"index.php": "v2", "lib/a.php": "a", "lib/new.php": "new", "static/app.css": "css"} {
+		data, err := os.ReadFile(filepath.Join(releaseDir, name))
+		if err != nil || string(data) != content {
+			t.Fatalf("%s: %q %v", name, data, err)
+		}
+	}
+	for _, name := range []string{"lib/old.php", "runtime"} {
+		if _, err := os.Stat(filepath.Join(releaseDir, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s should be removed: %v", name, err)
+		}
+	}
+	//硬链接的文件被替换时不能影响上一个版本
+	if data, _ := os.ReadFile(filepath.Join(prevDir, "index.php")); string(data) != "v1" {
+		t.Fatalf("previous release changed: %q", data)
+	}
+}
+
+// TestUnpackAfterIncrementalFailure 增量发布失败改为完整程序包时，不能保留增量同步残留的文件
+func TestUnpackAfterIncrementalFailure(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{"index.php": "v2", "lib/a.php": "a"}
+	pkg, _ := packRelease(t, root, "v2", files)
+	releaseDir := filepath.Join(root, "releases", "v2")
+	//增量同步复制了当前版本后失败
+	writeFiles(t, releaseDir, map[string]string{"index.php": "v1", "lib/a.php": "a", "lib/old.php": "old"})
+
+	if out, err := exec.Command("sh", "-c", unpackCommand(releaseDir, pkg)).CombinedOutput(); err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	for name, content := range files {
+		data, err := os.ReadFile(filepath.Join(releaseDir, name))
+		if err != nil || string(data) != content {
+			t.Fatalf("%s: %q %v", name, data, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(releaseDir, "lib/old.php")); !os.IsNotExist(err) {
+		t.Fatalf("lib/old.php should be removed: %v", err)
+	}
+}
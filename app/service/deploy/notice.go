@@ -0,0 +1,72 @@
+package deploy
+
+import (
+	"fmt"
+	"strings"
+	"yema.dev/app/model"
+	"yema.dev/app/service/notice"
+)
+
+var noticeEventTitles = map[string]string{
+	notice.EventTaskCreated:     "新建上线单",
+	notice.EventAuditPass:       "上线单审核通过",
+	notice.EventAuditReject:     "上线单审核拒绝",
+	notice.EventReleaseStart:    "开始发布",
+	notice.EventReleaseFinish:   "发布完成",
+	notice.EventReleaseFail:     "发布失败",
+	notice.EventReleasePartFail: "部分服务器发布失败",
+	notice.EventCanaryFinish:    "灰度发布完成，等待确认",
+	notice.EventCanaryAbort:     "灰度发布已取消",
+}
+
+// sendNotice 按项目的通知配置发送上线单事件通知，未配置时忽略
+func (d *deploy) sendNotice(event string, taskModel *model.Task, project *model.Project) {
+	if d.notice == nil || project == nil || project.NoticeType == "" {
+		return
+	}
+	title := fmt.Sprintf("[%s] %s", project.Name, noticeEventTitles[event])
+	lines := []string{
+		"- 上线单：" + taskModel.Name,
+		"- 环境：" + taskModel.Environment.Name,
+	}
+	if taskModel.Tag != "" {
+		lines = append(lines, "- 标签："+taskModel.Tag)
+	} else {
+		lines = append(lines, "- 分支："+taskModel.Branch)
+	}
+	if taskModel.CommitId != "" {
+		lines = append(lines, "- 版本："+taskModel.CommitId)
+	}
+	if taskModel.LastError != "" && (event == notice.EventReleaseFail || event == notice.EventReleasePartFail) {
+		lines = append(lines, "- 错误："+taskModel.LastError)
+	}
+	d.notice.Send(notice.Target{
+		Type:   project.NoticeType,
+		Hook:   project.NoticeHook,
+		Secret: project.NoticeSecret.String(),
+	}, &notice.Message{
+		Event:       event,
+		Title:       title,
+		Content:     strings.Join(lines, "\n"),
+		TaskId:      taskModel.ID,
+		TaskName:    taskModel.Name,
+		ProjectId:   project.ID,
+		ProjectName: project.Name,
+		Status:      taskModel.Status,
+	})
+}
+
+// releaseEvent 发布结束后根据上线单状态确定通知事件
+func releaseEvent(status int8) string {
+	switch status {
+	case model.TaskStatusReleaseFail:
+		return notice.EventReleaseFail
+	case model.TaskStatusReleasePartFail:
+		return notice.EventReleasePartFail
+	case model.TaskStatusCanary:
+		return notice.EventCanaryFinish
+	case model.TaskStatusCanaryAbort:
+		return notice.EventCanaryAbort
+	}
+	return notice.EventReleaseFinish
+}
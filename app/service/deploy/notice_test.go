@@ -0,0 +1,60 @@
+package deploy
+
+import (
+	"encoding/json"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"yema.dev/app/model"
+	"yema.dev/app/service/notice"
+)
+
+func TestReleaseEvent(t *testing.T) {
+	tests := []struct {
+		status int8
+		event  string
+	}{
+		{model.TaskStatusFinish, notice.EventReleaseFinish},
+		{model.TaskStatusReleaseFail, notice.EventReleaseFail},
+		{model.TaskStatusReleasePartFail, notice.EventReleasePartFail},
+		{model.TaskStatusCanary, notice.EventCanaryFinish},
+		{model.TaskStatusCanaryAbort, notice.EventCanaryAbort},
+	}
+	for _, tt := range tests {
+		if event := releaseEvent(tt.status); event != tt.event {
+			t.Errorf("status %d: event %s, want %s", tt.status, event, tt.event)
+		}
+		if noticeEventTitles[tt.event] == "" {
+			t.Errorf("event %s has no title", tt.event)
+		}
+	}
+}
+
+func TestSendNotice(t *testing.T) {
+	received := make(chan *notice.Message, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg := &notice.Message{}
+		_ = json.NewDecoder(r.Body).Decode(msg)
+		received <- msg
+	}))
+	defer srv.Close()
+	d := &deploy{notice: notice.NewService(zap.NewNop(), &notice.Config{Timeout: time.Second})}
+	project := &model.Project{Name: "demo", NoticeType: notice.TypeWebhook, NoticeHook: srv.URL}
+	d.sendNotice(notice.EventCanaryAbort, &model.Task{Name: "task", Branch: "master"}, project)
+
+	select {
+	case msg := <-received:
+		if msg.Title != "[demo] 灰度发布已取消" {
+			t.Fatalf("title %q", msg.Title)
+		}
+		//标题由各通知方式展示，内容中不再重复
+		if strings.Contains(msg.Content, msg.Title) {
+			t.Fatalf("title repeated in content: %q", msg.Content)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("notice not sent")
+	}
+}
@@ -1,6 +1,7 @@
 package deploy
 
 import (
+	"time"
 	"yema.dev/app/pkg/db"
 )
 
@@ -12,8 +13,11 @@ type CreateReq struct {
 	Tag         string  `json:"tag" binding:"omitempty,max=50"`
 	Branch      string  `json:"branch" binding:"omitempty,max=50"`
 	CommitId    string  `json:"commit_id" binding:"omitempty,max=50"`
+	ImageTag    string  `json:"image_tag" binding:"omitempty,max=100"` //docker项目指定已有镜像标签时不在本地构建
 	Description string  `json:"description" binding:"omitempty,max=500"`
 	ServerIds   []int64 `json:"server_ids" binding:"required"`
+	//灰度服务器，为空时全量发布
+	CanaryServerIds []int64 `json:"canary_server_ids" binding:"omitempty,unique,dive,gt=0"`
 }
 
 type ListReq struct {
@@ -21,11 +25,26 @@ type ListReq struct {
 	db.Paginator
 }
 
+type ArtifactListReq struct {
+	SpaceId   int64 `json:"-" binding:"required,gt=0"`
+	ProjectId int64 `form:"project_id" json:"project_id" binding:"omitempty,gt=0"`
+	db.Paginator
+}
+
 type AuditReq struct {
-	SpaceId     int64 `json:"-" binding:"required,gt=0"`
-	AuditUserId int64 `json:"-" binding:"required,gt=0"`
-	ID          int64 `json:"-" binding:"required,gt=0"`
-	Audit       bool  `json:"audit" `
+	SpaceId     int64  `json:"-" binding:"required,gt=0"`
+	AuditUserId int64  `json:"-" binding:"required,gt=0"`
+	ID          int64  `json:"-" binding:"required,gt=0"`
+	Audit       bool   `json:"audit" `
+	Comment     string `json:"comment" binding:"omitempty,max=500"` //审核意见
+}
+
+// ScheduleReq 设置或修改定时发布
+type ScheduleReq struct {
+	SpaceId     int64     `json:"-" binding:"required,gt=0"`
+	UserId      int64     `json:"-" binding:"required,gt=0"`
+	ID          int64     `json:"-" binding:"required,gt=0"`
+	ScheduledAt time.Time `json:"scheduled_at" binding:"required"`
 }
 
 type ConsoleMsg struct {
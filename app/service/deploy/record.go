@@ -12,6 +12,7 @@ import (
 	bytes2 "yema.dev/app/internal/bytes"
 	"yema.dev/app/model"
 	"yema.dev/app/pkg/ssh"
+	"yema.dev/app/service/common"
 )
 
 type Record struct {
@@ -77,11 +78,10 @@ func (r *Record) Run(ctx context.Context) (err error) {
 		command = ssh.NewLocalExec(r.output)
 	} else {
 		r.log.Info("服务器执行命令", zap.String("cmd", r.model.Command), zap.Int64("server", r.model.ServerId))
-		command, err = r.ssh.NewRemoteExec(ssh.ServerConfig{
-			Host: r.server.Host,
-			User: r.server.User,
-			Port: r.server.Port,
-		}, r.output)
+		var sshConf ssh.ServerConfig
+		if sshConf, err = common.SshConfig(r.db, r.server); err == nil {
+			command, err = r.ssh.NewRemoteExec(sshConf, r.output)
+		}
 	}
 	if err == nil {
 		defer func() {
@@ -102,7 +102,11 @@ func (r *Record) Run(ctx context.Context) (err error) {
 		r.model.Status = 0
 	}
 	r.model.RunTime = time.Now().Sub(startT).Milliseconds()
-	return r.save()
+	//命令执行失败时返回执行错误，保存记录失败只记录日志
+	if saveErr := r.save(); err == nil {
+		err = saveErr
+	}
+	return err
 }
 
 func (r *Record) SetSaveTime() {
@@ -0,0 +1,298 @@
+package deploy
+
+import (
+	"context"
+	"encoding/binary"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+	"yema.dev/app/model"
+	"yema.dev/app/model/field"
+	"yema.dev/app/pkg/repo"
+	ssh2 "yema.dev/app/pkg/ssh"
+)
+
+// testRemote 模拟发布服务器的ssh服务，命令在本机执行，
+// 环境变量ROOT为该服务器的根目录，项目目录使用$ROOT区分不同服务器的文件
+type testRemote struct {
+	root    string
+	hostKey string
+	port    int
+}
+
+func newTestRemote(t *testing.T) *testRemote {
+	key, _, err := ssh2.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	r := &testRemote{root: t.TempDir(), hostKey: ssh2.MarshalHostKey(signer.PublicKey()), port: l.Addr().(*net.TCPAddr).Port}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go r.handle(conn, config)
+		}
+	}()
+	return r
+}
+
+func (r *testRemote) handle(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for ch := range chans {
+		channel, requests, err := ch.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				_ = req.Reply(req.Type == "exec", nil)
+				if req.Type == "exec" {
+					go r.exec(channel, string(req.Payload[4:]))
+				}
+			}
+		}()
+	}
+}
+
+func (r *testRemote) exec(channel ssh.Channel, cmd string) {
+	c := exec.Command("sh", "-c", cmd)
+	c.Env = append(os.Environ(), "ROOT="+r.root)
+	c.Stdout, c.Stderr = channel, channel.Stderr()
+	code := 0
+	if err := c.Run(); err != nil {
+		code = 1
+		if e, ok := err.(*exec.ExitError); ok {
+			code = e.ExitCode()
+		}
+	}
+	status := make([]byte, 4)
+	binary.BigEndian.PutUint32(status, uint32(code))
+	_, _ = channel.SendRequest("exit-status", false, status)
+	_ = channel.Close()
+}
+
+// path 服务器上的文件路径
+func (r *testRemote) path(name string) string {
+	return filepath.Join(r.root, name)
+}
+
+// release 模拟服务器上已发布的版本目录
+func (r *testRemote) release(t *testing.T, versions ...string) {
+	for _, version := range versions {
+		if err := os.MkdirAll(r.path("releases/"+version), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// link 模拟服务器当前发布的版本
+func (r *testRemote) link(t *testing.T, version string) {
+	r.release(t, version)
+	if err := os.Symlink(r.path("releases/"+version), r.path("www")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// current 服务器当前发布的版本
+func (r *testRemote) current(t *testing.T) string {
+	dir, err := os.Readlink(r.path("www"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Base(dir)
+}
+
+// newRemoteTask 发布到模拟服务器的任务，服务器按顺序编号
+func newRemoteTask(t *testing.T, m *model.Task, remotes ...*testRemote) *Task {
+	key, _, err := ssh2.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityFile := filepath.Join(t.TempDir(), "id_ecdsa")
+	if err = os.WriteFile(identityFile, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	sshClient, err := ssh2.NewSSH(&ssh2.Config{IdentityFile: identityFile, Timeout: time.Second * 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := newTestDB(t)
+	m.Project.TargetRoot, m.Project.TargetReleases = "$ROOT/www", "$ROOT/releases"
+	for _, r := range remotes {
+		server := model.Server{User: "test", Host: "127.0.0.1", Port: r.port, HostKey: r.hostKey}
+		if err = db.Create(&server).Error; err != nil {
+			t.Fatal(err)
+		}
+		m.Servers = append(m.Servers, server)
+	}
+	if err = db.Omit("Servers").Create(m).Error; err != nil {
+		t.Fatal(err)
+	}
+	repos, err := repo.NewRepos(&repo.Config{RepoDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	task, err := NewTask(m, db, zap.NewNop(), sshClient, repos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task.initDeployDirs(repos.Dir())
+	return task
+}
+
+func TestLoadPrevVersions(t *testing.T) {
+	first, current, other := newTestRemote(t), newTestRemote(t), newTestRemote(t)
+	current.link(t, "1_1_20240101_000000")
+	other.link(t, "1_2_20240102_000000")
+	task := newRemoteTask(t, &model.Task{Name: "release"}, first, current, other)
+	//无法连接的服务器
+	down := model.Server{ID: 100, User: "test", Host: "127.0.0.1", Port: 1}
+	task.steps[down.ID] = &step{}
+	task.taskLogs[down.ID] = task.taskLogs[localServerId]
+
+	prevErrs := task.loadPrevVersions(context.Background(), append(task.servers(), down))
+	if len(prevErrs) != 1 || prevErrs[down.ID] == nil {
+		t.Fatalf("prev errors: %v", prevErrs)
+	}
+	servers := task.servers()
+	for i, want := range []string{"", current.path("releases/1_1_20240101_000000"), other.path("releases/1_2_20240102_000000")} {
+		if v := task.prevVersion(servers[i].ID); v != want {
+			t.Errorf("server %d prev version %q, want %q", i, v, want)
+		}
+	}
+	//上线单的上一个版本取第一台有版本的服务器
+	if m := loadTask(t, &deploy{db: task.db}, task.model.ID); m.PrevVersion != current.path("releases/1_1_20240101_000000") {
+		t.Fatalf("saved prev version %q", m.PrevVersion)
+	}
+
+	//灰度确认时保留灰度发布前的版本
+	task.model.PrevVersion = "canary prev"
+	task.loadPrevVersions(context.Background(), servers)
+	if task.model.PrevVersion != "canary prev" {
+		t.Fatalf("prev version overwritten: %q", task.model.PrevVersion)
+	}
+}
+
+// TestRollbackCheck 回滚前检查所有服务器，有服务器缺少回滚版本时都不切换
+func TestRollbackCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		missing bool
+		current string
+	}{
+		{"all exist", false, "1_1_20240101_000000"},
+		{"one missing", true, "1_2_20240102_000000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, second := newTestRemote(t), newTestRemote(t)
+			first.link(t, "1_2_20240102_000000")
+			first.release(t, "1_1_20240101_000000")
+			second.link(t, "1_2_20240102_000000")
+			if !tt.missing {
+				second.release(t, "1_1_20240101_000000")
+			}
+			task := newRemoteTask(t, &model.Task{Name: "rollback", Version: "1_1_20240101_000000", IsRollback: model.TaskIsRollback}, first, second)
+			err := task.remoteRelease(context.Background())
+			if (err != nil) != tt.missing {
+				t.Fatalf("rollback error: %v", err)
+			}
+			for _, r := range []*testRemote{first, second} {
+				if v := r.current(t); v != tt.current {
+					t.Fatalf("current version %s, want %s", v, tt.current)
+				}
+			}
+		})
+	}
+}
+
+// TestAbortCanaryServers 灰度取消时各灰度服务器回滚到各自发布前的版本
+func TestAbortCanaryServers(t *testing.T) {
+	first, second, other := newTestRemote(t), newTestRemote(t), newTestRemote(t)
+	for _, r := range []*testRemote{first, second} {
+		r.release(t, "1_1_20240101_000000", "1_2_20240102_000000")
+		r.link(t, "1_3_20240103_000000")
+	}
+	other.link(t, "1_2_20240102_000000")
+	m := &model.Task{Name: "canary", Version: "1_3_20240103_000000", Status: model.TaskStatusCanary}
+	task := newRemoteTask(t, m, first, second, other)
+	m.CanaryServerIds = field.Slices[int64]{m.Servers[0].ID, m.Servers[1].ID}
+	m.PrevVersion = first.path("releases/1_1_20240101_000000")
+	m.PrevVersions = model.ServerVersions{
+		m.Servers[0].ID: first.path("releases/1_1_20240101_000000"),
+		m.Servers[1].ID: second.path("releases/1_2_20240102_000000"),
+	}
+	task.stage = stageAbort
+	if err := task.prevRollback(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := task.remoteRelease(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		remote  *testRemote
+		version string
+	}{{first, "1_1_20240101_000000"}, {second, "1_2_20240102_000000"}, {other, "1_2_20240102_000000"}} {
+		if v := c.remote.current(t); v != c.version {
+			t.Errorf("current version %s, want %s", v, c.version)
+		}
+	}
+}
+
+// TestCleanReleasesKeepPrev 只保留一个版本时不删除发布前的版本，健康检查失败时仍然可以回滚
+func TestCleanReleasesKeepPrev(t *testing.T) {
+	r := newTestRemote(t)
+	versions := []string{"1_1_20240101_000000", "1_2_20240102_000000", "1_3_20240103_000000"}
+	r.release(t, versions[0])
+	r.link(t, versions[1])
+	m := &model.Task{Name: "release", Version: versions[2], ProjectId: 1, Project: model.Project{ID: 1, KeepVersionNum: 1}}
+	task := newRemoteTask(t, m, r)
+	server := &m.Servers[0]
+	if prevErrs := task.loadPrevVersions(context.Background(), m.Servers); len(prevErrs) > 0 {
+		t.Fatalf("prev errors: %v", prevErrs)
+	}
+	r.release(t, versions[2])
+	for i, version := range versions {
+		at := time.Now().Add(time.Duration(i-len(versions)) * time.Hour)
+		if err := os.Chtimes(r.path("releases/"+version), at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := task.cleanReleases(context.Background(), server); err != nil {
+		t.Fatal(err)
+	}
+	for i, version := range versions {
+		_, err := os.Stat(r.path("releases/" + version))
+		if exist := err == nil; exist != (i > 0) {
+			t.Errorf("version %s exist %v", version, exist)
+		}
+	}
+}
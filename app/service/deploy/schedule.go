@@ -0,0 +1,76 @@
+package deploy
+
+import (
+	"database/sql"
+	"go.uber.org/zap"
+	"time"
+	"yema.dev/app/model"
+)
+
+// scheduler 定时发布调度，定时时间从数据库读取，服务重启后继续生效
+func (d *deploy) scheduler() {
+	tk := time.NewTicker(d.ScheduleInterval)
+	defer tk.Stop()
+	for {
+		select {
+		case now := <-tk.C:
+			d.startScheduled(now)
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// startScheduled 启动已到定时时间并且审核通过的上线单，启动前先清除定时，避免重复启动
+func (d *deploy) startScheduled(now time.Time) {
+	//与保存的定时时间使用同一时区比较
+	now = now.In(time.Local)
+	due := make([]*model.Task, 0)
+	err := d.db.Where("status = ? and scheduled_at is not null and scheduled_at <= ?", model.TaskStatusAudit, now).
+		Preload("Project").
+		Preload("Environment").
+		Preload("Servers").
+		Order("scheduled_at asc, id asc").
+		Find(&due).Error
+	if err != nil {
+		d.log.Error("读取定时发布任务出错", zap.Error(err))
+		return
+	}
+	for _, taskModel := range due {
+		res := d.db.Model(model.Task{}).
+			Where("id = ? and status = ? and scheduled_at is not null and scheduled_at <= ?", taskModel.ID, model.TaskStatusAudit, now).
+			Update("scheduled_at", nil)
+		if res.Error != nil {
+			d.log.Error("清除定时发布时间出错", zap.Int64("taskId", taskModel.ID), zap.Error(res.Error))
+			continue
+		}
+		//已被取消、修改或者手动发布
+		if res.RowsAffected == 0 {
+			continue
+		}
+		scheduledAt := taskModel.ScheduledAt.Time
+		taskModel.ScheduledAt = sql.NullTime{}
+		//之前启动时的强制发布不沿用
+		taskModel.OverrideUserId, taskModel.OverrideReason = 0, ""
+		err = d.Start(taskModel)
+		if ErrTaskLocked.Has(err) {
+			//同项目有任务正在发布时进入发布队列，等待发布完成后启动
+			d.mux.Lock()
+			err = d.enqueue(taskModel)
+			d.mux.Unlock()
+			if err == nil {
+				d.log.Info("定时发布任务等待同项目的发布完成", zap.Int64("taskId", taskModel.ID))
+				continue
+			}
+		}
+		if err != nil {
+			d.log.Error("启动定时发布任务出错", zap.Int64("taskId", taskModel.ID), zap.Time("scheduledAt", scheduledAt), zap.Error(err))
+			_err := d.db.Model(model.Task{}).Where("id = ?", taskModel.ID).Update("last_error", "定时发布失败："+err.Error()).Error
+			if _err != nil {
+				d.log.Error("更新定时发布任务出错", zap.Int64("taskId", taskModel.ID), zap.Error(_err))
+			}
+			continue
+		}
+		d.log.Info("定时发布任务已启动", zap.Int64("taskId", taskModel.ID), zap.Time("scheduledAt", scheduledAt))
+	}
+}
@@ -0,0 +1,106 @@
+package deploy
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+	"yema.dev/app/model"
+	"yema.dev/app/service/common"
+)
+
+// scheduleTask 设置定时发布时间，at为零值时不设置
+func scheduleTask(t *testing.T, d *deploy, m *model.Task, at time.Time) {
+	err := d.db.Model(m).Update("scheduled_at", sql.NullTime{Time: at, Valid: !at.IsZero()}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStartScheduled(t *testing.T) {
+	d := newQueueDeploy(t, 2)
+	now := time.Now()
+	due := createQueueTask(t, d, &model.Environment{Name: "dev"}, model.TaskStatusAudit)
+	scheduleTask(t, d, due, now.Add(-time.Minute))
+	future := createQueueTask(t, d, &model.Environment{Name: "dev"}, model.TaskStatusAudit)
+	scheduleTask(t, d, future, now.Add(time.Hour))
+	cancelled := createQueueTask(t, d, &model.Environment{Name: "dev"}, model.TaskStatusAudit)
+
+	//同一项目环境有灰度待确认的任务时进入发布队列
+	locked := createQueueTask(t, d, &model.Environment{Name: "dev"}, model.TaskStatusAudit)
+	scheduleTask(t, d, locked, now.Add(-time.Minute))
+	canary := &model.Task{Name: "canary", ProjectId: locked.ProjectId, EnvironmentId: locked.EnvironmentId, Status: model.TaskStatusCanary}
+	if err := d.db.Create(canary).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	d.startScheduled(now)
+	waitIdle(t, d)
+	tests := []struct {
+		name      string
+		id        int64
+		status    int8
+		scheduled bool
+	}{
+		{"due", due.ID, model.TaskStatusReleaseFail, false},
+		{"future", future.ID, model.TaskStatusAudit, true},
+		{"cancelled", cancelled.ID, model.TaskStatusAudit, false},
+		{"locked", locked.ID, model.TaskStatusQueue, false},
+	}
+	for _, tt := range tests {
+		m := loadTask(t, d, tt.id)
+		if m.Status != tt.status || m.ScheduledAt.Valid != tt.scheduled {
+			t.Errorf("%s: status %d scheduled %v, want %d %v", tt.name, m.Status, m.ScheduledAt.Valid, tt.status, tt.scheduled)
+		}
+	}
+}
+
+func TestCancelSchedule(t *testing.T) {
+	srv := newTestService(t)
+	d := srv.deploy
+	env := &model.Environment{Name: "dev"}
+	audit := createQueueTask(t, d, env, model.TaskStatusAudit)
+	scheduleTask(t, d, audit, time.Now().Add(time.Hour))
+	release := createQueueTask(t, d, env, model.TaskStatusRelease)
+	scheduleTask(t, d, release, time.Now().Add(time.Hour))
+
+	if err := srv.CancelSchedule(&common.SpaceWithId{ID: audit.ID}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if m := loadTask(t, d, audit.ID); m.ScheduledAt.Valid {
+		t.Fatal("schedule not cancelled")
+	}
+	//已开始发布的上线单不能取消
+	if err := srv.CancelSchedule(&common.SpaceWithId{ID: release.ID}, 1); err == nil {
+		t.Fatal("cancelled schedule of started task")
+	}
+	if m := loadTask(t, d, release.ID); !m.ScheduledAt.Valid {
+		t.Fatal("schedule of started task cleared")
+	}
+}
+
+// TestScheduleTimezone 其他时区偏移的定时时间不能提前启动
+func TestScheduleTimezone(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("UTC+8", 8*3600)
+	t.Cleanup(func() {
+		time.Local = local
+	})
+	srv := newTestService(t)
+	d := srv.deploy
+	m := createQueueTask(t, d, &model.Environment{Name: "dev"}, model.TaskStatusAudit)
+	at := time.Now().Add(30 * time.Minute).In(time.FixedZone("UTC-5", -5*3600))
+	if err := srv.Schedule(&ScheduleReq{UserId: 1, ID: m.ID, ScheduledAt: at}); err != nil {
+		t.Fatal(err)
+	}
+
+	d.startScheduled(time.Now().UTC())
+	waitIdle(t, d)
+	if m = loadTask(t, d, m.ID); m.Status != model.TaskStatusAudit || !m.ScheduledAt.Valid {
+		t.Fatalf("started before scheduled time: status %d", m.Status)
+	}
+	d.startScheduled(at.Add(time.Minute).UTC())
+	waitIdle(t, d)
+	if m = loadTask(t, d, m.ID); m.Status == model.TaskStatusAudit || m.ScheduledAt.Valid {
+		t.Fatalf("not started after scheduled time: status %d", m.Status)
+	}
+}
@@ -10,24 +10,38 @@ import (
 	"github.com/wuzfei/go-helper/slices"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
+	"net/http"
+	"path/filepath"
+	"regexp"
 	"sync"
 	"time"
 	"yema.dev/app/internal/errcode"
 	"yema.dev/app/model"
 	"yema.dev/app/pkg/repo"
 	"yema.dev/app/pkg/ssh"
+	"yema.dev/app/pkg/webhook"
 	"yema.dev/app/service/common"
+	"yema.dev/app/service/notice"
 	"yema.dev/app/utils"
 )
 
 var (
 	service     *Service
 	onceService sync.Once
+
+	//docker镜像标签规则
+	imageTagRe = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127}$`)
 )
 
 type Config struct {
 	MaxDeploy         int           `help:"最大同时发布数量" default:"10"`
 	MaxReleaseTimeout time.Duration `help:"发布超时时间" default:"10m"`
+	DispatchInterval  time.Duration `help:"发布队列检查间隔" default:"30s"`
+	ScheduleInterval  time.Duration `help:"定时发布检查间隔" default:"30s"`
+	LockServer        bool          `help:"同一服务器同时只允许一个发布任务，默认只限制同一项目环境" default:"false"`
+	ArtifactDir       string        `help:"构建产物缓存目录，为空时不缓存" devDefault:"$ROOT/runtime/artifact" default:"/var/lib/walle/artifact"`
+	ArtifactMaxSize   int64         `help:"构建产物缓存最大容量(MB)" default:"10240"`
+	ArtifactMaxAge    time.Duration `help:"构建产物缓存最长保留时间" default:"168h"`
 }
 
 type Service struct {
@@ -36,17 +50,22 @@ type Service struct {
 	deploy *deploy
 }
 
-func NewService(db *gorm.DB, log *zap.Logger, ssh *ssh.Ssh, repo *repo.Repos, conf *Config) *Service {
+func NewService(db *gorm.DB, log *zap.Logger, ssh *ssh.Ssh, repo *repo.Repos, notice *notice.Service, conf *Config) *Service {
 	onceService.Do(func() {
 		service = &Service{
 			db:     db,
 			log:    log,
-			deploy: newDeploy(db, log, ssh, repo, conf),
+			deploy: newDeploy(db, log, ssh, repo, notice, conf),
 		}
 	})
 	return service
 }
 
+// Close 停止发布调度
+func (srv *Service) Close() {
+	srv.deploy.Close()
+}
+
 func (srv *Service) List(params *ListReq) (total int64, list []*model.Task, err error) {
 	_db := srv.db.Model(&model.Task{}).Where("space_id=?", params.SpaceId)
 	err = _db.Count(&total).Error
@@ -64,13 +83,21 @@ func (srv *Service) List(params *ListReq) (total int64, list []*model.Task, err
 
 // Create 创建上线单
 func (srv *Service) Create(params *CreateReq) error {
+	_, err := srv.create(params)
+	return err
+}
+
+func (srv *Service) create(params *CreateReq) (*model.Task, error) {
 	project := &model.Project{SpaceId: params.SpaceId, ID: params.ProjectId}
 	err := srv.db.Model(&project).Where(project).Preload("Environment").Preload("Servers").First(&project).Error
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if !project.Status.IsEnable() || !project.Environment.Status.IsEnable() {
-		return errors.New("该项目或者该环境暂停上线，请联系相关负责人")
+		return nil, errors.New("该项目或者该环境暂停上线，请联系相关负责人")
+	}
+	if params.ImageTag != "" && (!project.IsDocker() || !imageTagRe.MatchString(params.ImageTag)) {
+		return nil, errcode.ErrRequest.Wrap(errors.New("镜像标签错误，只有docker发布的项目可以指定镜像标签"))
 	}
 	serverIds := slices.Map(project.Servers, func(item model.Server, k int) int64 {
 		return item.ID
@@ -84,13 +111,14 @@ func (srv *Service) Create(params *CreateReq) error {
 		Tag:           params.Tag,
 		Branch:        params.Branch,
 		CommitId:      params.CommitId,
+		ImageTag:      params.ImageTag,
 	}
 	m.Status = model.TaskStatusAudit
-	if project.IsTaskAudit() {
+	if needAudit(project, project.Environment) {
 		m.Status = model.TaskStatusWaiting
 	}
 	servers := make([]model.Server, 0)
-	return srv.db.Transaction(func(tx *gorm.DB) error {
+	err = srv.db.Transaction(func(tx *gorm.DB) error {
 		serverIds = slices.Intersect(serverIds, params.ServerIds)
 		if len(serverIds) == 0 {
 			return errcode.ErrRequest.Wrap(errors.New("服务器选择错误"))
@@ -102,9 +130,74 @@ func (srv *Service) Create(params *CreateReq) error {
 		if len(servers) == 0 {
 			return errcode.ErrRequest.Wrap(errors.New("服务器选择错误"))
 		}
+		if len(params.CanaryServerIds) > 0 {
+			canaryIds := slices.Intersect(serverIds, params.CanaryServerIds)
+			if len(canaryIds) != len(params.CanaryServerIds) || len(canaryIds) >= len(servers) {
+				return errcode.ErrRequest.Wrap(errors.New("灰度服务器必须是发布服务器的一部分"))
+			}
+			m.CanaryServerIds = canaryIds
+		}
 		m.Servers = servers
 		return tx.Create(m).Error
 	})
+	if err != nil {
+		return m, err
+	}
+	m.Environment = *project.Environment
+	srv.deploy.sendNotice(notice.EventTaskCreated, m, project)
+	return m, nil
+}
+
+// Webhook 代码推送时根据项目配置的分支和标签规则自动创建上线单，无需审核且开启自动发布时立即发布
+func (srv *Service) Webhook(projectId int64, header http.Header, body []byte) (*model.Task, error) {
+	project := &model.Project{}
+	if err := srv.db.Preload("Servers").First(project, projectId).Error; err != nil {
+		return nil, err
+	}
+	if !project.IsWebhookEnable() {
+		return nil, errcode.ErrForbidden.New("该项目未开启webhook")
+	}
+	event, err := webhook.Parse(header, body, project.WebhookSecret.String())
+	if err != nil {
+		return nil, err
+	}
+	params := &CreateReq{
+		UserId:    project.UserId,
+		SpaceId:   project.SpaceId,
+		ProjectId: project.ID,
+		ServerIds: slices.Map(project.Servers, func(item model.Server, k int) int64 {
+			return item.ID
+		}),
+	}
+	shortCommit := event.CommitId
+	if len(shortCommit) > 8 {
+		shortCommit = shortCommit[:8]
+	}
+	switch {
+	case event.Tag != "" && webhook.Match(project.WebhookTags, event.Tag):
+		params.Tag = event.Tag
+		params.Name = fmt.Sprintf("webhook：%s", event.Tag)
+	case event.Branch != "" && webhook.Match(project.WebhookBranches, event.Branch):
+		params.Branch = event.Branch
+		params.CommitId = event.CommitId
+		params.Name = fmt.Sprintf("webhook：%s#%s", event.Branch, shortCommit)
+	default:
+		return nil, webhook.ErrIgnored
+	}
+	m, err := srv.create(params)
+	if err != nil {
+		return nil, err
+	}
+	srv.log.Info("webhook创建上线单", zap.Int64("taskId", m.ID), zap.String("provider", event.Provider),
+		zap.String("ref", event.Ref), zap.String("pusher", event.Pusher))
+	if m.Status != model.TaskStatusAudit || project.WebhookAutoRelease != model.ProjectWebhookAutoReleaseEnable {
+		return m, nil
+	}
+	taskDetail, err := srv.getTask(&common.SpaceWithId{SpaceId: m.SpaceId, ID: m.ID}, "Project", "Environment", "Servers")
+	if err != nil {
+		return m, err
+	}
+	return m, srv.deploy.Start(taskDetail)
 }
 
 // Detail 上线单详情
@@ -113,6 +206,10 @@ func (srv *Service) Detail(spaceAndId *common.SpaceWithId) (taskDetail *model.Ta
 	err = srv.db.Where(spaceAndId).
 		Preload("Project").
 		Preload("Servers").
+		Preload("Approvals", func(db *gorm.DB) *gorm.DB { return db.Order("id asc") }).
+		Preload("Approvals.User").
+		Preload("Overrides", func(db *gorm.DB) *gorm.DB { return db.Order("id asc") }).
+		Preload("Overrides.User").
 		First(&taskDetail).
 		Error
 	return
@@ -124,35 +221,186 @@ func (srv *Service) Delete(spaceId int64) (m *model.Space, err error) {
 	return
 }
 
-// Audit 审核
+// Audit 审核，按环境的审核策略记录每个人的审核意见，通过人数满足要求后上线单才审核通过，任意一人拒绝即审核拒绝
 func (srv *Service) Audit(params *AuditReq) (err error) {
 	var m *model.Task
-	err = srv.db.Where("space_id = ? and id = ?", params.SpaceId, params.ID).First(&m).Error
+	err = srv.db.Where("space_id = ? and id = ?", params.SpaceId, params.ID).
+		Preload("Project").
+		Preload("Environment").
+		First(&m).Error
 	if err != nil {
 		return
 	}
 	if m.Status != model.TaskStatusWaiting {
 		return errors.New("审核失败，该上线单并未处于待审核状态")
 	}
+	role, err := srv.memberRole(params.SpaceId, params.AuditUserId)
+	if err != nil {
+		return
+	}
+	if m.UserId == params.AuditUserId {
+		return errors.New("审核失败，不允许审核自己提交的上线单")
+	}
+	if !m.Environment.CanApprove(params.AuditUserId, role) {
+		return errors.New("审核失败，你不在该环境的审核人员范围内")
+	}
+	var exists int64
+	if err = srv.db.Model(model.Approval{}).Where("task_id = ? and user_id = ?", m.ID, params.AuditUserId).Count(&exists).Error; err != nil {
+		return
+	}
+	if exists > 0 {
+		return errors.New("审核失败，你已经审核过该上线单")
+	}
 
-	m.AuditUserId = params.AuditUserId
+	approval := &model.Approval{TaskId: m.ID, UserId: params.AuditUserId, Role: string(role), Comment: params.Comment}
 	if params.Audit {
-		m.Status = model.TaskStatusAudit
-	} else {
-		m.Status = model.TaskStatusReject
+		approval.Approved = model.ApprovalPass
 	}
-	m.AuditTime = sql.NullTime{Time: time.Now(), Valid: true}
-	return srv.db.Select("status", "audit_user_id", "audit_time").Updates(&m).Error
+	status := m.Status
+	err = srv.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(approval).Error; err != nil {
+			return err
+		}
+		if params.Audit {
+			var passed int64
+			err := tx.Model(model.Approval{}).Where("task_id = ? and approved = ?", m.ID, model.ApprovalPass).Count(&passed).Error
+			if err != nil {
+				return err
+			}
+			if int(passed) >= m.Environment.ApprovalRequired() {
+				status = model.TaskStatusAudit
+			}
+		} else {
+			status = model.TaskStatusReject
+		}
+		res := tx.Model(model.Task{}).Where("id = ? and status = ?", m.ID, model.TaskStatusWaiting).Updates(map[string]any{
+			"status":        status,
+			"audit_user_id": params.AuditUserId,
+			"audit_time":    sql.NullTime{Time: time.Now(), Valid: true},
+		})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errors.New("审核失败，该上线单并未处于待审核状态")
+		}
+		return nil
+	})
+	if err != nil || status == model.TaskStatusWaiting {
+		return
+	}
+	m.Status = status
+	event := notice.EventAuditPass
+	if status == model.TaskStatusReject {
+		event = notice.EventAuditReject
+	}
+	srv.deploy.sendNotice(event, m, &m.Project)
+	return
 }
 
-// Release 发布
-func (srv *Service) Release(spaceAndId *common.SpaceWithId, userId int64) (err error) {
+// Release 发布，overrideReason不为空时为负责人强制在发布窗口外发布
+func (srv *Service) Release(spaceAndId *common.SpaceWithId, userId int64, overrideReason string) (err error) {
 	//上线单详情
 	taskDetail, err := srv.getTask(spaceAndId, "Project", "Environment", "Servers")
 	if err != nil {
 		return
 	}
-	return srv.deploy.Start(taskDetail)
+	if err = srv.override(taskDetail, userId, overrideReason); err != nil {
+		return
+	}
+	if err = srv.deploy.Start(taskDetail); err == nil {
+		srv.logOverride(taskDetail)
+	}
+	return
+}
+
+// override 负责人强制在发布窗口外或封版期间发布，只对本次启动有效，发布启动成功后才记录操作人和原因
+func (srv *Service) override(taskDetail *model.Task, userId int64, reason string) error {
+	//清除之前设置的强制发布，避免沿用
+	taskDetail.OverrideUserId = 0
+	taskDetail.OverrideReason = ""
+	if reason == "" {
+		return nil
+	}
+	if len([]rune(reason)) > 500 {
+		return errcode.ErrInvalidParams.New("强制发布原因不能超过500个字符")
+	}
+	role, err := srv.memberRole(taskDetail.SpaceId, userId)
+	if err != nil {
+		return err
+	}
+	if role.Level() < model.RoleOwner.Level() {
+		return errcode.ErrForbidden.New("只有空间负责人可以强制发布")
+	}
+	taskDetail.OverrideUserId = userId
+	taskDetail.OverrideReason = reason
+	return nil
+}
+
+func (srv *Service) logOverride(taskDetail *model.Task) {
+	if taskDetail.OverrideReason == "" {
+		return
+	}
+	srv.log.Warn("负责人强制发布", zap.Int64("taskId", taskDetail.ID), zap.Int64("userId", taskDetail.OverrideUserId),
+		zap.String("environment", taskDetail.Environment.Name), zap.String("reason", taskDetail.OverrideReason))
+}
+
+// memberRole 用户在空间中的角色
+func (srv *Service) memberRole(spaceId, userId int64) (model.Role, error) {
+	if model.IsSuperUser(userId) {
+		return model.RoleSuper, nil
+	}
+	member := model.Member{}
+	err := srv.db.Where("space_id = ? and user_id = ?", spaceId, userId).First(&member).Error
+	return model.Role(member.Role), err
+}
+
+// Schedule 设置定时发布，已设置的重新设置为新的时间，只有审核通过的上线单可以定时发布
+func (srv *Service) Schedule(params *ScheduleReq) (err error) {
+	taskDetail, err := srv.getTask(&common.SpaceWithId{SpaceId: params.SpaceId, ID: params.ID}, "Environment")
+	if err != nil {
+		return
+	}
+	if taskDetail.Status != model.TaskStatusAudit {
+		return errors.New("设置失败，该上线单并未处于审核通过状态")
+	}
+	//sqlite按字符串比较时间，统一转换为本地时区保存，否则其他时区偏移的时间会提前或延后发布
+	scheduledAt := params.ScheduledAt.In(time.Local)
+	if !scheduledAt.After(time.Now()) {
+		return errcode.ErrInvalidParams.New("定时发布时间必须晚于当前时间")
+	}
+	if err = taskDetail.Environment.CheckDeployTime(scheduledAt); err != nil {
+		return errcode.ErrRequest.Wrap(err)
+	}
+	res := srv.db.Model(model.Task{}).Where("id = ? and status = ?", taskDetail.ID, model.TaskStatusAudit).
+		Updates(map[string]any{
+			"scheduled_at":     sql.NullTime{Time: scheduledAt, Valid: true},
+			"schedule_user_id": params.UserId,
+		})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errors.New("设置失败，该上线单状态已变更")
+	}
+	srv.log.Info("设置定时发布", zap.Int64("taskId", taskDetail.ID), zap.Int64("userId", params.UserId),
+		zap.Time("scheduledAt", scheduledAt))
+	return
+}
+
+// CancelSchedule 取消定时发布，只能取消审核通过等待发布的上线单
+func (srv *Service) CancelSchedule(spaceAndId *common.SpaceWithId, userId int64) error {
+	//已开始发布或者已结束的上线单定时已失效，不能再修改
+	res := srv.db.Model(model.Task{}).Where(spaceAndId).Where("status = ? and scheduled_at is not null", model.TaskStatusAudit).
+		Updates(map[string]any{"scheduled_at": nil, "schedule_user_id": 0})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errors.New("取消失败，该上线单未设置定时发布或者已开始发布")
+	}
+	srv.log.Info("取消定时发布", zap.Int64("taskId", spaceAndId.ID), zap.Int64("userId", userId))
+	return nil
 }
 
 // StopRelease 停止发布
@@ -165,12 +413,124 @@ func (srv *Service) StopRelease(spaceAndId *common.SpaceWithId) (err error) {
 	return srv.deploy.Stop(taskDetail.ID)
 }
 
-// Rollback 回滚
-func (srv *Service) Rollback(spaceId int64) (m *model.Space, err error) {
-	err = srv.db.First(&m, spaceId).Error
+// Rollback 回滚，根据已发布上线单记录的上一个版本创建回滚单并发布，需要审核时等待审核通过后再发布
+func (srv *Service) Rollback(spaceAndId *common.SpaceWithId, userId int64) (err error) {
+	taskDetail, err := srv.getTask(spaceAndId, "Project", "Environment", "Servers")
+	if err != nil {
+		return
+	}
+	if taskDetail.Status != model.TaskStatusFinish && taskDetail.Status != model.TaskStatusReleasePartFail {
+		return errors.New("回滚失败，该上线单并未发布完成")
+	}
+	//回滚单所有服务器回滚到同一个版本，各服务器发布前的版本不同时无法回滚
+	version := ""
+	for _, server := range taskDetail.Servers {
+		prevVersion := filepath.Base(taskDetail.ServerPrevVersion(server.ID))
+		if prevVersion == "." {
+			return fmt.Errorf("回滚失败，服务器[%s]没有可回滚的上一个版本", server.Hostname())
+		}
+		if version != "" && prevVersion != version {
+			return fmt.Errorf("回滚失败，各服务器发布前的版本不一致(%s、%s)，请发布指定版本", version, prevVersion)
+		}
+		version = prevVersion
+	}
+	if version == "" {
+		return errors.New("回滚失败，该上线单没有可回滚的上一个版本")
+	}
+	m := &model.Task{
+		Name:          "回滚：" + taskDetail.Name,
+		SpaceId:       taskDetail.SpaceId,
+		UserId:        userId,
+		ProjectId:     taskDetail.ProjectId,
+		EnvironmentId: taskDetail.EnvironmentId,
+		Version:       version,
+		Tag:           taskDetail.Tag,
+		Branch:        taskDetail.Branch,
+		CommitId:      taskDetail.CommitId,
+		IsRollback:    model.TaskIsRollback,
+		Status:        model.TaskStatusAudit,
+		AuditUserId:   userId,
+		AuditTime:     sql.NullTime{Time: time.Now(), Valid: true},
+		Servers:       taskDetail.Servers,
+	}
+	if needAudit(&taskDetail.Project, &taskDetail.Environment) {
+		m.Status = model.TaskStatusWaiting
+		m.AuditUserId = 0
+		m.AuditTime = sql.NullTime{}
+	}
+	if err = srv.db.Create(m).Error; err != nil {
+		return
+	}
+	if m.Status == model.TaskStatusWaiting {
+		srv.deploy.sendNotice(notice.EventTaskCreated, m, &taskDetail.Project)
+		return
+	}
+	rollbackTask, err := srv.getTask(&common.SpaceWithId{SpaceId: m.SpaceId, ID: m.ID}, "Project", "Environment", "Servers")
+	if err != nil {
+		return
+	}
+	return srv.deploy.Start(rollbackTask)
+}
+
+// Promote 灰度确认，继续发布剩余服务器
+func (srv *Service) Promote(spaceAndId *common.SpaceWithId, userId int64, overrideReason string) (err error) {
+	taskDetail, err := srv.getTask(spaceAndId, "Project", "Environment", "Servers")
+	if err != nil {
+		return
+	}
+	if taskDetail.Status != model.TaskStatusCanary {
+		return errors.New("操作失败，该上线单并未处于灰度发布完成状态")
+	}
+	if err = srv.override(taskDetail, userId, overrideReason); err != nil {
+		return
+	}
+	if err = srv.deploy.Promote(taskDetail); err == nil {
+		srv.logOverride(taskDetail)
+	}
+	return
+}
+
+// AbortCanary 取消灰度，灰度服务器回滚到上一个版本
+func (srv *Service) AbortCanary(spaceAndId *common.SpaceWithId, userId int64) (err error) {
+	taskDetail, err := srv.getTask(spaceAndId, "Project", "Environment", "Servers")
+	if err != nil {
+		return
+	}
+	if taskDetail.Status != model.TaskStatusCanary {
+		return errors.New("操作失败，该上线单并未处于灰度发布完成状态")
+	}
+	if taskDetail.PrevVersion == "" {
+		return errors.New("操作失败，灰度服务器没有可回滚的上一个版本")
+	}
+	return srv.deploy.AbortCanary(taskDetail)
+}
+
+// ArtifactList 构建产物缓存列表
+func (srv *Service) ArtifactList(params *ArtifactListReq) (total int64, list []*model.Artifact, err error) {
+	_db := srv.db.Model(&model.Artifact{}).Where(model.Artifact{SpaceId: params.SpaceId, ProjectId: params.ProjectId})
+	err = _db.Count(&total).Error
+	if err != nil || total == 0 {
+		return
+	}
+	err = _db.Scopes(params.PageQuery()).
+		Preload("Project").
+		Order("last_used_at desc").
+		Find(&list).Error
 	return
 }
 
+// ArtifactDelete 删除构建产物缓存
+func (srv *Service) ArtifactDelete(spaceAndId *common.SpaceWithId) (err error) {
+	if srv.deploy.artifacts == nil {
+		return errors.New("未启用构建产物缓存")
+	}
+	m := &model.Artifact{}
+	if err = srv.db.Where(spaceAndId).First(m).Error; err != nil {
+		return
+	}
+	return srv.deploy.artifacts.Remove(m)
+}
+
 // Console 部署日志控制台输出
 func (srv *Service) Console(wsConn *websocket.Conn, spaceAndId *common.SpaceWithId) (err error) {
 	defer func() {
@@ -276,3 +636,8 @@ func (srv *Service) getTask(spaceAndId *common.SpaceWithId, preloads ...string)
 	err := _db.First(&taskDetail).Error
 	return &taskDetail, err
 }
+
+// needAudit 项目开启审核或者环境配置了审核策略时上线单需要审核
+func needAudit(project *model.Project, env *model.Environment) bool {
+	return project.IsTaskAudit() || env.HasApprovalPolicy()
+}
@@ -0,0 +1,169 @@
+package deploy
+
+import (
+	"go.uber.org/zap"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"path/filepath"
+	"testing"
+	"yema.dev/app/model"
+	"yema.dev/app/model/field"
+	"yema.dev/app/service/common"
+)
+
+func newTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AutoMigrate(&model.User{}, &model.Space{}, &model.Member{}, &model.Environment{}, &model.Project{},
+		&model.Server{}, &model.Task{}, &model.TaskServer{}, &model.Approval{}, &model.Record{}, &model.Artifact{}, &model.Override{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func newTestService(t *testing.T) *Service {
+	db := newTestDB(t)
+	log := zap.NewNop()
+	return &Service{db: db, log: log, deploy: &deploy{db: db, log: log, tasks: make(map[int64]*taskRunning)}}
+}
+
+func TestAudit(t *testing.T) {
+	srv := newTestService(t)
+	env := &model.Environment{SpaceId: 1, Name: "prod", ApprovalCount: 2,
+		ApprovalRoles: field.Slices[string]{string(model.RoleMaster)}, ApprovalUserIds: field.Slices[int64]{14}}
+	if err := srv.db.Create(env).Error; err != nil {
+		t.Fatal(err)
+	}
+	roles := map[int64]model.Role{10: model.RoleMaster, 11: model.RoleMaster, 12: model.RoleMaster, 13: model.RoleDeveloper, 14: model.RoleDeveloper}
+	for userId, role := range roles {
+		if err := srv.db.Create(&model.Member{SpaceId: 1, UserId: userId, Role: string(role)}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	newTask := func() int64 {
+		m := &model.Task{SpaceId: 1, UserId: 10, EnvironmentId: env.ID, Name: "task", Status: model.TaskStatusWaiting}
+		if err := srv.db.Create(m).Error; err != nil {
+			t.Fatal(err)
+		}
+		return m.ID
+	}
+	status := func(id int64) int8 {
+		m := model.Task{}
+		if err := srv.db.First(&m, id).Error; err != nil {
+			t.Fatal(err)
+		}
+		return m.Status
+	}
+
+	taskId := newTask()
+	steps := []struct {
+		name    string
+		userId  int64
+		audit   bool
+		success bool
+		status  int8
+	}{
+		{"self approval", 10, true, false, model.TaskStatusWaiting},
+		{"role not allowed", 13, true, false, model.TaskStatusWaiting},
+		{"not member", 20, true, false, model.TaskStatusWaiting},
+		{"first approval", 11, true, true, model.TaskStatusWaiting},
+		{"approve twice", 11, true, false, model.TaskStatusWaiting},
+		{"allowed user", 14, true, true, model.TaskStatusAudit},
+		{"already passed", 12, true, false, model.TaskStatusAudit},
+	}
+	for _, s := range steps {
+		err := srv.Audit(&AuditReq{SpaceId: 1, AuditUserId: s.userId, ID: taskId, Audit: s.audit, Comment: s.name})
+		if (err == nil) != s.success {
+			t.Fatalf("%s: err %v", s.name, err)
+		}
+		if got := status(taskId); got != s.status {
+			t.Fatalf("%s: status %d, want %d", s.name, got, s.status)
+		}
+	}
+	var approvals []model.Approval
+	srv.db.Where("task_id = ?", taskId).Order("id").Find(&approvals)
+	if len(approvals) != 2 || approvals[0].UserId != 11 || approvals[0].Comment != "first approval" || approvals[1].Role != string(model.RoleDeveloper) {
+		t.Fatalf("approvals: %+v", approvals)
+	}
+
+	taskId = newTask()
+	if err := srv.Audit(&AuditReq{SpaceId: 1, AuditUserId: 12, ID: taskId, Audit: false, Comment: "no"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := status(taskId); got != model.TaskStatusReject {
+		t.Fatalf("reject status %d", got)
+	}
+}
+
+func TestNeedAudit(t *testing.T) {
+	cases := []struct {
+		name  string
+		audit int8
+		env   model.Environment
+		need  bool
+	}{
+		{"project audit", model.ProjectTaskAuditEnable, model.Environment{}, true},
+		{"no policy", model.ProjectTaskAuditDisable, model.Environment{}, false},
+		{"env count", model.ProjectTaskAuditDisable, model.Environment{ApprovalCount: 2}, true},
+		{"env roles", model.ProjectTaskAuditDisable, model.Environment{ApprovalRoles: field.Slices[string]{"owner"}}, true},
+		{"env users", model.ProjectTaskAuditDisable, model.Environment{ApprovalUserIds: field.Slices[int64]{1}}, true},
+	}
+	for _, c := range cases {
+		if got := needAudit(&model.Project{TaskAudit: c.audit}, &c.env); got != c.need {
+			t.Errorf("%s: %v", c.name, got)
+		}
+	}
+}
+
+func TestRollbackVersions(t *testing.T) {
+	srv := newTestService(t)
+	servers := []model.Server{{SpaceId: 1, Host: "10.0.0.1"}, {SpaceId: 1, Host: "10.0.0.2"}}
+	for i := range servers {
+		if err := srv.db.Create(&servers[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	s1, s2 := servers[0].ID, servers[1].ID
+	//需要审核时回滚单等待审核，不会直接发布
+	project := &model.Project{SpaceId: 1, Name: "project", TaskAudit: model.ProjectTaskAuditEnable}
+	if err := srv.db.Create(project).Error; err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		prevVersion  string
+		prevVersions model.ServerVersions
+		version      string
+	}{
+		{"same version", "/data/releases/v1", model.ServerVersions{s1: "/data/releases/v1", s2: "/data/releases/v1"}, "v1"},
+		{"different versions", "/data/releases/v1", model.ServerVersions{s1: "/data/releases/v1", s2: "/data/releases/v0"}, ""},
+		{"first release", "/data/releases/v1", model.ServerVersions{s1: "/data/releases/v1", s2: ""}, ""},
+		{"not recorded", "/data/releases/v1", nil, "v1"},
+		{"no version", "", nil, ""},
+	}
+	for _, tt := range tests {
+		m := &model.Task{SpaceId: 1, ProjectId: project.ID, Name: tt.name, Status: model.TaskStatusFinish, Servers: servers,
+			PrevVersion: tt.prevVersion, PrevVersions: tt.prevVersions}
+		if err := srv.db.Create(m).Error; err != nil {
+			t.Fatal(err)
+		}
+		err := srv.Rollback(&common.SpaceWithId{SpaceId: 1, ID: m.ID}, 1)
+		if (err == nil) != (tt.version != "") {
+			t.Fatalf("%s: rollback error %v", tt.name, err)
+		}
+		if err != nil {
+			continue
+		}
+		rollback := model.Task{}
+		if err = srv.db.Where("is_rollback = ?", model.TaskIsRollback).Last(&rollback).Error; err != nil {
+			t.Fatal(err)
+		}
+		if rollback.Version != tt.version || rollback.Status != model.TaskStatusWaiting {
+			t.Errorf("%s: rollback version %s status %d", tt.name, rollback.Version, rollback.Status)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"strings"
+	"yema.dev/app/model"
+	"yema.dev/app/pkg/ssh"
+)
+
+const (
+	defaultServiceWait  = 30 //等待服务启动默认超时时间(秒)
+	defaultJournalLines = 50 //服务失败时默认输出的日志行数
+)
+
+// restartService 发布后重启或重载systemd服务并等待服务正常运行，失败时输出服务最近的日志
+func (t *Task) restartService(ctx context.Context, server *model.Server) error {
+	project := t.model.Project
+	if project.ServiceUnit == "" {
+		return nil
+	}
+	action := project.ServiceAction
+	if action == "" {
+		action = model.ProjectServiceRestart
+	}
+	wait := project.ServiceWaitTimeout
+	if wait <= 0 {
+		wait = defaultServiceWait
+	}
+	lines := project.ServiceJournalLines
+	if lines <= 0 {
+		lines = defaultJournalLines
+	}
+	t.log.Debug("6.1、操作systemd服务", zap.String("server", server.Hostname()), zap.String("unit", project.ServiceUnit), zap.String("action", action))
+	cmd := serviceCommand(project.ServiceUnit, action, project.ServiceSudo == 1, wait, lines)
+	if err := t.newRecordRemote(cmd, server, nil).Run(ctx); err != nil {
+		if ctx.Err() != nil {
+			return ErrStopDeploy
+		}
+		return Error.New("服务%s %s失败：%s", project.ServiceUnit, action, err)
+	}
+	return nil
+}
+
+// serviceCommand 操作服务后每秒检查一次状态，连续两次为active才认为启动成功，避免服务启动后立即退出；
+// 操作失败、服务进入failed状态或者超时都输出最近的日志并返回失败
+func serviceCommand(unit, action string, sudo bool, wait, lines int) string {
+	s := ""
+	if sudo {
+		s = "sudo -n "
+	}
+	u := ssh.ShellQuote(unit)
+	return strings.Join([]string{
+		fmt.Sprintf("%ssystemctl %s %s", s, action, u),
+		"rc=$?",
+		fmt.Sprintf("if [ $rc -eq 0 ]; then rc=1; n=0; end=$(($(date +%%s) + %d)); "+
+			"while [ $(date +%%s) -lt $end ]; do state=$(systemctl is-active %s); "+
+			`if [ "$state" = active ]; then n=$((n + 1)); if [ $n -ge 2 ]; then rc=0; break; fi; else n=0; if [ "$state" = failed ]; then break; fi; fi; `+
+			"sleep 1; done; "+
+			`if [ $rc -ne 0 ]; then echo "服务未能在%d秒内正常运行，当前状态：$state"; fi; fi`, wait, u, wait),
+		fmt.Sprintf(`if [ $rc -ne 0 ]; then echo "---- journalctl -u %s -n %d ----"; %sjournalctl -u %s -n %d --no-pager; exit $rc; fi`, unit, lines, s, u, lines),
+	}, "; ")
+}
@@ -0,0 +1,52 @@
+package deploy
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeSystemd 模拟systemctl和journalctl，服务状态和操作结果由环境变量控制
+func fakeSystemd(t *testing.T) string {
+	dir := t.TempDir()
+	scripts := map[string]string{
+		"systemctl":  "#!/bin/sh\nif [ \"$1\" = is-active ]; then echo \"$UNIT_STATE\"; [ \"$UNIT_STATE\" = active ]; exit $?; fi\nexit ${ACTION_RC:-0}\n",
+		"journalctl": "#!/bin/sh\necho \"unit journal: $*\"\n",
+	}
+	for name, content := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestServiceCommand(t *testing.T) {
+	bin := fakeSystemd(t)
+	cases := []struct {
+		name    string
+		state   string
+		rc      string
+		success bool
+	}{
+		{"active", "active", "0", true},
+		{"failed", "failed", "0", false},
+		{"restart error", "active", "5", false},
+	}
+	cmd := serviceCommand("app.service", "restart", false, 3, 20)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sh := exec.Command("sh", "-c", cmd)
+			sh.Env = append(os.Environ(), "PATH="+bin+":"+os.Getenv("PATH"), "UNIT_STATE="+c.state, "ACTION_RC="+c.rc)
+			out, err := sh.CombinedOutput()
+			if (err == nil) != c.success {
+				t.Fatalf("err: %v\n%s", err, out)
+			}
+			if hasJournal := strings.Contains(string(out), "unit journal: -u app.service -n 20"); hasJournal == c.success {
+				t.Fatalf("journal output: %s", out)
+			}
+		})
+	}
+}
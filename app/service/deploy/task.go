@@ -2,11 +2,14 @@ package deploy
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/wuzfei/go-helper/compress"
 	"github.com/wuzfei/go-helper/files"
+	"github.com/wuzfei/go-helper/slices"
+	"github.com/wuzfei/go-helper/unit"
 	"github.com/zeebo/errs"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -22,39 +25,75 @@ import (
 	"yema.dev/app/model"
 	"yema.dev/app/pkg/repo"
 	"yema.dev/app/pkg/ssh"
+	"yema.dev/app/service/common"
 	"yema.dev/app/utils"
 )
 
 var ErrStopDeploy = Error.New("终止发布任务")
+var ErrBatchAbort = Error.New("前序批次失败服务器超出允许数量，中止发布")
+
+// ErrDeployWindow 不在发布窗口内或处于封版期间
+var ErrDeployWindow = errs.Class("DeployWindow")
 
 var localServerId = int64(0)
 
+const (
+	maxUploadRetry      = 3               //上传程序包最多尝试次数
+	uploadRetryInterval = time.Second * 3 //上传失败重试间隔
+)
+
+const (
+	stageRelease = iota //发布，灰度上线单只发布灰度服务器
+	stagePromote        //灰度确认，发布剩余服务器
+	stageAbort          //灰度取消，灰度服务器回滚到上一个版本
+)
+
 type RemoteErrs struct {
 	sync.Map
 }
 
-func (r RemoteErrs) Error() string {
+func (r *RemoteErrs) Error() string {
 	res := ""
 	r.Range(func(key, value any) bool {
-		res = fmt.Sprintf("[%d]%s;%s", key, value, res)
+		if value != nil {
+			res = fmt.Sprintf("[%d]%s;%s", key, value, res)
+		}
 		return true
 	})
 	return res
 }
 
+// Failed 失败的服务器数量和总数量
+func (r *RemoteErrs) Failed() (failed, total int) {
+	r.Range(func(key, value any) bool {
+		total++
+		if value != nil {
+			failed++
+		}
+		return true
+	})
+	return
+}
+
 type deployDirs struct {
 	localWarehouseDir, //发布时本地代码临时目录
 	localCodePackage, //发布时本地代码压缩包全路径名称
 	remoteReleaseDir, //远程对应版本的代码或程序目录
 	remoteReleasePackage, //远程发布程序目录
-	remoteRootLink string //远程发布程序软连接，比如nginx将指向此地址
+	remoteRootLink, //远程发布程序软连接，比如nginx将指向此地址
+	localManifest, //增量发布时本地文件清单
+	localDeltaDir, //增量发布时本地增量包目录
+	remoteReleaseManifest, //增量发布时远程文件清单
+	remoteReleaseDelta string //增量发布时远程增量包
 }
 
 func (dd *deployDirs) Remove() error {
 	//移除本地目录
 	err := errs.Combine(
 		os.RemoveAll(dd.localWarehouseDir),
-		os.RemoveAll(dd.localCodePackage))
+		os.RemoveAll(dd.localCodePackage),
+		os.RemoveAll(dd.localManifest),
+		os.RemoveAll(dd.localDeltaDir))
 	return err
 }
 
@@ -80,15 +119,36 @@ type Task struct {
 
 	userId         int64 //操作人员
 	model          *model.Task
+	stage          int //发布阶段
 	ReleaseTimeout time.Duration
 
 	started    bool
 	deployDirs *deployDirs
 
-	doneError chan error
+	artifacts   *artifactStore  //构建产物缓存，为nil时不启用
+	artifact    *model.Artifact //本次发布对应的构建产物
+	artifactHit bool            //是否命中构建产物缓存
+
+	doneError  chan error
+	remoteErrs *RemoteErrs //各服务器发布结果
 
 	steps map[int64]*step
 
+	distributions     map[int64]*distribution //服务器程序包来源，没有时由发布机直接推送
+	packageSha256     string                  //服务器间分发时校验程序包
+	distributeKey     []byte                  //服务器间分发的临时私钥，只在本次发布有效
+	distributeAuthKey string                  //临时公钥，写入来源服务器authorized_keys
+	distributeSources sync.Map                //已授权临时公钥的来源服务器，发布结束时撤销
+
+	manifestOnce  sync.Once
+	localManifest manifest //增量发布时本次发布的文件清单
+	manifestErr   error
+	deltaMux      sync.Mutex
+	deltas        map[string]string //上一个版本清单的sha256对应的增量包
+
+	mux          sync.Mutex
+	prevVersions map[int64]string //各服务器发布前的版本，健康检查失败时回滚
+
 	taskLogs map[int64]*bytes.BufferOver
 }
 
@@ -111,6 +171,9 @@ func NewTask(taskModel *model.Task, db *gorm.DB, log *zap.Logger, ssh *ssh.Ssh,
 		model:     taskModel,
 		taskLogs:  taskLogs,
 		steps:     steps,
+		deltas:    make(map[string]string),
+
+		prevVersions: make(map[int64]string),
 	}, nil
 }
 
@@ -134,13 +197,37 @@ func (t *Task) Start(ctx context.Context) (err error) {
 
 	t.started = true
 
-	//更新发布状态和版本
+	//更新发布状态和版本，回滚单的版本在创建时已确定，灰度确认和取消沿用灰度发布的版本
+	fromStatus := []int8{model.TaskStatusAudit, model.TaskStatusQueue}
+	if t.stage != stageRelease {
+		fromStatus = []int8{model.TaskStatusCanary}
+	} else if t.model.ImageTag != "" {
+		t.model.Version = t.model.ImageTag
+	} else if !t.isRollback() {
+		t.model.Version = t.createReleaseVersion()
+	}
 	t.model.Status = model.TaskStatusRelease
-	t.model.Version = t.createReleaseVersion()
-	err = t.db.Model(model.Task{}).Where("id = ? and status=?", t.model.ID, model.TaskStatusAudit).
-		Select("status", "Version").UpdateColumns(t.model).Error
+	//手动发布或者定时发布启动后清除定时
+	t.model.ScheduledAt = sql.NullTime{}
+	err = t.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(model.Task{}).Where("id = ? and status in ?", t.model.ID, fromStatus).
+			Select("status", "Version", "ScheduledAt").UpdateColumns(t.model)
+		if res.Error != nil {
+			return Error.Wrap(res.Error)
+		}
+		//同时启动或者状态已被修改时只有一个能更新成功
+		if res.RowsAffected == 0 {
+			return Error.New("该任务[%d]状态已变更，无法发布", t.model.ID)
+		}
+		if t.model.OverrideReason == "" {
+			return nil
+		}
+		//强制发布启动成功才记录，用于审计
+		override := &model.Override{TaskId: t.model.ID, UserId: t.model.OverrideUserId, Reason: t.model.OverrideReason}
+		return Error.Wrap(tx.Create(override).Error)
+	})
 	if err != nil {
-		return Error.Wrap(err)
+		return err
 	}
 
 	go func() {
@@ -165,16 +252,7 @@ func (t *Task) prevDeploy(ctx context.Context) (err error) {
 	if err != nil {
 		return errors.New("获取代码仓库错误：" + err.Error())
 	}
-	localDeployDir := filepath.Dir(_repo.Path())
-	//发布压缩包名
-	packageName := t.model.Version + ".tar.gz"
-	t.deployDirs = &deployDirs{
-		localWarehouseDir:    filepath.Join(localDeployDir, t.model.Version),
-		localCodePackage:     filepath.Join(localDeployDir, packageName),
-		remoteReleaseDir:     filepath.Join(t.model.Project.TargetReleases, t.model.Version),
-		remoteReleasePackage: filepath.Join(t.model.Project.TargetReleases, packageName),
-		remoteRootLink:       t.model.Project.TargetRoot,
-	}
+	t.initDeployDirs(filepath.Dir(_repo.Path()))
 	//2、执行用户打包前命令
 	t.log.Debug("1.2、执行用户打包前命令")
 	commands := parseCommands(t.model.Project.PrevDeploy)
@@ -197,6 +275,10 @@ func (t *Task) deploy(ctx context.Context) (err error) {
 			t.steps[localServerId].status = 1
 		}
 	}()
+	//docker发布指定了已有镜像时不需要检出代码
+	if t.model.ImageTag != "" {
+		return t.newRecordLocal("use image "+t.image(), nil).Save(0, "success")
+	}
 	//1、检出代码
 	t.log.Debug("2.1、检出代码")
 	_repo, err := t.getRepo()
@@ -214,6 +296,10 @@ func (t *Task) deploy(ctx context.Context) (err error) {
 	if err != nil {
 		return err
 	}
+	//命中构建产物缓存时不需要复制代码和编译
+	if t.lookupArtifact(_repo) {
+		return nil
+	}
 	//2、复制发布版本代码到新目录，以便下面执行编译等操作
 	t.log.Debug("2.2、复制发布版本代码到新目录，以便下面执行编译等操作")
 	if _, err = files.CopyDirToDir(t.deployDirs.localWarehouseDir, _repo.Path()); err != nil {
@@ -233,6 +319,19 @@ func (t *Task) postDeploy(ctx context.Context) (err error) {
 			t.steps[localServerId].status = 1
 		}
 	}()
+	if t.model.Project.IsDocker() {
+		return t.buildImage(ctx)
+	}
+	if t.artifactHit {
+		cmd := fmt.Sprintf("cp %s %s", t.artifact.Path, t.deployDirs.localCodePackage)
+		record := t.newRecordLocal(cmd, nil)
+		record.SetSaveTime()
+		if _, err = files.CopyFileToFile(t.deployDirs.localCodePackage, t.artifact.Path); err != nil {
+			_ = record.Save(254, "复制构建产物出错:"+err.Error())
+			return err
+		}
+		return record.Save(0, "success")
+	}
 	//1、在检出代码执行用户发布前命令
 	t.log.Debug("3.1、在检出代码执行用户发布前命令")
 	commands := parseCommands(t.model.Project.PostDeploy)
@@ -254,26 +353,292 @@ func (t *Task) postDeploy(ctx context.Context) (err error) {
 		return err
 	}
 	_ = record.Save(0, "success")
+	//3、保存构建产物缓存，失败不影响本次发布
+	if t.artifact != nil {
+		if err := t.artifacts.Put(t.artifact, t.deployDirs.localCodePackage); err != nil {
+			t.log.Warn("保存构建产物缓存出错", zap.String("key", t.artifact.Key), zap.Error(err))
+		}
+	}
 	return nil
 }
 
+// lookupArtifact 查找构建产物缓存，命中时记录到发布日志
+func (t *Task) lookupArtifact(_repo repo.Repo) bool {
+	if t.artifacts == nil || t.model.Project.IsDocker() {
+		return false
+	}
+	commitId, err := _repo.CurrentCommit()
+	if err != nil {
+		t.log.Warn("获取当前提交出错，不使用构建产物缓存", zap.Error(err))
+		return false
+	}
+	project := t.model.Project
+	hash := buildHash(&project)
+	t.artifact = &model.Artifact{
+		SpaceId:   t.model.SpaceId,
+		ProjectId: project.ID,
+		TaskId:    t.model.ID,
+		Key:       artifactKey(t.model.SpaceId, project.RepoUrl, commitId, hash),
+		RepoUrl:   project.RepoUrl,
+		CommitId:  commitId,
+		BuildHash: hash,
+	}
+	if cached, ok := t.artifacts.Get(t.artifact.Key); ok {
+		t.artifact = cached
+		t.artifactHit = true
+		_ = t.newRecordLocal(fmt.Sprintf("use artifact %s (commit %s)", cached.Path, commitId), nil).Save(0, "success")
+		return true
+	}
+	return false
+}
+
+// prevPromote step1.灰度确认前检查，直接使用灰度发布时打包的程序包，docker发布使用灰度发布时推送的镜像
+func (t *Task) prevPromote(ctx context.Context) (err error) {
+	t.steps[localServerId].step = 1
+	defer func() {
+		if err != nil {
+			t.steps[localServerId].status = 2
+		} else {
+			t.steps[localServerId].status = 1
+		}
+	}()
+	t.initDeployDirs(t.repo.Dir())
+	if t.model.Project.IsDocker() {
+		return t.newRecordLocal("promote "+t.image(), nil).Save(0, "success")
+	}
+	record := t.newRecordLocal(fmt.Sprintf("promote %s", t.deployDirs.localCodePackage), nil)
+	if _, err = os.Stat(t.deployDirs.localCodePackage); err != nil {
+		_ = record.Save(254, "灰度发布程序包不存在:"+err.Error())
+		return err
+	}
+	return record.Save(0, "success")
+}
+
+// prevRollback step1.回滚前检查，回滚不需要检出和编译代码，直接使用服务器上的历史版本
+func (t *Task) prevRollback(ctx context.Context) (err error) {
+	t.steps[localServerId].step = 1
+	defer func() {
+		if err != nil {
+			t.steps[localServerId].status = 2
+		} else {
+			t.steps[localServerId].status = 1
+		}
+	}()
+	version := t.model.Version
+	if t.stage == stageAbort {
+		version = filepath.Base(t.model.PrevVersion)
+	}
+	if version == "" || version == "." {
+		return errors.New("回滚版本为空")
+	}
+	dirs := &deployDirs{}
+	if t.stage == stageAbort {
+		//灰度取消后不再确认，取消完成时移除灰度发布保留的本地程序包和文件清单
+		t.initDeployDirs(t.repo.Dir())
+		dirs = t.deployDirs
+	}
+	dirs.remoteReleaseDir = filepath.Join(t.model.Project.TargetReleases, version)
+	dirs.remoteRootLink = t.model.Project.TargetRoot
+	t.deployDirs = dirs
+	record := t.newRecordLocal(fmt.Sprintf("rollback to %s", t.deployDirs.remoteReleaseDir), nil)
+	return record.Save(0, "success")
+}
+
 func (t *Task) remoteRelease(ctx context.Context) error {
-	remoteErrs := RemoteErrs{}
+	remoteErrs := &RemoteErrs{}
+	t.remoteErrs = remoteErrs
+	project := t.model.Project
+	servers := t.servers()
+	batches := slices.Split(servers, int64(project.BatchNum(len(servers))))
+	relay := t.prepareDistribute(ctx)
+	prevErrs := t.loadPrevVersions(ctx, servers)
+	for i, batch := range batches {
+		if i > 0 && project.BatchPause > 0 {
+			record := t.newRecordLocal(fmt.Sprintf("sleep %d", project.BatchPause), nil)
+			record.SetSaveTime()
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Duration(project.BatchPause) * time.Second):
+			}
+			_ = record.Save(0, fmt.Sprintf("等待%d秒后发布第%d批", project.BatchPause, i+1))
+		}
+		select {
+		case <-ctx.Done():
+			storeRemoteErr(remoteErrs, batches[i:], ErrStopDeploy)
+			return remoteErrs
+		default:
+		}
+		hosts := slices.Map(batch, func(item model.Server, k int) string {
+			return item.Hostname()
+		})
+		_ = t.newRecordLocal(fmt.Sprintf("release batch %d/%d: %s", i+1, len(batches), strings.Join(hosts, ", ")), nil).
+			Save(0, "success")
+
+		t.distribute(batch, relay)
+		wg := sync.WaitGroup{}
+		for _, s := range batch {
+			wg.Add(1)
+			go func(server model.Server) {
+				if err, ok := prevErrs[server.ID]; ok {
+					remoteErrs.Store(server.ID, err)
+				} else {
+					remoteErrs.Store(server.ID, t.remoteRun(ctx, &server))
+				}
+				wg.Done()
+			}(s)
+		}
+		wg.Wait()
+
+		failed := 0
+		for _, s := range batch {
+			if v, _ := remoteErrs.Load(s.ID); v != nil {
+				failed++
+			}
+		}
+		if failed > project.BatchMaxFail && i < len(batches)-1 {
+			_ = t.newRecordLocal(fmt.Sprintf("abort batch %d/%d", i+2, len(batches)), nil).
+				Save(1, fmt.Sprintf("第%d批失败%d台，超出允许失败数量%d，中止后续批次", i+1, failed, project.BatchMaxFail))
+			storeRemoteErr(remoteErrs, batches[i+1:], ErrBatchAbort)
+			break
+		}
+	}
+	if failed, _ := remoteErrs.Failed(); failed == 0 {
+		return nil
+	}
+	return remoteErrs
+}
+
+// loadPrevVersions 发布前获取各服务器当前的版本，上线单和各服务器的上一个版本只在为空时保存一次，
+// 灰度确认和取消沿用灰度发布前的版本，返回获取失败的服务器，这些服务器不再发布。
+// 回滚时先检查所有服务器的回滚版本，有服务器不能回滚时都不回滚，避免只回滚了部分服务器
+func (t *Task) loadPrevVersions(ctx context.Context, servers []model.Server) map[int64]error {
+	prevErrs := make(map[int64]error)
 	wg := sync.WaitGroup{}
-	for _, s := range t.model.Servers {
+	for _, s := range servers {
 		wg.Add(1)
 		go func(server model.Server) {
-			remoteErrs.Store(server.ID, t.remoteRun(ctx, &server))
-			wg.Done()
+			defer wg.Done()
+			version, err := t.currentVersion(ctx, &server)
+			if err == nil && t.isRollback() {
+				err = t.checkRollback(ctx, &server)
+			}
+			t.mux.Lock()
+			defer t.mux.Unlock()
+			if err != nil {
+				t.steps[server.ID].step, t.steps[server.ID].status = 5, 2
+				prevErrs[server.ID] = err
+				return
+			}
+			t.prevVersions[server.ID] = version
 		}(s)
 	}
 	wg.Wait()
-	return remoteErrs
+	if t.isRollback() && len(prevErrs) > 0 {
+		for _, server := range servers {
+			if _, ok := prevErrs[server.ID]; !ok {
+				t.steps[server.ID].step, t.steps[server.ID].status = 5, 2
+				prevErrs[server.ID] = Error.New("其他服务器无法回滚，已取消回滚")
+			}
+		}
+		return prevErrs
+	}
+	if t.stage == stageAbort {
+		return prevErrs
+	}
+	if t.model.PrevVersions == nil {
+		t.model.PrevVersions = make(model.ServerVersions)
+	}
+	for _, server := range servers {
+		version, ok := t.prevVersions[server.ID]
+		if !ok {
+			continue
+		}
+		if _, ok = t.model.PrevVersions[server.ID]; !ok {
+			t.model.PrevVersions[server.ID] = version
+		}
+		if t.model.PrevVersion == "" {
+			t.model.PrevVersion = version
+		}
+	}
+	t.db.Select("prev_version", "prev_versions").UpdateColumns(t.model)
+	return prevErrs
+}
+
+// rollbackVersion 服务器回滚的版本，灰度取消时各服务器切换回各自灰度发布前的版本
+func (t *Task) rollbackVersion(serverId int64) string {
+	if t.stage != stageAbort {
+		return t.model.Version
+	}
+	version := t.model.ServerPrevVersion(serverId)
+	if version == "" {
+		return ""
+	}
+	return filepath.Base(version)
+}
+
+// rollbackDir 服务器回滚的版本目录
+func (t *Task) rollbackDir(serverId int64) string {
+	return filepath.Join(t.model.Project.TargetReleases, t.rollbackVersion(serverId))
+}
+
+// checkRollback 检查服务器上回滚版本的目录是否还存在，docker发布时镜像在替换容器前拉取
+func (t *Task) checkRollback(ctx context.Context, server *model.Server) error {
+	if t.rollbackVersion(server.ID) == "" {
+		return Error.New("服务器没有可回滚的上一个版本")
+	}
+	if t.model.Project.IsDocker() {
+		return nil
+	}
+	dir := t.rollbackDir(server.ID)
+	record := t.newRecordRemote(fmt.Sprintf("[ -d %s ]", dir), server, t.envs())
+	if err := record.Run(ctx); err != nil {
+		return Error.New("回滚版本目录[%s]不存在", dir)
+	}
+	return nil
+}
+
+// currentVersion 服务器当前发布的版本目录，docker发布时为当前容器的镜像标签，还没有发布过时为空
+func (t *Task) currentVersion(ctx context.Context, server *model.Server) (string, error) {
+	if t.model.Project.IsDocker() {
+		return t.currentImageTag(ctx, server)
+	}
+	t.log.Debug("5.1、获取上一个部署版本，保存下来", zap.String("server", server.Hostname()))
+	cmd := fmt.Sprintf("[ -L %s ] && readlink %s || echo \"\"", t.deployDirs.remoteRootLink, t.deployDirs.remoteRootLink)
+	record := t.newRecordRemote(cmd, server, t.envs())
+	if err := record.Run(ctx); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(record.Output()), nil
+}
+
+// prevVersion 服务器发布前的版本
+func (t *Task) prevVersion(serverId int64) string {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.prevVersions[serverId]
+}
+
+// storeRemoteErr 未执行发布的服务器记录为失败
+func storeRemoteErr(remoteErrs *RemoteErrs, batches [][]model.Server, err error) {
+	for _, batch := range batches {
+		for _, s := range batch {
+			remoteErrs.Store(s.ID, err)
+		}
+	}
 }
 
 // remoteRun 远程服务器执行部署
 func (t *Task) remoteRun(ctx context.Context, server *model.Server) error {
-	for _, f := range []func(ctx2 context.Context, server *model.Server) error{t.prevRelease, t.release, t.postRelease} {
+	steps := []func(ctx2 context.Context, server *model.Server) error{t.prevRelease, t.release, t.postRelease, t.healthCheck}
+	clean := t.cleanReleases
+	if t.model.Project.IsDocker() {
+		steps = []func(ctx2 context.Context, server *model.Server) error{t.dockerPull, t.dockerRelease, t.postRelease, t.healthCheck}
+		clean = t.cleanImages
+	} else if t.isRollback() {
+		//回滚只需要切换软链接，然后执行发布后命令
+		steps = []func(ctx2 context.Context, server *model.Server) error{t.release, t.postRelease, t.healthCheck}
+	}
+	for _, f := range steps {
 		select {
 		case <-ctx.Done():
 			return ErrStopDeploy
@@ -283,6 +648,10 @@ func (t *Task) remoteRun(ctx context.Context, server *model.Server) error {
 			}
 		}
 	}
+	//清理历史版本失败不影响本次发布结果
+	if err := clean(ctx, server); err != nil {
+		t.log.Warn("清理历史版本出错", zap.String("server", server.Hostname()), zap.Error(err))
+	}
 	return nil
 }
 
@@ -302,27 +671,8 @@ func (t *Task) prevRelease(ctx context.Context, server *model.Server) (err error
 	//if err := r.Run(t.ctx); err != nil {
 	//	return err
 	//}
-	//1、上传程序包
-	t.log.Debug("4.1、上传程序包", zap.String("server", server.Hostname()))
-	_saveCmd := fmt.Sprintf("scp -P%d %s@%s:%s %s:%s", server.Port, utils.CurrentUser.Username, utils.CurrentHostname, t.deployDirs.localCodePackage, server.Hostname(), t.deployDirs.remoteReleasePackage)
-	record := t.newRecordRemote(_saveCmd, server, nil)
-	record.SetSaveTime()
-	sftp, err := t.ssh.NewSftp(ssh.ServerConfig{Host: server.Host, User: server.User, Port: server.Port})
-	if err == nil {
-		err = sftp.Copy(t.deployDirs.localCodePackage, t.deployDirs.remoteReleasePackage)
-		sftp.Close()
-	}
-	if err != nil {
-		_ = record.Save(254, "上传程序出错:"+err.Error())
-		return err
-	}
-	_ = record.Save(0, "success")
-
-	//2、解压程序包
-	t.log.Debug("4.2、在服务器解压程序包", zap.String("server", server.Hostname()))
-	_tarCmd := fmt.Sprintf("mkdir -p %s && tar -zxvf %s -C %s", t.deployDirs.remoteReleaseDir, t.deployDirs.remoteReleasePackage, t.deployDirs.remoteReleaseDir)
-	r := t.newRecordRemote(_tarCmd, server, t.envs())
-	if err = r.Run(ctx); err != nil {
+	//1、上传并解压程序包
+	if err = t.syncPackage(ctx, server); err != nil {
 		return err
 	}
 	//3、执行用户命令
@@ -330,7 +680,7 @@ func (t *Task) prevRelease(ctx context.Context, server *model.Server) (err error
 	commands := parseCommands(t.model.Project.PrevRelease)
 	for _, cmd := range commands {
 		cmd = fmt.Sprintf("cd %s && %s", t.deployDirs.remoteReleaseDir, cmd)
-		r = t.newRecordRemote(cmd, server, t.envs())
+		r := t.newRecordRemote(cmd, server, t.envs())
 		if err = r.Run(ctx); err != nil {
 			return err
 		}
@@ -338,6 +688,120 @@ func (t *Task) prevRelease(ctx context.Context, server *model.Server) (err error
 	return nil
 }
 
+// syncPackage 增量发布时只传输有变化的文件，失败时改为上传完整程序包
+func (t *Task) syncPackage(ctx context.Context, server *model.Server) error {
+	if t.model.Project.IsIncremental() {
+		err := t.syncIncremental(ctx, server)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ErrStopDeploy
+		}
+		t.taskLogs[server.ID].Write([]byte(fmt.Sprintf("增量发布失败：%s，改为上传完整程序包\r\n", err)))
+	}
+	return t.transferPackage(ctx, server)
+}
+
+// transferPackage 上传完整程序包并解压，开启服务器间分发时从分发来源拉取，失败时改为直接推送
+func (t *Task) transferPackage(ctx context.Context, server *model.Server) (err error) {
+	dist := t.distributions[server.ID]
+	pulled := false
+	if dist != nil && dist.source.ID != server.ID {
+		if err = t.pull(ctx, server, dist); err != nil && ctx.Err() != nil {
+			return ErrStopDeploy
+		}
+		if pulled = err == nil; !pulled {
+			t.taskLogs[server.ID].Write([]byte(fmt.Sprintf("从%s拉取程序包失败：%s，改为直接推送\r\n", dist.source.Hostname(), err)))
+			dist = nil
+		}
+	}
+	if !pulled {
+		t.log.Debug("4.1、上传程序包", zap.String("server", server.Hostname()))
+		_saveCmd := fmt.Sprintf("scp -P%d %s@%s:%s %s:%s", server.Port, utils.CurrentUser.Username, utils.CurrentHostname, t.deployDirs.localCodePackage, server.Hostname(), t.deployDirs.remoteReleasePackage)
+		record := t.newRecordRemote(_saveCmd, server, nil)
+		record.SetSaveTime()
+		result, err := t.upload(ctx, server, t.deployDirs.localCodePackage, t.deployDirs.remoteReleasePackage, t.taskLogs[server.ID])
+		if dist != nil {
+			dist.done(err)
+		}
+		if err != nil {
+			_ = record.Save(254, "上传程序出错:"+err.Error())
+			return err
+		}
+		_ = record.Save(0, fmt.Sprintf("success, size: %d, sha256: %s", result.Size, result.Sha256))
+	}
+
+	//2、解压程序包
+	t.log.Debug("4.2、在服务器解压程序包", zap.String("server", server.Hostname()))
+	r := t.newRecordRemote(unpackCommand(t.deployDirs.remoteReleaseDir, t.deployDirs.remoteReleasePackage), server, t.envs())
+	if err = r.Run(ctx); err != nil {
+		return err
+	}
+	//增量发布时保存文件清单，供下次发布对比，失败只影响下次发布改为全量
+	if t.model.Project.IsIncremental() {
+		if _, err := t.manifest(); err == nil {
+			err = t.uploadFile(ctx, server, t.deployDirs.localManifest, t.deployDirs.remoteReleaseManifest)
+		}
+		if err != nil {
+			t.log.Warn("上传文件清单出错", zap.String("server", server.Hostname()), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// unpackCommand 清空版本目录后解压完整程序包，增量发布失败时目录中可能残留部分文件
+func unpackCommand(releaseDir, pkg string) string {
+	return fmt.Sprintf("rm -rf %[1]s && mkdir -p %[1]s && tar -zxvf %[2]s -C %[1]s", releaseDir, pkg)
+}
+
+// upload 上传程序包，失败时重新连接并从已上传的位置续传，上传进度输出到发布日志
+func (t *Task) upload(ctx context.Context, server *model.Server, localFile, remoteFile string, output io.Writer) (result *ssh.UploadResult, err error) {
+	sshConf, err := common.SshConfig(t.db, server)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < maxUploadRetry; i++ {
+		if i > 0 {
+			output.Write([]byte(fmt.Sprintf("上传失败：%s，%s后第%d次重试\r\n", err, uploadRetryInterval, i)))
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(uploadRetryInterval):
+			}
+		}
+		var sftp *ssh.Sftp
+		if sftp, err = t.ssh.NewSftp(sshConf); err != nil {
+			continue
+		}
+		lastPercent := int64(-1)
+		result, err = sftp.Upload(localFile, remoteFile, func(uploaded, total int64) {
+			percent := int64(100)
+			if total > 0 {
+				percent = uploaded * 100 / total
+			}
+			//每5%输出一次进度
+			if percent/5 == lastPercent/5 {
+				return
+			}
+			lastPercent = percent
+			output.Write([]byte(fmt.Sprintf("上传进度：%s/%s %d%%\r\n", unit.ByteFormat(uploaded, 2), unit.ByteFormat(total, 2), percent)))
+		})
+		_ = sftp.Close()
+		if err == nil {
+			if result.Resumed > 0 {
+				output.Write([]byte(fmt.Sprintf("断点续传，已上传：%s\r\n", unit.ByteFormat(result.Resumed, 2))))
+			}
+			output.Write([]byte("sha256校验通过：" + result.Sha256 + "\r\n"))
+			return result, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return nil, err
+}
+
 // release step5.部署程序
 func (t *Task) release(ctx context.Context, server *model.Server) (err error) {
 	t.steps[server.ID].step = 5
@@ -348,32 +812,24 @@ func (t *Task) release(ctx context.Context, server *model.Server) (err error) {
 			t.steps[server.ID].status = 1
 		}
 	}()
-	//1、获取上一个部署版本，保存下来
-	t.log.Debug("5.1、获取上一个部署版本，保存下来", zap.String("server", server.Hostname()))
-	cmd := fmt.Sprintf("[ -L %s ] && readlink %s || echo \"\"", t.deployDirs.remoteRootLink, t.deployDirs.remoteRootLink)
-	record := t.newRecordRemote(cmd, server, t.envs())
-	if err = record.Run(ctx); err != nil {
-		return err
+	//回滚版本目录在发布前已检查
+	releaseDir := t.deployDirs.remoteReleaseDir
+	if t.isRollback() {
+		releaseDir = t.rollbackDir(server.ID)
 	}
-	t.model.PrevVersion = record.Output()
-
 	//2、部署代码，创建并替换源软连接
 	t.log.Debug("5.2、部署代码，创建并替换源软连接", zap.String("server", server.Hostname()))
 	tmpLink := fmt.Sprintf("%s_tmp", t.deployDirs.remoteRootLink)
-	cmd = fmt.Sprintf("mkdir -p %s && ln -sfn %s %s", filepath.Dir(t.deployDirs.remoteRootLink), t.deployDirs.remoteReleaseDir, tmpLink)
-	record = t.newRecordRemote(cmd, server, t.envs())
+	cmd := fmt.Sprintf("mkdir -p %s && ln -sfn %s %s", filepath.Dir(t.deployDirs.remoteRootLink), releaseDir, tmpLink)
+	record := t.newRecordRemote(cmd, server, t.envs())
 	if err = record.Run(ctx); err != nil {
 		return err
 	}
 
-	t.log.Debug("5.3、更新数据库记录", zap.String("server", server.Hostname()))
+	t.log.Debug("5.3、替换软连接", zap.String("server", server.Hostname()))
 	cmd = fmt.Sprintf("mv -fT %s %s", tmpLink, t.deployDirs.remoteRootLink)
 	record = t.newRecordRemote(cmd, server, t.envs())
-	if err = record.Run(ctx); err != nil {
-		return err
-	}
-	t.db.Select("prev_version").UpdateColumns(t.model)
-	return nil
+	return record.Run(ctx)
 }
 
 // postRelease 6、执行部署完成功后用户相关命令
@@ -386,10 +842,17 @@ func (t *Task) postRelease(ctx context.Context, server *model.Server) (err error
 			t.steps[server.ID].status = 1
 		}
 	}()
-	t.log.Debug("6.1、执行部署完成功后用户相关命令", zap.String("server", server.Hostname()))
+	//1、重启服务，失败时不再执行用户命令
+	if err = t.restartService(ctx, server); err != nil {
+		return err
+	}
+	t.log.Debug("6.2、执行部署完成功后用户相关命令", zap.String("server", server.Hostname()))
 	commands := parseCommands(t.model.Project.PostRelease)
 	for _, cmd := range commands {
-		cmd = fmt.Sprintf("cd %s && %s", t.deployDirs.remoteRootLink, cmd)
+		//docker发布没有发布目录
+		if !t.model.Project.IsDocker() {
+			cmd = fmt.Sprintf("cd %s && %s", t.deployDirs.remoteRootLink, cmd)
+		}
 		r := t.newRecordRemote(cmd, server, t.envs())
 		if err = r.Run(ctx); err != nil {
 			return err
@@ -398,10 +861,44 @@ func (t *Task) postRelease(ctx context.Context, server *model.Server) (err error
 	return nil
 }
 
+// cleanReleases 清理服务器上的历史版本，保留最新的KeepVersionNum个版本以及当前版本和发布前的版本
+func (t *Task) cleanReleases(ctx context.Context, server *model.Server) (err error) {
+	keepNum := t.model.Project.KeepVersionNum
+	if keepNum <= 0 {
+		return nil
+	}
+	t.log.Debug("6.3、清理历史版本", zap.String("server", server.Hostname()))
+	releasesDir := t.model.Project.TargetReleases
+	cmd := fmt.Sprintf("[ -d %s ] && ls -1t %s || echo \"\"", releasesDir, releasesDir)
+	record := t.newRecordRemote(cmd, server, nil)
+	if err = record.Run(ctx); err != nil {
+		return err
+	}
+	current := filepath.Base(t.deployDirs.remoteReleaseDir)
+	if t.isRollback() {
+		current = t.rollbackVersion(server.ID)
+	}
+	for _, version := range expiredVersions(record.Output(), t.model.Project.ID, keepNum, t.keepVersions(server.ID, current)) {
+		dir := filepath.Join(releasesDir, version)
+		cmd = fmt.Sprintf("rm -rf %s %s %s %s", dir, dir+".tar.gz", dir+manifestSuffix, dir+deltaSuffix)
+		record = t.newRecordRemote(cmd, server, nil)
+		if err = record.Run(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (t *Task) start(ctx context.Context) {
 	var err error
+	steps := []func(ctx2 context.Context) error{t.prevDeploy, t.deploy, t.postDeploy, t.remoteRelease}
+	if t.isRollback() {
+		steps = []func(ctx2 context.Context) error{t.prevRollback, t.remoteRelease}
+	} else if t.stage == stagePromote {
+		steps = []func(ctx2 context.Context) error{t.prevPromote, t.remoteRelease}
+	}
 loopFor:
-	for _, f := range []func(ctx2 context.Context) error{t.prevDeploy, t.deploy, t.postDeploy, t.remoteRelease} {
+	for _, f := range steps {
 		select {
 		case <-ctx.Done():
 			err = ErrStopDeploy
@@ -466,38 +963,42 @@ func (t *Task) Wait() error {
 	}
 
 	t.model.Status = model.TaskStatusFinish
+	if doneErr == nil && t.stage == stageRelease && t.isCanary() {
+		//灰度服务器发布成功，等待确认
+		t.model.Status = model.TaskStatusCanary
+	}
+	if doneErr == nil && t.stage == stageAbort {
+		t.model.Status = model.TaskStatusCanaryAbort
+	}
 	if doneErr != nil {
 		t.model.LastError = doneErr.Error()
 		t.model.Status = model.TaskStatusReleaseFail
+		if re, ok := doneErr.(*RemoteErrs); ok {
+			if failed, total := re.Failed(); failed < total {
+				t.model.Status = model.TaskStatusReleasePartFail
+			}
+		}
+	}
+	//更新各服务器发布状态
+	if t.remoteErrs != nil {
 		updates := make([]*model.TaskServer, 0)
-		if re, ok := doneErr.(RemoteErrs); ok {
-			t.model.Status = model.TaskStatusReleasePartFail
-			re.Range(func(key, value any) bool {
-				if value != nil {
-					updates = append(updates, &model.TaskServer{
-						TaskId:   t.model.ID,
-						ServerId: key.(int64),
-						Status:   model.TaskServerStatusFail,
-						Err:      value.(error).Error(),
-					})
-				} else {
-					updates = append(updates, &model.TaskServer{
-						TaskId:   t.model.ID,
-						ServerId: key.(int64),
-						Status:   model.TaskServerStatusSuccess,
-					})
-				}
-				return true
-			})
-		} else {
-			for _, s := range t.model.Servers {
+		t.remoteErrs.Range(func(key, value any) bool {
+			if value != nil {
 				updates = append(updates, &model.TaskServer{
 					TaskId:   t.model.ID,
-					ServerId: s.ID,
+					ServerId: key.(int64),
+					Status:   model.TaskServerStatusFail,
+					Err:      value.(error).Error(),
+				})
+			} else {
+				updates = append(updates, &model.TaskServer{
+					TaskId:   t.model.ID,
+					ServerId: key.(int64),
 					Status:   model.TaskServerStatusSuccess,
 				})
 			}
-		}
+			return true
+		})
 		_err := t.db.Clauses(clause.OnConflict{
 			Columns:   []clause.Column{{Name: "task_id"}, {Name: "server_id"}},
 			DoUpdates: clause.AssignmentColumns([]string{"status", "err"}),
@@ -509,12 +1010,22 @@ func (t *Task) Wait() error {
 	}
 	mb, _ := json.Marshal(t.model)
 
-	err := t.deployDirs.Remove()
-	if err != nil {
-		t.log.Error("发布完成移除临时文件目录出错", zap.Error(err), zap.Object("deployDirs", t.deployDirs))
+	if t.deployDirs != nil {
+		var err error
+		if t.model.Status == model.TaskStatusCanary {
+			//保留程序包，灰度确认后继续发布剩余服务器
+			err = os.RemoveAll(t.deployDirs.localWarehouseDir)
+		} else {
+			err = t.deployDirs.Remove()
+		}
+		if err != nil {
+			t.log.Error("发布完成移除临时文件目录出错", zap.Error(err), zap.Object("deployDirs", t.deployDirs))
+		}
 	}
 
-	if err = t.db.Model(model.Task{}).
+	t.revokeDistributeKey()
+
+	if err := t.db.Model(model.Task{}).
 		Select("status", "last_error").Where("id = ?", t.model.ID).UpdateColumns(t.model).Error; err != nil {
 		t.log.Error("部署完成，更新数据库时出错", zap.ByteString("task_model", mb), zap.Error(doneErr), zap.Error(err))
 	} else {
@@ -524,7 +1035,7 @@ func (t *Task) Wait() error {
 }
 
 func (t *Task) envs() *ssh.Envs {
-	_envs := ssh.NewEnvsBySliceKV(parseCommands(t.model.Project.TaskVars))
+	_envs := ssh.NewEnvsBySliceKV(parseCommands(t.model.Project.TaskVars.String()))
 	//_envs := NewEnvs()
 	_envs.Add("PROJECT_ID", t.model.Project.ID)
 	_envs.Add("PROJECT_NAME", t.model.Project.Name)
@@ -532,6 +1043,9 @@ func (t *Task) envs() *ssh.Envs {
 	_envs.Add("TASK_NAME", t.model.Name)
 	//_envs.Add("DEPLOY_PATH", t.deployPath)
 	_envs.Add("RELEASE_PATH", &t.model.Project.TargetRoot)
+	if t.model.Project.IsDocker() {
+		_envs.Add("IMAGE", t.image())
+	}
 	return _envs
 }
 
@@ -557,8 +1071,7 @@ func (t *Task) getFileMatch() compress.Match {
 }
 
 func (t *Task) getRepo() (repo.Repo, error) {
-	fmt.Println(repo.TypeRepo(t.model.Project.RepoType), t.model.Project.RepoUrl, fmt.Sprintf("%d", t.model.Project.ID))
-	return t.repo.New(repo.TypeRepo(t.model.Project.RepoType), t.model.Project.RepoUrl, fmt.Sprintf("%d", t.model.Project.ID))
+	return common.NewRepo(t.repo, &t.model.Project)
 }
 
 func (t *Task) newRecordLocal(cmd string, envs *ssh.Envs) *Record {
@@ -579,6 +1092,46 @@ func (t *Task) newRecordRemote(cmd string, server *model.Server, envs *ssh.Envs)
 	return NewRecordRemote(t.db, t.log, t.ssh, t.model.ID, t.userId, cmd, server, envs, t.taskLogs[server.ID])
 }
 
+func (t *Task) isRollback() bool {
+	return t.model.IsRollback == model.TaskIsRollback || t.stage == stageAbort
+}
+
+func (t *Task) isCanary() bool {
+	return len(t.model.CanaryServerIds) > 0
+}
+
+// servers 当前发布阶段需要发布的服务器
+func (t *Task) servers() []model.Server {
+	if !t.isCanary() {
+		return t.model.Servers
+	}
+	return slices.FilterFunc(t.model.Servers, func(v model.Server) bool {
+		isCanary := slices.Contains(t.model.CanaryServerIds, v.ID)
+		if t.stage == stagePromote {
+			return !isCanary
+		}
+		return isCanary
+	})
+}
+
+// initDeployDirs 设置本地和远程发布目录
+func (t *Task) initDeployDirs(localDeployDir string) {
+	//发布压缩包名
+	packageName := t.model.Version + ".tar.gz"
+	t.deployDirs = &deployDirs{
+		localWarehouseDir:    filepath.Join(localDeployDir, t.model.Version),
+		localCodePackage:     filepath.Join(localDeployDir, packageName),
+		remoteReleaseDir:     filepath.Join(t.model.Project.TargetReleases, t.model.Version),
+		remoteReleasePackage: filepath.Join(t.model.Project.TargetReleases, packageName),
+		remoteRootLink:       t.model.Project.TargetRoot,
+
+		localManifest:         filepath.Join(localDeployDir, t.model.Version+manifestSuffix),
+		localDeltaDir:         filepath.Join(localDeployDir, t.model.Version+"_delta"),
+		remoteReleaseManifest: filepath.Join(t.model.Project.TargetReleases, t.model.Version+manifestSuffix),
+		remoteReleaseDelta:    filepath.Join(t.model.Project.TargetReleases, t.model.Version+deltaSuffix),
+	}
+}
+
 func (t *Task) createReleaseVersion() string {
 	return fmt.Sprintf("%d_%d_%s", t.model.Project.ID, t.model.ID, time.Now().Format("20060102_150405"))
 }
@@ -601,9 +1154,43 @@ func parseCommands(commands string) []string {
 	return res
 }
 
+// keepVersions 清理时不论数量都要保留的版本：服务器当前的版本，以及发布前的版本，健康检查失败、取消灰度和回滚时使用
+func (t *Task) keepVersions(serverId int64, current string) []string {
+	return []string{current, filepath.Base(t.prevVersion(serverId)), filepath.Base(t.model.ServerPrevVersion(serverId)),
+		filepath.Base(t.model.PrevVersion)}
+}
+
+// expiredVersions 从按修改时间倒序的目录列表中找出需要清理的版本，只处理本项目的版本目录和程序包，keep中的版本始终保留
+func expiredVersions(list string, projectId int64, keepNum int, keep []string) []string {
+	prefix := fmt.Sprintf("%d_", projectId)
+	versions := make([]string, 0)
+	for _, v := range strings.Split(list, "\n") {
+		v = strings.TrimSpace(v)
+		for _, suffix := range []string{deltaSuffix, ".tar.gz", manifestSuffix} {
+			v = strings.TrimSuffix(v, suffix)
+		}
+		if !strings.HasPrefix(v, prefix) || slices.Contains(versions, v) {
+			continue
+		}
+		versions = append(versions, v)
+	}
+	res := make([]string, 0)
+	for i, v := range versions {
+		if i < keepNum || slices.Contains(keep, v) {
+			continue
+		}
+		res = append(res, v)
+	}
+	return res
+}
+
 // check 检查基本状态是否可以发布上线
 func (t *Task) check() error {
-	if t.model.Status != model.TaskStatusAudit {
+	if t.stage != stageRelease {
+		if t.model.Status != model.TaskStatusCanary {
+			return errors.New("任务未处于灰度发布完成状态，无法继续操作")
+		}
+	} else if t.model.Status != model.TaskStatusAudit && t.model.Status != model.TaskStatusQueue {
 		return errors.New("任务未处于审核通过状态，无法发布")
 	}
 	if !t.model.Environment.Status.IsEnable() {
@@ -612,7 +1199,13 @@ func (t *Task) check() error {
 	if !t.model.Project.Status.IsEnable() {
 		return fmt.Errorf("该项目[%s]已经禁止发版，请联系相关负责人处理", t.model.Project.Name)
 	}
-	if len(t.model.Servers) == 0 {
+	//回滚和取消灰度用于恢复服务，不受发布窗口限制，负责人填写了原因的可以强制发布
+	if !t.isRollback() && t.model.OverrideReason == "" {
+		if err := t.model.Environment.CheckDeployTime(time.Now()); err != nil {
+			return ErrDeployWindow.Wrap(err)
+		}
+	}
+	if len(t.servers()) == 0 {
 		return fmt.Errorf("该任务[%s]发布服务器为空，请联系相关负责人处理", t.model.Name)
 	}
 	return nil
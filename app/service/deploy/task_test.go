@@ -0,0 +1,215 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"github.com/wuzfei/go-helper/slices"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"yema.dev/app/model"
+	"yema.dev/app/model/field"
+	"yema.dev/app/pkg/repo"
+)
+
+// newCanaryTask 灰度发布完成等待确认的任务，本地保留了程序包和文件清单
+func newCanaryTask(t *testing.T, stage int, deployType string) (*Task, string) {
+	repos, err := repo.NewRepos(&repo.Config{RepoDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &model.Task{ID: 1, Version: "1_1_20240102_150405", PrevVersion: "/data/releases/1_0_20240101_150405",
+		Status: model.TaskStatusCanary, CanaryServerIds: field.Slices[int64]{1},
+		Project: model.Project{DeployType: deployType, DockerImage: "registry/app",
+			TargetRoot: "/data/www", TargetReleases: "/data/releases"},
+		Servers: []model.Server{{ID: 1}, {ID: 2}},
+	}
+	task, err := NewTask(m, newTestDB(t), zap.NewNop(), nil, repos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task.stage = stage
+	if deployType == model.ProjectDeployPackage {
+		writeFiles(t, repos.Dir(), map[string]string{
+			m.Version + ".tar.gz":      "package",
+			m.Version + manifestSuffix: "",
+		})
+	}
+	return task, filepath.Join(repos.Dir(), m.Version+".tar.gz")
+}
+
+// finish 模拟发布结束
+func finish(task *Task, err error) error {
+	go func() {
+		task.doneError <- err
+	}()
+	return task.Wait()
+}
+
+func TestPrevPromote(t *testing.T) {
+	task, pkg := newCanaryTask(t, stagePromote, model.ProjectDeployPackage)
+	if err := task.prevPromote(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if task.deployDirs.localCodePackage != pkg || task.deployDirs.remoteReleaseDir != "/data/releases/1_1_20240102_150405" {
+		t.Fatalf("deploy dirs error: %+v", task.deployDirs)
+	}
+	if servers := task.servers(); len(servers) != 1 || servers[0].ID != 2 {
+		t.Fatalf("promote servers error: %+v", servers)
+	}
+
+	task, pkg = newCanaryTask(t, stagePromote, model.ProjectDeployPackage)
+	_ = os.Remove(pkg)
+	if err := task.prevPromote(context.Background()); err == nil {
+		t.Fatal("expected package not exist error")
+	}
+
+	//docker发布没有本地程序包，使用灰度发布时推送的镜像
+	task, _ = newCanaryTask(t, stagePromote, model.ProjectDeployDocker)
+	if err := task.prevPromote(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if image := task.image(); image != "registry/app:1_1_20240102_150405" {
+		t.Fatalf("promote image %s", image)
+	}
+}
+
+func TestPromoteManifest(t *testing.T) {
+	task, pkg := newCanaryTask(t, stagePromote, model.ProjectDeployPackage)
+	if err := task.prevPromote(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	saved := manifest{"index.html": {sum: "sum", mode: 0644}}
+	if err := os.WriteFile(task.deployDirs.localManifest, saved.marshal(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	//程序包不是有效的压缩包，使用的是灰度发布时保存的清单
+	m, err := task.manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || m["index.html"] != saved["index.html"] {
+		t.Fatalf("manifest error: %+v", m)
+	}
+	if err = finish(task, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{pkg, task.deployDirs.localManifest} {
+		if _, err = os.Stat(f); !os.IsNotExist(err) {
+			t.Fatalf("%s not removed after promote", f)
+		}
+	}
+}
+
+func TestCanaryWait(t *testing.T) {
+	task, pkg := newCanaryTask(t, stageRelease, model.ProjectDeployPackage)
+	task.initDeployDirs(filepath.Dir(pkg))
+	if err := os.Mkdir(task.deployDirs.localWarehouseDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := finish(task, nil); err != nil {
+		t.Fatal(err)
+	}
+	if task.model.Status != model.TaskStatusCanary {
+		t.Fatalf("status %d", task.model.Status)
+	}
+	if _, err := os.Stat(pkg); err != nil {
+		t.Fatalf("package removed before promote: %v", err)
+	}
+	if _, err := os.Stat(task.deployDirs.localWarehouseDir); !os.IsNotExist(err) {
+		t.Fatal("warehouse dir not removed")
+	}
+}
+
+func TestAbortCanary(t *testing.T) {
+	task, pkg := newCanaryTask(t, stageAbort, model.ProjectDeployPackage)
+	if err := task.prevRollback(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if task.deployDirs.remoteReleaseDir != task.model.PrevVersion || task.deployDirs.remoteRootLink != "/data/www" {
+		t.Fatalf("abort deploy dirs error: %+v", task.deployDirs)
+	}
+	if servers := task.servers(); len(servers) != 1 || servers[0].ID != 1 {
+		t.Fatalf("abort servers error: %+v", servers)
+	}
+	if err := finish(task, nil); err != nil {
+		t.Fatal(err)
+	}
+	if task.model.Status != model.TaskStatusCanaryAbort {
+		t.Fatalf("status %d", task.model.Status)
+	}
+	if _, err := os.Stat(pkg); !os.IsNotExist(err) {
+		t.Fatal("package not removed after abort")
+	}
+
+	//docker发布取消时恢复灰度发布前的镜像
+	task, _ = newCanaryTask(t, stageAbort, model.ProjectDeployDocker)
+	task.model.PrevVersion = "1_0_20240101_150405"
+	if image := task.image(); image != "registry/app:1_0_20240101_150405" {
+		t.Fatalf("abort image %s", image)
+	}
+}
+
+func TestExpiredVersions(t *testing.T) {
+	list := "3_12_20240105_000000\n3_12_20240105_000000.tar.gz\n3_11_20240104_000000.tar.gz\n3_11_20240104_000000\n" +
+		"3_10_20240103_000000.manifest\n3_10_20240103_000000\n3_9_20240102_000000.delta.tar.gz\n3_9_20240102_000000\n" +
+		"4_8_20240101_000000\nlogs\n\n"
+	tests := []struct {
+		name    string
+		keep    []string
+		keepNum int
+		want    []string
+	}{
+		{"keep newest", []string{"3_12_20240105_000000"}, 2, []string{"3_10_20240103_000000", "3_9_20240102_000000"}},
+		{"keep current", []string{"3_9_20240102_000000"}, 2, []string{"3_10_20240103_000000"}},
+		{"keep all", []string{"3_12_20240105_000000"}, 4, []string{}},
+		{"keep one", nil, 1, []string{"3_11_20240104_000000", "3_10_20240103_000000", "3_9_20240102_000000"}},
+		//只保留一个版本时仍然保留发布前的版本，健康检查失败和回滚时使用
+		{"keep one with prev", []string{"3_12_20240105_000000", "3_11_20240104_000000"}, 1, []string{"3_10_20240103_000000", "3_9_20240102_000000"}},
+		{"keep one after rollback", []string{"3_9_20240102_000000", "3_11_20240104_000000"}, 1, []string{"3_10_20240103_000000"}},
+	}
+	for _, tt := range tests {
+		got := expiredVersions(list, 3, tt.keepNum, tt.keep)
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReleaseBatches(t *testing.T) {
+	servers := []model.Server{{ID: 1}, {ID: 2}, {ID: 3}, {ID: 4}, {ID: 5}}
+	tests := []struct {
+		name    string
+		project model.Project
+		sizes   []int
+	}{
+		{"all at once", model.Project{}, []int{5}},
+		{"batch size", model.Project{ReleaseStrategy: model.ProjectReleaseRolling, BatchSize: 2}, []int{2, 2, 1}},
+		{"percent", model.Project{ReleaseStrategy: model.ProjectReleaseRolling, BatchPercent: 40}, []int{2, 2, 1}},
+		{"one by one", model.Project{ReleaseStrategy: model.ProjectReleaseRolling}, []int{1, 1, 1, 1, 1}},
+	}
+	for _, tt := range tests {
+		batches := slices.Split(servers, int64(tt.project.BatchNum(len(servers))))
+		sizes := slices.Map(batches, func(item []model.Server, k int) int {
+			return len(item)
+		})
+		if fmt.Sprint(sizes) != fmt.Sprint(tt.sizes) {
+			t.Errorf("%s: batch sizes %v, want %v", tt.name, sizes, tt.sizes)
+		}
+	}
+
+	//第一批失败超出允许数量，中止的后续批次记录为失败
+	batches := slices.Split(servers, 2)
+	remoteErrs := &RemoteErrs{}
+	remoteErrs.Store(int64(1), nil)
+	remoteErrs.Store(int64(2), ErrStopDeploy)
+	storeRemoteErr(remoteErrs, batches[1:], ErrBatchAbort)
+	if failed, total := remoteErrs.Failed(); failed != 4 || total != 5 {
+		t.Fatalf("failed %d total %d", failed, total)
+	}
+	if v, _ := remoteErrs.Load(int64(5)); v != ErrBatchAbort {
+		t.Fatalf("server 5 error: %v", v)
+	}
+}
@@ -1,6 +1,7 @@
 package environment
 
 import (
+	"yema.dev/app/model"
 	"yema.dev/app/model/field"
 	"yema.dev/app/pkg/db"
 )
@@ -11,6 +12,16 @@ type CreateReq struct {
 	Status      field.Status `json:"status" binding:"required,status"`
 	Description string       `json:"description" binding:"omitempty,max=500"`
 	Color       string       `json:"color" binding:"omitempty,rgb"`
+
+	//上线单审核策略
+	ApprovalCount   int                  `json:"approval_count" binding:"omitempty,gte=0,lte=10"`
+	ApprovalRoles   field.Slices[string] `json:"approval_roles" binding:"omitempty,unique,dive,oneof=super owner master"`
+	ApprovalUserIds field.Slices[int64]  `json:"approval_user_ids" binding:"omitempty,unique,dive,gt=0"`
+
+	//发布窗口和封版时间
+	DeployTimezone string              `json:"deploy_timezone" binding:"omitempty,max=50"`
+	DeployWindows  model.DeployWindows `json:"deploy_windows" binding:"omitempty,max=20"`
+	DeployFreezes  model.DeployFreezes `json:"deploy_freezes" binding:"omitempty,max=50"`
 }
 
 type UpdateReq struct {
@@ -20,10 +31,22 @@ type UpdateReq struct {
 	Status      field.Status `json:"status" binding:"required,status"`
 	Description string       `json:"description" binding:"omitempty,max=500"`
 	Color       string       `json:"color" binding:"omitempty,rgb"`
+
+	//上线单审核策略
+	ApprovalCount   int                  `json:"approval_count" binding:"omitempty,gte=0,lte=10"`
+	ApprovalRoles   field.Slices[string] `json:"approval_roles" binding:"omitempty,unique,dive,oneof=super owner master"`
+	ApprovalUserIds field.Slices[int64]  `json:"approval_user_ids" binding:"omitempty,unique,dive,gt=0"`
+
+	//发布窗口和封版时间
+	DeployTimezone string              `json:"deploy_timezone" binding:"omitempty,max=50"`
+	DeployWindows  model.DeployWindows `json:"deploy_windows" binding:"omitempty,max=20"`
+	DeployFreezes  model.DeployFreezes `json:"deploy_freezes" binding:"omitempty,max=50"`
 }
 
 func (r *UpdateReq) Fields() []string {
-	return []string{"name", "status", "description", "color"}
+	return []string{"name", "status", "description", "color",
+		"approval_count", "approval_roles", "approval_user_ids",
+		"deploy_timezone", "deploy_windows", "deploy_freezes"}
 }
 
 type ListReq struct {
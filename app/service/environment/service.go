@@ -2,8 +2,12 @@ package environment
 
 import (
 	"errors"
+	"fmt"
 	"gorm.io/gorm"
+	"strings"
 	"sync"
+	"time"
+	"yema.dev/app/internal/errcode"
 	"yema.dev/app/model"
 	"yema.dev/app/service/common"
 )
@@ -38,16 +42,30 @@ func (srv *Service) List(params *ListReq) (total int64, list []*model.Environmen
 }
 
 func (srv *Service) Create(params *CreateReq) error {
+	if err := checkDeployTime(params.DeployTimezone, params.DeployWindows, params.DeployFreezes); err != nil {
+		return err
+	}
 	return srv.db.Create(&model.Environment{
 		SpaceId:     params.SpaceId,
 		Name:        params.Name,
 		Description: params.Description,
 		Status:      params.Status,
 		Color:       params.Color,
+
+		ApprovalCount:   params.ApprovalCount,
+		ApprovalRoles:   params.ApprovalRoles,
+		ApprovalUserIds: params.ApprovalUserIds,
+
+		DeployTimezone: params.DeployTimezone,
+		DeployWindows:  params.DeployWindows,
+		DeployFreezes:  params.DeployFreezes,
 	}).Error
 }
 
 func (srv *Service) Update(params *UpdateReq) error {
+	if err := checkDeployTime(params.DeployTimezone, params.DeployWindows, params.DeployFreezes); err != nil {
+		return err
+	}
 	return srv.db.Model(model.Environment{}).
 		Select(params.Fields()).
 		Where(model.Environment{SpaceId: params.SpaceId, ID: params.ID}).
@@ -67,3 +85,26 @@ func (srv *Service) Detail(spaceWithId *common.SpaceWithId) (m *model.Environmen
 	err = srv.db.Where(spaceWithId).First(&m).Error
 	return
 }
+
+// checkDeployTime 检查发布窗口和封版时间配置
+func checkDeployTime(timezone string, windows model.DeployWindows, freezes model.DeployFreezes) error {
+	if timezone != "" {
+		if _, err := time.LoadLocation(timezone); err != nil {
+			return errcode.ErrRequest.Wrap(fmt.Errorf("时区[%s]错误", timezone))
+		}
+	}
+	for _, w := range windows {
+		if err := w.Validate(); err != nil {
+			return errcode.ErrRequest.Wrap(err)
+		}
+	}
+	for _, f := range freezes {
+		if !f.End.After(f.Start) {
+			return errcode.ErrRequest.Wrap(errors.New("封版结束时间必须晚于开始时间"))
+		}
+		if strings.TrimSpace(f.Reason) == "" {
+			return errcode.ErrRequest.Wrap(errors.New("封版原因不能为空"))
+		}
+	}
+	return nil
+}
@@ -1,4 +1,45 @@
 package notice
 
-type DingtalkConfig struct {
-}
\ No newline at end of file
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Dingtalk 钉钉群机器人，配置了加签密钥时对请求签名
+type Dingtalk struct {
+	client  *http.Client
+	Webhook string
+	Secret  string
+}
+
+func (d *Dingtalk) Send(ctx context.Context, msg *Message) error {
+	return postRobot(ctx, d.client, d.url(time.Now()), map[string]any{
+		"msgtype": "markdown",
+		"markdown": map[string]string{
+			"title": msg.Title,
+			"text":  "### " + msg.Title + "\n\n" + msg.Content,
+		},
+	})
+}
+
+func (d *Dingtalk) url(now time.Time) string {
+	if d.Secret == "" {
+		return d.Webhook
+	}
+	timestamp := fmt.Sprintf("%d", now.UnixMilli())
+	mac := hmac.New(sha256.New, []byte(d.Secret))
+	mac.Write([]byte(timestamp + "\n" + d.Secret))
+	sign := url.QueryEscape(base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	sep := "?"
+	if strings.Contains(d.Webhook, "?") {
+		sep = "&"
+	}
+	return d.Webhook + sep + "timestamp=" + timestamp + "&sign=" + sign
+}
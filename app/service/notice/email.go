@@ -1,4 +1,142 @@
 package notice
 
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
 type EmailConfig struct {
-}
\ No newline at end of file
+	Host     string `help:"smtp服务器地址" default:""`
+	Port     int    `help:"smtp服务器端口" default:"25"`
+	Username string `help:"smtp帐号" default:""`
+	Password string `help:"smtp密码" default:""`
+	From     string `help:"发件人地址，为空时使用smtp帐号" default:""`
+	SSL      bool   `help:"是否使用SSL连接，一般为465端口" default:"false"`
+}
+
+// Email 邮件通知，收件人多个用逗号分隔
+type Email struct {
+	config  *EmailConfig
+	timeout time.Duration
+	To      string
+}
+
+func (e *Email) Send(ctx context.Context, msg *Message) error {
+	if e.config.Host == "" {
+		return Error.New("未配置smtp服务器")
+	}
+	to := e.recipients()
+	if len(to) == 0 {
+		return Error.New("收件人为空")
+	}
+	from := e.config.From
+	if from == "" {
+		from = e.config.Username
+	}
+	client, err := e.dial(ctx)
+	if err != nil {
+		return Error.Wrap(err)
+	}
+	defer client.Close()
+	if err = e.auth(client); err != nil {
+		return Error.Wrap(err)
+	}
+	if err = client.Mail(from); err != nil {
+		return Error.Wrap(err)
+	}
+	for _, v := range to {
+		if err = client.Rcpt(v); err != nil {
+			return Error.Wrap(err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return Error.Wrap(err)
+	}
+	if _, err = w.Write(e.body(from, to, msg)); err != nil {
+		return Error.Wrap(err)
+	}
+	if err = w.Close(); err != nil {
+		return Error.Wrap(err)
+	}
+	return Error.Wrap(client.Quit())
+}
+
+func (e *Email) recipients() []string {
+	to := make([]string, 0)
+	for _, v := range strings.Split(e.To, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			to = append(to, v)
+		}
+	}
+	return to
+}
+
+// dial 连接smtp服务器，非SSL连接时服务器支持则使用STARTTLS
+func (e *Email) dial(ctx context.Context) (*smtp.Client, error) {
+	addr := net.JoinHostPort(e.config.Host, fmt.Sprintf("%d", e.config.Port))
+	dialer := &net.Dialer{Timeout: e.timeout}
+	var conn net.Conn
+	var err error
+	if e.config.SSL {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: e.config.Host}}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, e.config.Host)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if !e.config.SSL {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err = client.StartTLS(&tls.Config{ServerName: e.config.Host}); err != nil {
+				_ = client.Close()
+				return nil, err
+			}
+		}
+	}
+	return client, nil
+}
+
+func (e *Email) auth(client *smtp.Client) error {
+	if e.config.Username == "" {
+		return nil
+	}
+	if ok, _ := client.Extension("AUTH"); !ok {
+		return nil
+	}
+	return client.Auth(smtp.PlainAuth("", e.config.Username, e.config.Password, e.config.Host))
+}
+
+func (e *Email) body(from string, to []string, msg *Message) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString("From: " + from + "\r\n")
+	buf.WriteString("To: " + strings.Join(to, ", ") + "\r\n")
+	buf.WriteString("Subject: " + mime.BEncoding.Encode("UTF-8", msg.Title) + "\r\n")
+	buf.WriteString("Date: " + msg.Time.Format(time.RFC1123Z) + "\r\n")
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+	content := base64.StdEncoding.EncodeToString([]byte(msg.Content))
+	for len(content) > 76 {
+		buf.WriteString(content[:76] + "\r\n")
+		content = content[76:]
+	}
+	buf.WriteString(content + "\r\n")
+	return buf.Bytes()
+}
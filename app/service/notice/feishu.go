@@ -0,0 +1,39 @@
+package notice
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Feishu 飞书群机器人，配置了签名校验密钥时对请求签名
+type Feishu struct {
+	client  *http.Client
+	Webhook string
+	Secret  string
+}
+
+func (f *Feishu) Send(ctx context.Context, msg *Message) error {
+	data := map[string]any{
+		"msg_type": "text",
+		"content": map[string]string{
+			"text": msg.Title + "\n" + msg.Content,
+		},
+	}
+	if f.Secret != "" {
+		timestamp := fmt.Sprintf("%d", time.Now().Unix())
+		data["timestamp"] = timestamp
+		data["sign"] = f.sign(timestamp)
+	}
+	return postRobot(ctx, f.client, f.Webhook, data)
+}
+
+// sign 飞书签名以 timestamp+"\n"+密钥 作为hmac的key，对空数据签名
+func (f *Feishu) sign(timestamp string) string {
+	mac := hmac.New(sha256.New, []byte(timestamp+"\n"+f.Secret))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,68 @@
+package notice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// postJSON 发送json请求，返回响应内容，非2xx状态码视为失败
+func postJSON(ctx context.Context, client *http.Client, url string, data any, header http.Header) ([]byte, error) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return nil, Error.Wrap(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, Error.Wrap(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, Error.Wrap(err)
+	}
+	defer resp.Body.Close()
+	res, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, Error.Wrap(err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, Error.New("http status %d: %s", resp.StatusCode, res)
+	}
+	return res, nil
+}
+
+// robotResult 机器人接口返回结果，钉钉和企业微信使用errcode，飞书使用code
+type robotResult struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+	Code    int    `json:"code"`
+	Msg     string `json:"msg"`
+}
+
+func (r *robotResult) err() error {
+	if r.ErrCode != 0 {
+		return Error.New("errcode %d: %s", r.ErrCode, r.ErrMsg)
+	}
+	if r.Code != 0 {
+		return Error.New("code %d: %s", r.Code, r.Msg)
+	}
+	return nil
+}
+
+func postRobot(ctx context.Context, client *http.Client, url string, data any) error {
+	res, err := postJSON(ctx, client, url, data, nil)
+	if err != nil {
+		return err
+	}
+	result := robotResult{}
+	if err = json.Unmarshal(res, &result); err != nil {
+		return Error.Wrap(err)
+	}
+	return result.err()
+}
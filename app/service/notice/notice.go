@@ -1,10 +1,146 @@
 package notice
 
+import (
+	"context"
+	"github.com/zeebo/errs"
+	"go.uber.org/zap"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var Error = errs.Class("Notice")
+
+const (
+	TypeDingtalk = "dingtalk"
+	TypeEmail    = "email"
+	TypeWecom    = "wecom"
+	TypeFeishu   = "feishu"
+	TypeWebhook  = "webhook"
+)
+
+const (
+	EventTaskCreated     = "task_created"      //创建上线单
+	EventAuditPass       = "audit_pass"        //审核通过
+	EventAuditReject     = "audit_reject"      //审核拒绝
+	EventReleaseStart    = "release_start"     //开始发布
+	EventReleaseFinish   = "release_finish"    //发布完成
+	EventReleaseFail     = "release_fail"      //发布失败
+	EventReleasePartFail = "release_part_fail" //部分服务器发布失败
+	EventCanaryFinish    = "canary_finish"     //灰度发布完成，等待确认
+	EventCanaryAbort     = "canary_abort"      //灰度发布已取消
+)
+
+var (
+	service     *Service
+	onceService sync.Once
+)
+
 type Config struct {
-	Dingtalk DingtalkConfig
-	Email    EmailConfig
+	Email         EmailConfig
+	Retry         int           `help:"通知发送失败重试次数" default:"3"`
+	RetryInterval time.Duration `help:"通知发送失败重试间隔" default:"5s"`
+	Timeout       time.Duration `help:"通知发送超时时间" default:"10s"`
+}
+
+// Message 通知内容，Content为markdown格式，不含标题，由各通知方式自行展示标题
+type Message struct {
+	Event       string    `json:"event"`
+	Title       string    `json:"title"`
+	Content     string    `json:"content"`
+	TaskId      int64     `json:"task_id"`
+	TaskName    string    `json:"task_name"`
+	ProjectId   int64     `json:"project_id"`
+	ProjectName string    `json:"project_name"`
+	Status      int8      `json:"status"`
+	Time        time.Time `json:"time"`
+}
+
+// Target 通知对象，对应项目的通知配置
+type Target struct {
+	Type   string //通知方式
+	Hook   string //机器人或webhook地址，邮件通知时为收件人，多个用逗号分隔
+	Secret string //签名密钥
 }
 
 type Notice interface {
-	Send() error
+	Send(ctx context.Context, msg *Message) error
+}
+
+type Service struct {
+	log    *zap.Logger
+	config *Config
+	client *http.Client
+}
+
+func NewService(log *zap.Logger, conf *Config) *Service {
+	onceService.Do(func() {
+		service = newService(log, conf)
+	})
+	return service
+}
+
+func newService(log *zap.Logger, conf *Config) *Service {
+	if conf.Timeout <= 0 {
+		conf.Timeout = time.Second * 10
+	}
+	return &Service{
+		log:    log,
+		config: conf,
+		client: &http.Client{Timeout: conf.Timeout},
+	}
+}
+
+// New 根据通知方式创建通知
+func (srv *Service) New(target Target) (Notice, error) {
+	switch target.Type {
+	case TypeDingtalk:
+		return &Dingtalk{client: srv.client, Webhook: target.Hook, Secret: target.Secret}, nil
+	case TypeEmail:
+		return &Email{config: &srv.config.Email, timeout: srv.config.Timeout, To: target.Hook}, nil
+	case TypeWecom:
+		return &Wecom{client: srv.client, Webhook: target.Hook}, nil
+	case TypeFeishu:
+		return &Feishu{client: srv.client, Webhook: target.Hook, Secret: target.Secret}, nil
+	case TypeWebhook:
+		return &Webhook{client: srv.client, Url: target.Hook, Secret: target.Secret}, nil
+	}
+	return nil, Error.New("不支持的通知方式[%s]", target.Type)
+}
+
+// Send 异步发送通知，失败时重试，未配置通知时忽略
+func (srv *Service) Send(target Target, msg *Message) {
+	if target.Type == "" || target.Hook == "" {
+		return
+	}
+	if msg.Time.IsZero() {
+		msg.Time = time.Now()
+	}
+	go func() {
+		if err := srv.send(target, msg); err != nil {
+			srv.log.Error("发送通知失败", zap.String("type", target.Type), zap.String("event", msg.Event),
+				zap.Int64("taskId", msg.TaskId), zap.Error(err))
+		}
+	}()
+}
+
+// send 发送通知，失败时按配置重试
+func (srv *Service) send(target Target, msg *Message) (err error) {
+	n, err := srv.New(target)
+	if err != nil {
+		return err
+	}
+	for i := 0; i <= srv.config.Retry; i++ {
+		if i > 0 {
+			time.Sleep(srv.config.RetryInterval)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), srv.config.Timeout)
+		err = n.Send(ctx, msg)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		srv.log.Warn("发送通知出错", zap.String("type", target.Type), zap.Int("retry", i), zap.Error(err))
+	}
+	return err
 }
@@ -0,0 +1,200 @@
+package notice
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testMsg = &Message{
+	Event:       EventReleaseFinish,
+	Title:       "[demo] 发布完成",
+	Content:     "上线单：test\n状态：发布完成",
+	TaskId:      1,
+	TaskName:    "test",
+	ProjectId:   2,
+	ProjectName: "demo",
+	Time:        time.Now(),
+}
+
+func testService() *Service {
+	return newService(zap.NewNop(), &Config{Retry: 2, RetryInterval: time.Millisecond, Timeout: time.Second})
+}
+
+// robotServer 模拟机器人接口，记录请求内容
+func robotServer(t *testing.T, handle func(r *http.Request, body map[string]any) string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]any{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		_, _ = io.WriteString(w, handle(r, body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDingtalk(t *testing.T) {
+	secret := "SEC123"
+	srv := robotServer(t, func(r *http.Request, body map[string]any) string {
+		timestamp := r.URL.Query().Get("timestamp")
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(timestamp + "\n" + secret))
+		if r.URL.Query().Get("sign") != base64.StdEncoding.EncodeToString(mac.Sum(nil)) {
+			return `{"errcode":310000,"errmsg":"sign not match"}`
+		}
+		if body["msgtype"] != "markdown" || r.URL.Query().Get("access_token") != "abc" {
+			return `{"errcode":1,"errmsg":"bad request"}`
+		}
+		return `{"errcode":0,"errmsg":"ok"}`
+	})
+	n, _ := testService().New(Target{Type: TypeDingtalk, Hook: srv.URL + "?access_token=abc", Secret: secret})
+	if err := n.Send(context.Background(), testMsg); err != nil {
+		t.Fatal(err)
+	}
+	n, _ = testService().New(Target{Type: TypeDingtalk, Hook: srv.URL + "?access_token=abc", Secret: "wrong"})
+	if err := n.Send(context.Background(), testMsg); err == nil {
+		t.Fatal("wrong secret should fail")
+	}
+}
+
+func TestWecomAndFeishu(t *testing.T) {
+	wecom := robotServer(t, func(r *http.Request, body map[string]any) string {
+		content := body["markdown"].(map[string]any)["content"].(string)
+		if !strings.Contains(content, testMsg.Title) {
+			return `{"errcode":40008,"errmsg":"invalid message"}`
+		}
+		return `{"errcode":0,"errmsg":"ok"}`
+	})
+	n, _ := testService().New(Target{Type: TypeWecom, Hook: wecom.URL})
+	if err := n.Send(context.Background(), testMsg); err != nil {
+		t.Fatal(err)
+	}
+
+	secret := "feishu"
+	feishu := robotServer(t, func(r *http.Request, body map[string]any) string {
+		mac := hmac.New(sha256.New, []byte(body["timestamp"].(string)+"\n"+secret))
+		if body["sign"] != base64.StdEncoding.EncodeToString(mac.Sum(nil)) {
+			return `{"code":19021,"msg":"sign match fail"}`
+		}
+		return `{"code":0,"msg":"success"}`
+	})
+	n, _ = testService().New(Target{Type: TypeFeishu, Hook: feishu.URL, Secret: secret})
+	if err := n.Send(context.Background(), testMsg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		msg := Message{}
+		_ = json.NewDecoder(r.Body).Decode(&msg)
+		if msg.TaskId != testMsg.TaskId || !strings.HasPrefix(r.Header.Get("X-Yema-Signature"), "sha256=") {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+	s := testService()
+	if err := s.send(Target{Type: TypeWebhook, Hook: srv.URL, Secret: "s"}, testMsg); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Fatalf("calls: %d", calls)
+	}
+	atomic.StoreInt32(&calls, -10)
+	if err := s.send(Target{Type: TypeWebhook, Hook: srv.URL}, testMsg); err == nil {
+		t.Fatal("should fail after retries")
+	}
+	if calls != -7 {
+		t.Fatalf("retry calls: %d", calls)
+	}
+}
+
+// smtpStub 最简单的smtp服务，返回收到的邮件内容
+func smtpStub(t *testing.T) (addr string, mails chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	mails = make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { _, _ = io.WriteString(conn, s+"\r\n") }
+		reply("220 localhost ESMTP")
+		var data strings.Builder
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(cmd, "MAIL"), strings.HasPrefix(cmd, "RCPT"):
+				data.WriteString(line)
+				reply("250 OK")
+			case cmd == "DATA":
+				reply("354 end with .")
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil || l == ".\r\n" {
+						break
+					}
+					data.WriteString(l)
+				}
+				reply("250 OK")
+			case cmd == "QUIT":
+				reply("221 bye")
+				mails <- data.String()
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+	return l.Addr().String(), mails
+}
+
+func TestEmail(t *testing.T) {
+	addr, mails := smtpStub(t)
+	host, port, _ := net.SplitHostPort(addr)
+	s := testService()
+	s.config.Email = EmailConfig{Host: host, From: "yema@example.com"}
+	s.config.Email.Port, _ = strconv.Atoi(port)
+	n, _ := s.New(Target{Type: TypeEmail, Hook: "a@example.com, b@example.com"})
+	if err := n.Send(context.Background(), testMsg); err != nil {
+		t.Fatal(err)
+	}
+	mail := <-mails
+	for _, want := range []string{"MAIL FROM:<yema@example.com>", "RCPT TO:<a@example.com>", "RCPT TO:<b@example.com>",
+		"Subject: =?UTF-8?b?", base64.StdEncoding.EncodeToString([]byte(testMsg.Content))} {
+		if !strings.Contains(mail, want) {
+			t.Fatalf("mail missing %q:\n%s", want, mail)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package notice
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+)
+
+// Webhook 通用webhook，以json格式推送通知内容，配置了密钥时在X-Yema-Signature请求头中带上hmac-sha256签名
+type Webhook struct {
+	client *http.Client
+	Url    string
+	Secret string
+}
+
+func (w *Webhook) Send(ctx context.Context, msg *Message) error {
+	header := http.Header{}
+	if w.Secret != "" {
+		body, err := json.Marshal(msg)
+		if err != nil {
+			return Error.Wrap(err)
+		}
+		mac := hmac.New(sha256.New, []byte(w.Secret))
+		mac.Write(body)
+		header.Set("X-Yema-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	_, err := postJSON(ctx, w.client, w.Url, msg, header)
+	return err
+}
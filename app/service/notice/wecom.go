@@ -0,0 +1,21 @@
+package notice
+
+import (
+	"context"
+	"net/http"
+)
+
+// Wecom 企业微信群机器人
+type Wecom struct {
+	client  *http.Client
+	Webhook string
+}
+
+func (w *Wecom) Send(ctx context.Context, msg *Message) error {
+	return postRobot(ctx, w.client, w.Webhook, map[string]any{
+		"msgtype": "markdown",
+		"markdown": map[string]string{
+			"content": "### " + msg.Title + "\n" + msg.Content,
+		},
+	})
+}
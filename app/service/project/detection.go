@@ -9,10 +9,8 @@ import (
 	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
 	"path/filepath"
-	"strconv"
 	"sync"
 	"yema.dev/app/model"
-	"yema.dev/app/pkg/repo"
 	"yema.dev/app/pkg/ssh"
 	"yema.dev/app/service/common"
 )
@@ -84,7 +82,7 @@ func (srv *Service) DetectionWs(wsConn *websocket.Conn, spaceWithId *common.Spac
 		}
 
 		srv.log.Info("clone仓库代码")
-		_, err = srv.repo.New(repo.TypeRepo(project.RepoType), project.RepoUrl, strconv.Itoa(int(project.ID)))
+		_, err = common.NewRepo(srv.repo, &project)
 		if err != nil {
 			sendMsg("代码clone失败", "1、请检查仓库地址："+project.RepoUrl+"是否正确；\n 2、请检查"+project.RepoType+"相关配置是否正确", err.Error(), 0)
 			return
@@ -118,7 +116,10 @@ func (srv *Service) DetectionWs(wsConn *websocket.Conn, spaceWithId *common.Spac
 				srv.log.Info("连接服务器", zap.String("server", server.Hostname()))
 				buf := write{}
 				var re *ssh.RemoteExec
-				re, err = srv.ssh.NewRemoteExec(ssh.ServerConfig{User: server.User, Port: server.Port, Host: server.Host}, &buf)
+				var sshConf ssh.ServerConfig
+				if sshConf, err = common.SshConfig(srv.db, &server); err == nil {
+					re, err = srv.ssh.NewRemoteExec(sshConf, &buf)
+				}
 				if err != nil {
 					sendMsg("远程目标机器免密码登录连接失败",
 						fmt.Sprintf("在宿主机中配置免密码登录，把宿主机用户[%s]的~/.ssh/id_rsa.pub添加到远程目标机器用户[%s]的~/.ssh/authorized_keys", server.User, server.User),
@@ -1,6 +1,7 @@
 package project
 
 import (
+	"yema.dev/app/model"
 	"yema.dev/app/pkg/db"
 )
 
@@ -12,6 +13,10 @@ type CreateReq struct {
 	RepoType      string `json:"repo_type" binding:"required,max=20"`
 	RepoMode      string `json:"repo_mode" binding:"required,max=20"`
 
+	RepoUsername   string `json:"repo_username" binding:"omitempty,max=100"`
+	RepoPassword   string `json:"repo_password" binding:"omitempty,max=100"`
+	RepoPrivateKey string `json:"repo_private_key" binding:"omitempty,max=10000"`
+
 	ServerIds      []int64 `json:"server_ids" binding:"required,unique,dive,gt=0"`
 	TargetRoot     string  `json:"target_root" binding:"required,max=100"`
 	TargetReleases string  `json:"target_releases" binding:"required,max=100"`
@@ -27,6 +32,42 @@ type CreateReq struct {
 
 	TaskAudit int8 `json:"task_audit" binding:"omitempty"`
 
+	ReleaseStrategy int8 `json:"release_strategy" binding:"omitempty,oneof=0 1"`
+	BatchSize       int  `json:"batch_size" binding:"omitempty,gte=0"`
+	BatchPercent    int  `json:"batch_percent" binding:"omitempty,gte=0,lte=100"`
+	BatchPause      int  `json:"batch_pause" binding:"omitempty,gte=0"`
+	BatchMaxFail    int  `json:"batch_max_fail" binding:"omitempty,gte=0"`
+
+	DistributeMode    int8  `json:"distribute_mode" binding:"omitempty,oneof=0 1 2"`
+	DistributeRelayId int64 `json:"distribute_relay_id" binding:"required_if=DistributeMode 2,gte=0"`
+	DistributeLimit   int   `json:"distribute_limit" binding:"omitempty,gte=0"`
+
+	TransferMode int8 `json:"transfer_mode" binding:"omitempty,oneof=0 1 2"`
+
+	DeployType      string `json:"deploy_type" binding:"omitempty,oneof=package docker"`
+	DockerImage     string `json:"docker_image" binding:"required_if=DeployType docker,max=300"`
+	DockerContainer string `json:"docker_container" binding:"required_if=DeployType docker,max=100"`
+	DockerRunSpec   string `json:"docker_run_spec" binding:"omitempty,max=2000"`
+
+	ServiceUnit         string `json:"service_unit" binding:"omitempty,max=100"`
+	ServiceAction       string `json:"service_action" binding:"omitempty,oneof=restart reload"`
+	ServiceSudo         int8   `json:"service_sudo" binding:"omitempty,oneof=0 1"`
+	ServiceWaitTimeout  int    `json:"service_wait_timeout" binding:"omitempty,gte=0,lte=600"`
+	ServiceJournalLines int    `json:"service_journal_lines" binding:"omitempty,gte=0,lte=1000"`
+
+	HealthChecks   model.HealthChecks `json:"health_checks" binding:"omitempty,max=10"`
+	HealthTimeout  int                `json:"health_timeout" binding:"omitempty,gte=0,lte=600"`
+	HealthInterval int                `json:"health_interval" binding:"omitempty,gte=0,lte=60"`
+
+	WebhookSecret      string `json:"webhook_secret" binding:"omitempty,max=100"`
+	WebhookBranches    string `json:"webhook_branches" binding:"omitempty,max=500"`
+	WebhookTags        string `json:"webhook_tags" binding:"omitempty,max=500"`
+	WebhookAutoRelease int8   `json:"webhook_auto_release" binding:"omitempty,oneof=0 1"`
+
+	NoticeType   string `json:"notice_type" binding:"omitempty,oneof=dingtalk email wecom feishu webhook"`
+	NoticeHook   string `json:"notice_hook" binding:"required_with=NoticeType,max=500"`
+	NoticeSecret string `json:"notice_secret" binding:"omitempty,max=200"`
+
 	Description string `json:"description" binding:"omitempty,max=500"`
 }
 
@@ -40,6 +81,12 @@ type UpdateReq struct {
 	RepoType      string `json:"repo_type" binding:"required,max=20"`
 	RepoMode      string `json:"repo_mode" binding:"required,max=20"`
 
+	RepoUsername        string `json:"repo_username" binding:"omitempty,max=100"`
+	RepoPassword        string `json:"repo_password" binding:"omitempty,max=100"`
+	RepoPrivateKey      string `json:"repo_private_key" binding:"omitempty,max=10000"`
+	ClearRepoPassword   bool   `json:"clear_repo_password"`    //清除项目的仓库密码，改用全局配置
+	ClearRepoPrivateKey bool   `json:"clear_repo_private_key"` //清除项目的仓库私钥，改用全局配置
+
 	ServerIds      []int64 `json:"server_ids" binding:"required,unique,dive,gt=0"`
 	TargetRoot     string  `json:"target_root" binding:"required,max=100"`
 	TargetReleases string  `json:"target_releases" binding:"required,max=100"`
@@ -55,16 +102,74 @@ type UpdateReq struct {
 
 	TaskAudit int8 `json:"task_audit" binding:"omitempty"`
 
+	ReleaseStrategy int8 `json:"release_strategy" binding:"omitempty,oneof=0 1"`
+	BatchSize       int  `json:"batch_size" binding:"omitempty,gte=0"`
+	BatchPercent    int  `json:"batch_percent" binding:"omitempty,gte=0,lte=100"`
+	BatchPause      int  `json:"batch_pause" binding:"omitempty,gte=0"`
+	BatchMaxFail    int  `json:"batch_max_fail" binding:"omitempty,gte=0"`
+
+	DistributeMode    int8  `json:"distribute_mode" binding:"omitempty,oneof=0 1 2"`
+	DistributeRelayId int64 `json:"distribute_relay_id" binding:"required_if=DistributeMode 2,gte=0"`
+	DistributeLimit   int   `json:"distribute_limit" binding:"omitempty,gte=0"`
+
+	TransferMode int8 `json:"transfer_mode" binding:"omitempty,oneof=0 1 2"`
+
+	DeployType      string `json:"deploy_type" binding:"omitempty,oneof=package docker"`
+	DockerImage     string `json:"docker_image" binding:"required_if=DeployType docker,max=300"`
+	DockerContainer string `json:"docker_container" binding:"required_if=DeployType docker,max=100"`
+	DockerRunSpec   string `json:"docker_run_spec" binding:"omitempty,max=2000"`
+
+	ServiceUnit         string `json:"service_unit" binding:"omitempty,max=100"`
+	ServiceAction       string `json:"service_action" binding:"omitempty,oneof=restart reload"`
+	ServiceSudo         int8   `json:"service_sudo" binding:"omitempty,oneof=0 1"`
+	ServiceWaitTimeout  int    `json:"service_wait_timeout" binding:"omitempty,gte=0,lte=600"`
+	ServiceJournalLines int    `json:"service_journal_lines" binding:"omitempty,gte=0,lte=1000"`
+
+	HealthChecks   model.HealthChecks `json:"health_checks" binding:"omitempty,max=10"`
+	HealthTimeout  int                `json:"health_timeout" binding:"omitempty,gte=0,lte=600"`
+	HealthInterval int                `json:"health_interval" binding:"omitempty,gte=0,lte=60"`
+
+	WebhookSecret      string `json:"webhook_secret" binding:"omitempty,max=100"`
+	ClearWebhookSecret bool   `json:"clear_webhook_secret"` //清除webhook密钥，关闭webhook
+	WebhookBranches    string `json:"webhook_branches" binding:"omitempty,max=500"`
+	WebhookTags        string `json:"webhook_tags" binding:"omitempty,max=500"`
+	WebhookAutoRelease int8   `json:"webhook_auto_release" binding:"omitempty,oneof=0 1"`
+
+	NoticeType   string `json:"notice_type" binding:"omitempty,oneof=dingtalk email wecom feishu webhook"`
+	NoticeHook   string `json:"notice_hook" binding:"required_with=NoticeType,max=500"`
+	NoticeSecret string `json:"notice_secret" binding:"omitempty,max=200"`
+
 	Description string `json:"description" binding:"omitempty,max=500"`
 }
 
 func (r *UpdateReq) Fields() []string {
-	return []string{
-		"name", "environment_id", "repo_url", "repo_type", "repo_mode",
+	fields := []string{
+		"name", "environment_id", "repo_url", "repo_type", "repo_mode", "repo_username",
 		"target_root", "target_releases", "keep_version_num",
 		"excludes", "is_include", "task_vars", "prev_deploy", "post_deploy", "prev_release", "post_release",
 		"task_audit", "description",
+		"release_strategy", "batch_size", "batch_percent", "batch_pause", "batch_max_fail",
+		"distribute_mode", "distribute_relay_id", "distribute_limit", "transfer_mode",
+		"deploy_type", "docker_image", "docker_container", "docker_run_spec",
+		"service_unit", "service_action", "service_sudo", "service_wait_timeout", "service_journal_lines",
+		"health_checks", "health_timeout", "health_interval",
+		"webhook_branches", "webhook_tags", "webhook_auto_release",
+		"notice_type", "notice_hook",
+	}
+	//密码、私钥和密钥为空时不修改，指定清除时清空
+	if r.RepoPassword != "" || r.ClearRepoPassword {
+		fields = append(fields, "repo_password")
+	}
+	if r.RepoPrivateKey != "" || r.ClearRepoPrivateKey {
+		fields = append(fields, "repo_private_key")
+	}
+	if r.NoticeSecret != "" {
+		fields = append(fields, "notice_secret")
+	}
+	if r.WebhookSecret != "" || r.ClearWebhookSecret {
+		fields = append(fields, "webhook_secret")
 	}
+	return fields
 }
 
 type ListReq struct {
@@ -0,0 +1,28 @@
+package project
+
+import (
+	"github.com/wuzfei/go-helper/slices"
+	"testing"
+)
+
+func TestUpdateFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		req    UpdateReq
+		fields map[string]bool
+	}{
+		{"keep", UpdateReq{}, map[string]bool{"repo_password": false, "repo_private_key": false, "webhook_secret": false}},
+		{"set", UpdateReq{RepoPassword: "pass", RepoPrivateKey: "key", WebhookSecret: "secret"},
+			map[string]bool{"repo_password": true, "repo_private_key": true, "webhook_secret": true}},
+		{"clear", UpdateReq{ClearRepoPassword: true, ClearRepoPrivateKey: true, ClearWebhookSecret: true},
+			map[string]bool{"repo_password": true, "repo_private_key": true, "webhook_secret": true}},
+	}
+	for _, tt := range tests {
+		fields := tt.req.Fields()
+		for field, want := range tt.fields {
+			if got := slices.Contains(fields, field); got != want {
+				t.Errorf("%s: field %s updated %v, want %v", tt.name, field, got, want)
+			}
+		}
+	}
+}
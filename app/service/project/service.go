@@ -8,7 +8,8 @@ import (
 	"go.uber.org/zap"
 	"gorm.io/gorm"
 	"path/filepath"
-	"strconv"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
 	"yema.dev/app/model"
@@ -19,9 +20,20 @@ import (
 )
 
 var (
-	Error       = errs.Class("Service.Project")
+	Error = errs.Class("Service.Project")
+	//仓库私钥必须加密存储
+	ErrSecretDisabled = Error.New("未配置加密密钥，无法保存仓库私钥")
+	//中转服务器必须属于当前空间
+	ErrRelayServer = Error.New("中转服务器不存在")
+	//容器名称会用于服务器上的docker命令
+	ErrDockerContainer = Error.New("容器名称只能包含字母、数字、下划线、点和中划线")
+	ErrServiceUnit     = Error.New("systemd服务名称错误")
+
 	service     *Service
 	onceService sync.Once
+
+	containerNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+	serviceUnitRe   = regexp.MustCompile(`^[a-zA-Z0-9@_.:-]+$`)
 )
 
 type Service struct {
@@ -66,6 +78,21 @@ func (srv *Service) List(params *ListReq) (total int64, list []*model.Project, e
 }
 
 func (srv *Service) Create(params *CreateReq) error {
+	if params.RepoPrivateKey != "" && !field.SecretEnabled() {
+		return ErrSecretDisabled
+	}
+	if err := srv.checkRelayServer(params.SpaceId, params.DistributeMode, params.DistributeRelayId); err != nil {
+		return err
+	}
+	if params.DeployType == model.ProjectDeployDocker && !containerNameRe.MatchString(params.DockerContainer) {
+		return ErrDockerContainer
+	}
+	if params.ServiceUnit != "" && !serviceUnitRe.MatchString(params.ServiceUnit) {
+		return ErrServiceUnit
+	}
+	if err := checkHealthChecks(params.HealthChecks); err != nil {
+		return err
+	}
 	m := &model.Project{
 		SpaceId: params.SpaceId,
 
@@ -77,18 +104,58 @@ func (srv *Service) Create(params *CreateReq) error {
 		TaskAudit:     params.TaskAudit,
 		Description:   params.Description,
 
+		RepoUsername:   params.RepoUsername,
+		RepoPassword:   field.Encrypted(params.RepoPassword),
+		RepoPrivateKey: field.Encrypted(params.RepoPrivateKey),
+
 		TargetRoot:     params.TargetRoot,
 		TargetReleases: params.TargetReleases,
 		KeepVersionNum: params.KeepVersionNum,
 
 		Excludes:    params.Excludes,
 		IsInclude:   params.IsInclude,
-		TaskVars:    params.TaskVars,
-		PrevDeploy:  params.PrevRelease,
+		TaskVars:    field.Encrypted(params.TaskVars),
+		PrevDeploy:  params.PrevDeploy,
 		PostDeploy:  params.PostDeploy,
 		PrevRelease: params.PrevRelease,
 		PostRelease: params.PostRelease,
 		Status:      field.StatusEnable,
+
+		ReleaseStrategy: params.ReleaseStrategy,
+		BatchSize:       params.BatchSize,
+		BatchPercent:    params.BatchPercent,
+		BatchPause:      params.BatchPause,
+		BatchMaxFail:    params.BatchMaxFail,
+
+		DistributeMode:    params.DistributeMode,
+		DistributeRelayId: params.DistributeRelayId,
+		DistributeLimit:   params.DistributeLimit,
+
+		TransferMode: params.TransferMode,
+
+		DeployType:      params.DeployType,
+		DockerImage:     params.DockerImage,
+		DockerContainer: params.DockerContainer,
+		DockerRunSpec:   params.DockerRunSpec,
+
+		ServiceUnit:         params.ServiceUnit,
+		ServiceAction:       params.ServiceAction,
+		ServiceSudo:         params.ServiceSudo,
+		ServiceWaitTimeout:  params.ServiceWaitTimeout,
+		ServiceJournalLines: params.ServiceJournalLines,
+
+		HealthChecks:   params.HealthChecks,
+		HealthTimeout:  params.HealthTimeout,
+		HealthInterval: params.HealthInterval,
+
+		WebhookSecret:      field.Encrypted(params.WebhookSecret),
+		WebhookBranches:    params.WebhookBranches,
+		WebhookTags:        params.WebhookTags,
+		WebhookAutoRelease: params.WebhookAutoRelease,
+
+		NoticeType:   params.NoticeType,
+		NoticeHook:   params.NoticeHook,
+		NoticeSecret: field.Encrypted(params.NoticeSecret),
 	}
 	servers := make([]model.Server, 0)
 	return srv.db.Transaction(func(tx *gorm.DB) error {
@@ -102,6 +169,21 @@ func (srv *Service) Create(params *CreateReq) error {
 }
 
 func (srv *Service) Update(params *UpdateReq) error {
+	if params.RepoPrivateKey != "" && !field.SecretEnabled() {
+		return ErrSecretDisabled
+	}
+	if err := srv.checkRelayServer(params.SpaceId, params.DistributeMode, params.DistributeRelayId); err != nil {
+		return err
+	}
+	if params.DeployType == model.ProjectDeployDocker && !containerNameRe.MatchString(params.DockerContainer) {
+		return ErrDockerContainer
+	}
+	if params.ServiceUnit != "" && !serviceUnitRe.MatchString(params.ServiceUnit) {
+		return ErrServiceUnit
+	}
+	if err := checkHealthChecks(params.HealthChecks); err != nil {
+		return err
+	}
 	m := model.Project{}
 	err := srv.db.Where("space_id = ? and id = ?", params.SpaceId, params.ID).First(&m).Error
 	if err != nil {
@@ -119,17 +201,57 @@ func (srv *Service) Update(params *UpdateReq) error {
 		TaskAudit:     params.TaskAudit,
 		Description:   params.Description,
 
+		RepoUsername:   params.RepoUsername,
+		RepoPassword:   field.Encrypted(params.RepoPassword),
+		RepoPrivateKey: field.Encrypted(params.RepoPrivateKey),
+
 		TargetRoot:     params.TargetRoot,
 		TargetReleases: params.TargetReleases,
 		KeepVersionNum: params.KeepVersionNum,
 
 		Excludes:    params.Excludes,
 		IsInclude:   params.IsInclude,
-		TaskVars:    params.TaskVars,
-		PrevDeploy:  params.PrevRelease,
+		TaskVars:    field.Encrypted(params.TaskVars),
+		PrevDeploy:  params.PrevDeploy,
 		PostDeploy:  params.PostDeploy,
 		PrevRelease: params.PrevRelease,
 		PostRelease: params.PostRelease,
+
+		ReleaseStrategy: params.ReleaseStrategy,
+		BatchSize:       params.BatchSize,
+		BatchPercent:    params.BatchPercent,
+		BatchPause:      params.BatchPause,
+		BatchMaxFail:    params.BatchMaxFail,
+
+		DistributeMode:    params.DistributeMode,
+		DistributeRelayId: params.DistributeRelayId,
+		DistributeLimit:   params.DistributeLimit,
+
+		TransferMode: params.TransferMode,
+
+		DeployType:      params.DeployType,
+		DockerImage:     params.DockerImage,
+		DockerContainer: params.DockerContainer,
+		DockerRunSpec:   params.DockerRunSpec,
+
+		ServiceUnit:         params.ServiceUnit,
+		ServiceAction:       params.ServiceAction,
+		ServiceSudo:         params.ServiceSudo,
+		ServiceWaitTimeout:  params.ServiceWaitTimeout,
+		ServiceJournalLines: params.ServiceJournalLines,
+
+		HealthChecks:   params.HealthChecks,
+		HealthTimeout:  params.HealthTimeout,
+		HealthInterval: params.HealthInterval,
+
+		WebhookSecret:      field.Encrypted(params.WebhookSecret),
+		WebhookBranches:    params.WebhookBranches,
+		WebhookTags:        params.WebhookTags,
+		WebhookAutoRelease: params.WebhookAutoRelease,
+
+		NoticeType:   params.NoticeType,
+		NoticeHook:   params.NoticeHook,
+		NoticeSecret: field.Encrypted(params.NoticeSecret),
 	}
 	return srv.db.Transaction(func(tx *gorm.DB) error {
 		servers := make([]model.Server, 0)
@@ -148,6 +270,51 @@ func (srv *Service) Update(params *UpdateReq) error {
 	})
 }
 
+// checkHealthChecks 校验健康检查配置
+func checkHealthChecks(checks model.HealthChecks) error {
+	for i, c := range checks {
+		switch c.Type {
+		case model.HealthCheckHttp:
+			if !strings.HasPrefix(c.Url, "http://") && !strings.HasPrefix(c.Url, "https://") {
+				return Error.New("第%d项健康检查地址错误", i+1)
+			}
+			if c.ExpectStatus != 0 && (c.ExpectStatus < 100 || c.ExpectStatus > 599) {
+				return Error.New("第%d项健康检查状态码错误", i+1)
+			}
+			if _, err := regexp.Compile(c.ExpectBody); err != nil {
+				return Error.New("第%d项健康检查响应内容正则错误：%s", i+1, err)
+			}
+		case model.HealthCheckTcp:
+			if c.Port <= 0 || c.Port > 65535 {
+				return Error.New("第%d项健康检查端口错误", i+1)
+			}
+		case model.HealthCheckCommand:
+			if strings.TrimSpace(c.Command) == "" {
+				return Error.New("第%d项健康检查命令为空", i+1)
+			}
+		default:
+			return Error.New("第%d项健康检查类型错误", i+1)
+		}
+	}
+	return nil
+}
+
+// checkRelayServer 中转分发时校验中转服务器
+func (srv *Service) checkRelayServer(spaceId int64, mode int8, relayId int64) error {
+	if mode != model.ProjectDistributeRelay {
+		return nil
+	}
+	var total int64
+	err := srv.db.Model(&model.Server{}).Where("space_id = ? and id = ?", spaceId, relayId).Count(&total).Error
+	if err != nil {
+		return err
+	}
+	if total == 0 {
+		return ErrRelayServer
+	}
+	return nil
+}
+
 func (srv *Service) Delete(spaceAndId *common.SpaceWithId) error {
 	return srv.db.Transaction(func(tx *gorm.DB) error {
 		if err := tx.Model(&model.Project{ID: spaceAndId.ID}).Association("Servers").Clear(); err != nil {
@@ -176,7 +343,7 @@ func (srv *Service) Detection(spaceWithId *common.SpaceWithId) (ret []*Detection
 	if err != nil {
 		return
 	}
-	_, err = srv.repo.New(repo.TypeRepo(project.RepoType), project.RepoUrl, strconv.Itoa(int(project.ID)))
+	_, err = common.NewRepo(srv.repo, &project)
 	if err != nil {
 		ret = append(ret, &DetectionMsg{
 			Title: "代码clone失败",
@@ -211,7 +378,11 @@ func (srv *Service) Detection(spaceWithId *common.SpaceWithId) (ret []*Detection
 		go func(server model.Server) {
 			defer wg.Done()
 			buf := bytes.Buffer{}
-			re, _err := srv.ssh.NewRemoteExec(ssh.ServerConfig{User: server.User, Port: server.Port, Host: server.Host}, &buf)
+			var re *ssh.RemoteExec
+			sshConf, _err := common.SshConfig(srv.db, &server)
+			if _err == nil {
+				re, _err = srv.ssh.NewRemoteExec(sshConf, &buf)
+			}
 			if _err != nil {
 				detectionMsgChan <- &DetectionMsg{
 					Title: "远程目标机器免密码登录失败",
@@ -297,5 +468,5 @@ func (srv *Service) getRepoBySpaceWithId(spaceWithId *common.SpaceWithId) (rep r
 	if !projectModel.Status.IsEnable() {
 		return nil, errors.New("该项目已经禁用")
 	}
-	return srv.repo.New(repo.TypeRepo(projectModel.RepoType), projectModel.RepoUrl, strconv.Itoa(int(projectModel.ID)))
+	return common.NewRepo(srv.repo, projectModel)
 }
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"go.uber.org/zap"
+	"yema.dev/app/model"
+	"yema.dev/app/model/field"
+	"yema.dev/app/pkg/ssh"
+	"yema.dev/app/service/common"
+)
+
+// HostKey 查看服务器记录的主机公钥
+func (srv *Service) HostKey(spaceWithId *common.SpaceWithId) (*HostKeyResp, error) {
+	serverDetail := model.Server{}
+	err := srv.db.Where(spaceWithId).First(&serverDetail).Error
+	if err != nil {
+		return nil, err
+	}
+	resp := &HostKeyResp{HostKey: serverDetail.HostKey}
+	if serverDetail.HostKey != "" {
+		key, err := ssh.ParseHostKey(serverDetail.HostKey)
+		if err != nil {
+			return nil, err
+		}
+		resp.Type = key.Type()
+		resp.Fingerprint = ssh.Fingerprint(serverDetail.HostKey)
+	}
+	return resp, nil
+}
+
+// ResetHostKey 重置主机公钥，服务器重装后使用，下次校验连接时重新记录
+func (srv *Service) ResetHostKey(spaceWithId *common.SpaceWithId) error {
+	return srv.db.Model(&model.Server{}).Where(spaceWithId).
+		UpdateColumns(map[string]any{"host_key": "", "status": field.StatusDisable}).Error
+}
+
+// hostKeyPin 未记录主机公钥的服务器首次连接时的公钥
+type hostKeyPin struct {
+	server  *model.Server
+	hostKey string
+}
+
+// sshConfig 服务器和各级跳板机未记录主机公钥时信任首次连接的公钥，已记录的照常校验，连接成功后再调用saveHostKeys保存
+func (srv *Service) sshConfig(server *model.Server) (ssh.ServerConfig, []*hostKeyPin, error) {
+	conf, err := common.SshConfig(srv.db, server)
+	if err != nil {
+		return conf, nil, err
+	}
+	pins := make([]*hostKeyPin, 0)
+	hop, hopServer := &conf, server
+	for {
+		if hopServer.HostKey == "" {
+			pin := &hostKeyPin{server: hopServer}
+			hop.OnNewHostKey = func(hostKey string) error {
+				pin.hostKey = hostKey
+				return nil
+			}
+			pins = append(pins, pin)
+		}
+		if hop.Jump == nil {
+			break
+		}
+		jumpServer := &model.Server{}
+		err = srv.db.Where("space_id = ? and id = ?", hopServer.SpaceId, hopServer.JumpServerId).First(jumpServer).Error
+		if err != nil {
+			return conf, nil, err
+		}
+		hop, hopServer = hop.Jump, jumpServer
+	}
+	return conf, pins, nil
+}
+
+// saveHostKeys 连接成功后保存服务器和跳板机首次连接的主机公钥，跳板机已有连接时没有新公钥，不保存
+func (srv *Service) saveHostKeys(pins []*hostKeyPin) {
+	for _, pin := range pins {
+		srv.saveHostKey(pin.server, pin.hostKey)
+	}
+}
+
+func (srv *Service) saveHostKey(server *model.Server, hostKey string) {
+	if hostKey == "" || server.HostKey != "" {
+		return
+	}
+	err := srv.db.Model(&model.Server{}).Where("id = ? and host_key = ''", server.ID).UpdateColumn("host_key", hostKey).Error
+	if err != nil {
+		srv.log.Error("保存主机公钥失败", zap.Int64("server_id", server.ID), zap.Error(err))
+		return
+	}
+	srv.log.Info("记录服务器主机公钥", zap.Int64("server_id", server.ID), zap.String("fingerprint", ssh.Fingerprint(hostKey)))
+	server.HostKey = hostKey
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"go.uber.org/zap"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"path/filepath"
+	"testing"
+	"yema.dev/app/model"
+)
+
+// TestSshConfigJumpHostKey 各级跳板机未记录主机公钥时也信任首次连接的公钥，已记录的不覆盖
+func TestSshConfigJumpHostKey(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.AutoMigrate(&model.Server{}, &model.Credential{}); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Service{db: db, log: zap.NewNop()}
+	create := func(s *model.Server) *model.Server {
+		s.SpaceId, s.User, s.Port = 1, "root", 22
+		if err := db.Create(s).Error; err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	bastion := create(&model.Server{Host: "bastion", HostKey: "bastion-key"})
+	inner := create(&model.Server{Host: "inner", JumpServerId: bastion.ID})
+	app := create(&model.Server{Host: "app", JumpServerId: inner.ID})
+
+	conf, pins, err := srv.sshConfig(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins) != 2 || conf.OnNewHostKey == nil || conf.Jump.OnNewHostKey == nil || conf.Jump.Jump.OnNewHostKey != nil {
+		t.Fatalf("pins %d, callbacks %v %v %v", len(pins), conf.OnNewHostKey != nil, conf.Jump.OnNewHostKey != nil, conf.Jump.Jump.OnNewHostKey != nil)
+	}
+	//模拟连接时各级服务器回调主机公钥
+	if err = conf.Jump.OnNewHostKey("inner-key"); err != nil {
+		t.Fatal(err)
+	}
+	if err = conf.OnNewHostKey("app-key"); err != nil {
+		t.Fatal(err)
+	}
+	srv.saveHostKeys(pins)
+	for _, want := range []*model.Server{{ID: bastion.ID, HostKey: "bastion-key"}, {ID: inner.ID, HostKey: "inner-key"}, {ID: app.ID, HostKey: "app-key"}} {
+		got := model.Server{}
+		if err = db.First(&got, want.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		if got.HostKey != want.HostKey {
+			t.Errorf("server %s host key %q, want %q", got.Host, got.HostKey, want.HostKey)
+		}
+	}
+
+	//已记录后各级都校验记录的公钥
+	app.HostKey = ""
+	if err = db.First(app, app.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if conf, pins, err = srv.sshConfig(app); err != nil || len(pins) != 0 || conf.Jump.HostKey != "inner-key" {
+		t.Fatalf("pins %d, err %v", len(pins), err)
+	}
+}
@@ -3,26 +3,30 @@ package server
 import "yema.dev/app/pkg/db"
 
 type CreateReq struct {
-	SpaceId     int64  `json:"-" binding:"required,gt=0"`
-	Name        string `json:"name" binding:"required,max=100"`
-	User        string `json:"user" binding:"required,max=30"`
-	Host        string `json:"host" binding:"required,ip"`
-	Port        int    `json:"port" binding:"required,min=22,max=65535"`
-	Description string `json:"description" binding:"omitempty,max=500"`
+	SpaceId      int64  `json:"-" binding:"required,gt=0"`
+	Name         string `json:"name" binding:"required,max=100"`
+	User         string `json:"user" binding:"required,max=30"`
+	Host         string `json:"host" binding:"required,ip"`
+	Port         int    `json:"port" binding:"required,min=22,max=65535"`
+	CredentialId int64  `json:"credential_id" binding:"omitempty,gte=0"`
+	JumpServerId int64  `json:"jump_server_id" binding:"omitempty,gte=0"`
+	Description  string `json:"description" binding:"omitempty,max=500"`
 }
 
 type UpdateReq struct {
-	SpaceId     int64  `json:"-" binding:"required,gt=0"`
-	ID          int64  `json:"id" binding:"required,gt=0"`
-	Name        string `json:"name" binding:"required,max=100"`
-	User        string `json:"user" binding:"required,max=30"`
-	Host        string `json:"host" binding:"required,ip"`
-	Port        int    `json:"port" binding:"required,min=22,max=65535"`
-	Description string `json:"description" binding:"omitempty,max=500"`
+	SpaceId      int64  `json:"-" binding:"required,gt=0"`
+	ID           int64  `json:"id" binding:"required,gt=0"`
+	Name         string `json:"name" binding:"required,max=100"`
+	User         string `json:"user" binding:"required,max=30"`
+	Host         string `json:"host" binding:"required,ip"`
+	Port         int    `json:"port" binding:"required,min=22,max=65535"`
+	CredentialId int64  `json:"credential_id" binding:"omitempty,gte=0"`
+	JumpServerId int64  `json:"jump_server_id" binding:"omitempty,gte=0"`
+	Description  string `json:"description" binding:"omitempty,max=500"`
 }
 
 func (r *UpdateReq) Fields() []string {
-	return []string{"name", "user", "host", "port", "description"}
+	return []string{"name", "user", "host", "port", "credential_id", "jump_server_id", "description"}
 }
 
 type SetAuthorizedReq struct {
@@ -31,6 +35,12 @@ type SetAuthorizedReq struct {
 	Password string `json:"password" binding:"required,max=100"`
 }
 
+type HostKeyResp struct {
+	HostKey     string `json:"host_key"`
+	Type        string `json:"type"`
+	Fingerprint string `json:"fingerprint"`
+}
+
 type ListReq struct {
 	SpaceId int64 `json:"-" binding:"required,gt=0"`
 	//Name string `json:"name" binding:"omitempty,max=100" search:"table:servers;column:name;type:contains"`
@@ -36,19 +36,27 @@ func (srv *Service) List(params *ListReq) (total int64, list []*model.Server, er
 	if err != nil || total == 0 {
 		return
 	}
-	err = _db.Scopes(params.PageQuery()).Find(&list).Error
+	err = _db.Scopes(params.PageQuery()).Preload("Credential").Preload("Jump").Find(&list).Error
 	return
 }
 
 func (srv *Service) Create(params *CreateReq) error {
 	m := &model.Server{
-		SpaceId:     params.SpaceId,
-		Name:        params.Name,
-		Host:        params.Host,
-		Port:        params.Port,
-		User:        params.User,
-		Status:      field.StatusDisable,
-		Description: params.Description,
+		SpaceId:      params.SpaceId,
+		Name:         params.Name,
+		Host:         params.Host,
+		Port:         params.Port,
+		User:         params.User,
+		CredentialId: params.CredentialId,
+		JumpServerId: params.JumpServerId,
+		Status:       field.StatusDisable,
+		Description:  params.Description,
+	}
+	if err := srv.checkCredential(m.SpaceId, m.CredentialId); err != nil {
+		return err
+	}
+	if err := srv.checkJumpServer(m.SpaceId, 0, m.JumpServerId); err != nil {
+		return err
 	}
 	_m, err := srv.FindByHostIp(m.SpaceId, m.User, m.Host, m.Port)
 	if err != nil {
@@ -68,10 +76,38 @@ func (srv *Service) Update(params *UpdateReq) error {
 	if _m.ID != 0 && _m.ID != params.ID {
 		return errors.New("更新错误")
 	}
-	return srv.db.Model(model.Server{}).Select(params.Fields()).Where(model.Server{SpaceId: params.SpaceId, ID: params.ID}).Updates(params).Error
+	if err = srv.checkCredential(params.SpaceId, params.CredentialId); err != nil {
+		return err
+	}
+	if err = srv.checkJumpServer(params.SpaceId, params.ID, params.JumpServerId); err != nil {
+		return err
+	}
+	m := model.Server{}
+	if err = srv.db.Where(model.Server{SpaceId: params.SpaceId, ID: params.ID}).First(&m).Error; err != nil {
+		return err
+	}
+	return srv.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(model.Server{}).Select(params.Fields()).Where(model.Server{SpaceId: params.SpaceId, ID: params.ID}).Updates(params).Error
+		if err != nil {
+			return err
+		}
+		//更换了主机地址，需要重新校验连接记录主机公钥
+		if m.Host != params.Host || m.Port != params.Port {
+			return tx.Model(&m).UpdateColumns(map[string]any{"host_key": "", "status": field.StatusDisable}).Error
+		}
+		return nil
+	})
 }
 
 func (srv *Service) Delete(spaceWith *common.SpaceWithId) error {
+	var total int64
+	err := srv.db.Model(&model.Server{}).Where("space_id = ? and jump_server_id = ?", spaceWith.SpaceId, spaceWith.ID).Count(&total).Error
+	if err != nil {
+		return err
+	}
+	if total > 0 {
+		return errors.New("还有服务器使用该服务器作为跳板机，不允许删除")
+	}
 	return srv.db.Transaction(func(tx *gorm.DB) error {
 		err := tx.Model(&model.Server{ID: spaceWith.ID}).Association("Projects").Clear()
 		if err != nil {
@@ -96,3 +132,52 @@ func (srv *Service) FindByHostIp(spaceId int64, user, host string, port int) (m
 	}
 	return
 }
+
+// checkCredential 登录凭据必须属于同一空间
+func (srv *Service) checkCredential(spaceId, credentialId int64) error {
+	if credentialId == 0 {
+		return nil
+	}
+	var total int64
+	err := srv.db.Model(&model.Credential{}).Where("space_id = ? and id = ?", spaceId, credentialId).Count(&total).Error
+	if err != nil {
+		return err
+	}
+	if total == 0 {
+		return errors.New("登录凭据不存在")
+	}
+	return nil
+}
+
+// checkJumpServer 跳板机必须属于同一空间，不能循环引用，嵌套不超过common.MaxJumpDepth层
+func (srv *Service) checkJumpServer(spaceId, id, jumpServerId int64) error {
+	if jumpServerId == 0 {
+		return nil
+	}
+	if jumpServerId == id {
+		return errors.New("跳板机不能是服务器自己")
+	}
+	for depth, cur := 1, jumpServerId; cur > 0; depth++ {
+		if depth > common.MaxJumpDepth {
+			return fmt.Errorf("跳板机最多嵌套%d层", common.MaxJumpDepth)
+		}
+		jump := model.Server{}
+		err := srv.db.Where("space_id = ? and id = ?", spaceId, cur).First(&jump).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errors.New("跳板机不存在")
+		}
+		if err != nil {
+			return err
+		}
+		if id > 0 && jump.JumpServerId == id {
+			return errors.New("跳板机不能循环引用")
+		}
+		cur = jump.JumpServerId
+	}
+	return nil
+}
+
+// SshPool ssh连接池状态
+func (srv *Service) SshPool() ssh.PoolStats {
+	return srv.ssh.Stats()
+}
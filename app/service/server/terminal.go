@@ -47,14 +47,20 @@ func (srv *Service) Check(spaceWithId *common.SpaceWithId) error {
 	if err != nil {
 		return err
 	}
-	output, err := srv.ssh.RunCmd(ssh.ServerConfig{
-		User: serverDetail.User,
-		Host: serverDetail.Host,
-		Port: serverDetail.Port,
-	}, "pwd")
+	conf, pins, err := srv.sshConfig(&serverDetail)
+	if err != nil {
+		return err
+	}
+	output, err := srv.ssh.RunCmd(conf, "pwd")
 	srv.log.Debug("CheckConnect", zap.String("cmd", "pwd"), zap.ByteString("output", output), zap.Error(err))
+	if err == nil {
+		srv.saveHostKeys(pins)
+	}
 	if err != nil && serverDetail.Status.IsEnable() {
-		return srv.db.Model(&serverDetail).Where("id=?", serverDetail.ID).UpdateColumn("status", field.StatusDisable).Error
+		if _err := srv.db.Model(&serverDetail).Where("id=?", serverDetail.ID).UpdateColumn("status", field.StatusDisable).Error; _err != nil {
+			return _err
+		}
+		return err
 	}
 	if err == nil && serverDetail.Status.IsDisable() {
 		return srv.db.Model(&serverDetail).Where("id=?", serverDetail.ID).UpdateColumn("status", field.StatusEnable).Error
@@ -71,21 +77,23 @@ func (srv *Service) SetAuthorized(params *SetAuthorizedReq) error {
 	if serverDetail.Status.IsEnable() {
 		return errors.New("该服务器能正常连接，无需设置")
 	}
-	signer := srv.ssh.GetIdentitySigner()
+	conf, pins, err := srv.sshConfig(&serverDetail)
+	if err != nil {
+		return err
+	}
+	//服务器使用密钥凭据时添加该凭据的公钥
+	signer, err := srv.ssh.Signer(conf)
 	if err != nil {
 		return err
 	}
 	hostname, _ := os.Hostname()
 	publicKeyStr := fmt.Sprintf("%s %s %s", signer.PublicKey().Type(), base64.StdEncoding.EncodeToString(signer.PublicKey().Marshal()), hostname)
 	runCmd := fmt.Sprintf("mkdir -p $HOME/.ssh && echo '%s' >> $HOME/.ssh/authorized_keys && chmod 600 $HOME/.ssh/authorized_keys", publicKeyStr)
-	output, err := srv.ssh.RunCmd(ssh.ServerConfig{
-		User:     serverDetail.User,
-		Host:     serverDetail.Host,
-		Password: params.Password,
-		Port:     serverDetail.Port,
-	}, runCmd)
+	conf.Password = params.Password
+	output, err := srv.ssh.RunCmd(conf, runCmd)
 	srv.log.Debug("Setting", zap.String("cmd", runCmd), zap.ByteString("output", output), zap.Error(err))
 	if err == nil {
+		srv.saveHostKeys(pins)
 		_err := srv.db.Model(&serverDetail).Where("id=?", serverDetail.ID).UpdateColumn("status", field.StatusEnable).Error
 		if _err != nil {
 			srv.log.Error("更新数据库失败", zap.Int64("server_id", serverDetail.ID), zap.Int("status", field.StatusEnable))
@@ -116,12 +124,12 @@ func (srv *Service) Terminal(wsConn *websocket.Conn, spaceWithId *common.SpaceWi
 	if err = wsSendMsg("正在连接服务器...", successMsg); err != nil {
 		return err
 	}
-	sshTerminal, err := srv.ssh.NewTerminal(ssh.ServerConfig{
-		User:     serverDetail.User,
-		Host:     serverDetail.Host,
-		Password: "",
-		Port:     serverDetail.Port,
-	}, 200, 40)
+	sshConf, err := common.SshConfig(srv.db, &serverDetail)
+	if err != nil {
+		_ = wsSendMsg(err.Error(), errorMsg)
+		return err
+	}
+	sshTerminal, err := srv.ssh.NewTerminal(sshConf, 200, 40)
 	if err != nil {
 		_ = wsSendMsg(err.Error(), errorMsg)
 		return err
@@ -1,7 +1,11 @@
 package service
 
-import "yema.dev/app/service/deploy"
+import (
+	"yema.dev/app/service/deploy"
+	"yema.dev/app/service/notice"
+)
 
 type Config struct {
 	Deploy deploy.Config
+	Notice notice.Config
 }
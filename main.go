@@ -17,6 +17,7 @@ import (
 	"yema.dev/app/migration"
 	db2 "yema.dev/app/pkg/db"
 	log3 "yema.dev/app/pkg/log"
+	"yema.dev/app/pkg/secret"
 	"yema.dev/app/version"
 )
 
@@ -63,7 +64,7 @@ var (
 	}
 	migrationCmd = &cobra.Command{
 		Use:   "migration",
-		Short: "数据库迁移初始化等操作,可选[init_tables|init_admin|mock|default]",
+		Short: "数据库迁移初始化等操作,可选[init_tables|init_admin|mock|default|encrypt_secrets]",
 		Args:  cobra.ExactArgs(1),
 		RunE:  cmdMigration,
 	}
@@ -144,6 +145,12 @@ func cmdMigration(cmd *cobra.Command, args []string) error {
 		return mr.MockDefaultData()
 	case "default":
 		return errs.Combine(mr.InitTables(), mr.InitAdminAccount())
+	case "encrypt_secrets":
+		s, err := secret.NewSecret(&migrationCfg.Secret)
+		if err != nil {
+			return err
+		}
+		return mr.EncryptSecrets(s)
 	}
 	return fmt.Errorf("arg[%s] error", args[0])
 }